@@ -5,15 +5,20 @@ go 1.23
 require (
 	git.sr.ht/~sircmpwn/getopt v1.0.0
 	github.com/ahrtr/gocontainer v0.3.0
+	github.com/bazelbuild/remote-apis v0.0.0-20260120202631-b02e15a6d354
 	github.com/edwingeng/deque v1.0.3
 	github.com/fatih/color v1.18.0
 	github.com/glebarez/sqlite v1.11.0
 	github.com/go-co-op/gocron/v2 v2.12.4
+	github.com/google/uuid v1.6.0
 	github.com/mikoim/go-loadavg v0.0.0-20150917074714-35ece5f6d547
 	github.com/segmentio/fasthash v1.0.3
 	github.com/tevino/abool/v2 v2.1.0
 	github.com/valyala/fasthttp v1.57.0
 	github.com/zeebo/blake3 v0.2.4
+	google.golang.org/genproto/googleapis/bytestream v0.0.0-20240812133136-8ffd90a71988
+	google.golang.org/grpc v1.65.0
+	google.golang.org/protobuf v1.34.2
 	gorm.io/gorm v1.25.12
 	gorm.io/plugin/soft_delete v1.2.1
 	lukechampine.com/uint128 v1.3.0
@@ -21,10 +26,10 @@ require (
 )
 
 require (
+	cloud.google.com/go/longrunning v0.5.12 // indirect
 	github.com/andybalholm/brotli v1.1.1 // indirect
 	github.com/dustin/go-humanize v1.0.1 // indirect
 	github.com/glebarez/go-sqlite v1.21.2 // indirect
-	github.com/google/uuid v1.6.0 // indirect
 	github.com/jinzhu/inflection v1.0.0 // indirect
 	github.com/jinzhu/now v1.1.5 // indirect
 	github.com/jonboulle/clockwork v0.4.0 // indirect
@@ -37,8 +42,11 @@ require (
 	github.com/robfig/cron/v3 v3.0.1 // indirect
 	github.com/valyala/bytebufferpool v1.0.0 // indirect
 	golang.org/x/exp v0.0.0-20240613232115-7f521ea00fb8 // indirect
+	golang.org/x/net v0.30.0 // indirect
 	golang.org/x/sys v0.26.0 // indirect
 	golang.org/x/text v0.19.0 // indirect
+	google.golang.org/genproto/googleapis/api v0.0.0-20240812133136-8ffd90a71988 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20240812133136-8ffd90a71988 // indirect
 	modernc.org/libc v1.55.3 // indirect
 	modernc.org/mathutil v1.6.0 // indirect
 	modernc.org/memory v1.8.0 // indirect
@@ -0,0 +1,53 @@
+package model
+
+// ActionEntry is an action cache record: what running an action produced,
+// all of its outputs, its depfile and the deps it discovered, found by the
+// action's key.  The
+// contents of the outputs are in the CAS, addressed by their digests.
+type ActionEntry struct {
+	ID int64 `json:"-" gorm:"primarykey"`
+	// 动作的键，客户端计算的 blake3
+	Key      string `json:"key" gorm:"index:idx_action_key,unique"`
+	Instance string `json:"instance" gorm:"index:idx_action_instance"`
+	// 命令行的HASH值
+	CommandHash string `json:"command_hash"`
+	// 输入文件的HASH
+	InputHash string `json:"input_hash"`
+	// 开始时间
+	StartTime int64 `json:"start_time"`
+	// 结束时间
+	EndTime int64 `json:"end_time"`
+	//
+	Outputs []*OutputEntry `json:"outputs" gorm:"foreignKey:PID"`
+	// depfile 的内容
+	Depfile string `json:"depfile"`
+	// 命令发现的依赖，比如头文件
+	Deps []*DepsEntry `json:"deps" gorm:"foreignKey:PID"`
+	//
+	CreatedAt  int64 `json:"-"`
+	LastAccess int64 `json:"-" gorm:"index:idx_action_last_access"`
+	// 过期时间，秒
+	ExpiredDuration int64 `json:"-"`
+}
+
+func (ActionEntry) TableName() string {
+	return "action_entry"
+}
+
+// OutputEntry is one output of an action.
+type OutputEntry struct {
+	ID int64 `json:"-" gorm:"primarykey"`
+	// 所属动作的ID
+	PID int64 `json:"-" gorm:"column:pid;index:idx_output_pid"`
+	// 文件路径
+	Path string `json:"path"`
+	// 文件内容的 blake3，CAS 中的地址
+	Digest string `json:"digest" gorm:"index:idx_output_digest"`
+	Size   int64  `json:"size"`
+	// 文件权限
+	Mode uint32 `json:"mode"`
+}
+
+func (OutputEntry) TableName() string {
+	return "output_entry"
+}
@@ -2,16 +2,18 @@ package model
 
 import "gorm.io/plugin/soft_delete"
 
+// DepsEntry is a dependency an action discovered while it ran, such as a
+// header, with the blake3 its contents had then.
 type DepsEntry struct {
-	ID int64 `gorm:"primarykey"`
+	ID int64 `json:"-" gorm:"primarykey"`
 	// 文件路径
-	FilePath string
+	FilePath string `json:"path"`
 	// 本文件的HASH值
-	FileHash string
-	// 被谁依赖的节点的ID
-	PID int64 `json:"pid" gorm:"index:idx_pid"`
+	FileHash string `json:"hash"`
+	// 所属动作的ID
+	PID int64 `json:"-" gorm:"column:pid;index:idx_pid"`
 	/* 0 false 1 true */
-	Deleted soft_delete.DeletedAt `gorm:"softDelete:flag;default:0"`
+	Deleted soft_delete.DeletedAt `json:"-" gorm:"softDelete:flag;default:0"`
 }
 
 func (DepsEntry) TableName() string {
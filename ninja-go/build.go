@@ -1,10 +1,16 @@
 package main
 
 import (
+	"bytes"
 	"github.com/edwingeng/deque"
 	"log"
 	"math"
 	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type EdgeResult int8
@@ -50,14 +56,43 @@ type BuildConfig struct {
 	RbeService string
 	// RBE Instance
 	RbeInstance string
+	/// How many files may be hashed concurrently while scanning for dirty
+	/// nodes.
+	HashParallelism int
+	/// Default limit on the run time of a command, 0 for none.  Edges can
+	/// override it with a "timeout" binding.
+	JobTimeout time.Duration
+	/// Act as a GNU make jobserver for our children when we are not running
+	/// under one already.
+	Jobserver bool
+	/// The memory, in bytes, that must be left available when starting a
+	/// command, on top of what its edge's "memory" binding asks for.  0 means
+	/// that we only honour the bindings.
+	MinAvailableMemory int64
+	/// Run every command in a sandbox, unless its edge sets "sandbox = 0".
+	Sandbox bool
+	/// Trace the files every command accesses and warn about those its edge
+	/// doesn't declare.
+	TraceAccess bool
+	/// How edges tell whether their inputs changed, unless they set a "hash"
+	/// binding.
+	HashMode HashMode
+	/// Where to write the build events as newline-delimited JSON, if anywhere:
+	/// a file, or a Unix socket someone listens on.
+	EventsPath string
+	/// How many commands may run at once on the workers of the ninja-rbe
+	/// RbeService names, on top of the Parallelism local ones.  0 runs
+	/// everything locally.
+	RemoteJobs int
 }
 
 func NewBuildConfig() *BuildConfig {
 	ret := BuildConfig{Verbosity: NORMAL, DryRun: false,
 		Parallelism: 1, FailuresAllowed: 1,
-		MaxLoadAverage: -0.0,
-		RbeInstance:    "main",
-		RbeService:     "http://localhost:8080",
+		MaxLoadAverage:  -0.0,
+		RbeInstance:     "main",
+		RbeService:      "http://localhost:8080",
+		HashParallelism: GetProcessorCount(),
 	}
 	return &ret
 }
@@ -133,6 +168,14 @@ type Result struct {
 	edge   *Edge
 	status ExitStatus
 	output string
+	/// The command's exit code, or -1 if it was killed by a signal.
+	exit_code int
+	/// Set by FinishCommand when the failed edge was queued to run again.
+	retried bool
+	/// The files the command accessed, if it was traced and succeeded.
+	accesses *FileAccesses
+	/// The contents of the depfile, kept by ExtractDeps() before it deleted it.
+	depfile string
 }
 
 func NewResult() *Result {
@@ -148,10 +191,18 @@ type CommandRunner interface {
 	WaitForCommand(result *Result) bool
 	GetActiveEdges() []*Edge
 	CanRunMore() int64
+	/// Whether there is enough memory left to start |edge| now.
+	CanRunEdge(edge *Edge) bool
 	Abort()
 }
 
 func CommandRunnerfactory(config *BuildConfig) CommandRunner {
+	if config.RemoteJobs > 0 {
+		if config.RbeService != "" && !IsReapiService(config.RbeService) {
+			return NewRemoteCommandRunner(config)
+		}
+		Warning("--remote-jobs needs a ninja-rbe service on -r; running commands locally")
+	}
 	return NewRealCommandRunner(config)
 }
 
@@ -180,6 +231,10 @@ func (d *DryRunCommandRunner) GetActiveEdges() []*Edge {
 	return []*Edge{}
 }
 
+func (d *DryRunCommandRunner) CanRunEdge(edge *Edge) bool {
+	return true
+}
+
 func (d *DryRunCommandRunner) Abort() {}
 
 func NewBuilder(state *State, config *BuildConfig, build_log *BuildLog,
@@ -206,12 +261,18 @@ func NewBuilder(state *State, config *BuildConfig, build_log *BuildLog,
 		ret.lock_file_path_ = build_dir + "/" + ret.lock_file_path_
 	}
 	ret.status_.SetExplanations(ret.explanations_)
+	if build_log != nil {
+		build_log.status_ = status
+	}
 	return &ret
 }
 
 func (this *Builder) RealeaseBuilder() {
 	this.Cleanup()
 	this.status_.SetExplanations(nil)
+	if build_log := this.scan_.build_log(); build_log != nil {
+		build_log.status_ = nil
+	}
 }
 
 // / Clean up after interrupted commands by deleting output files.
@@ -327,12 +388,20 @@ func (this *Builder) Build(err *string) bool {
 		// See if we can start any more commands.
 		if failures_allowed != 0 {
 			capacity := this.command_runner_.CanRunMore()
+			deferred := []*Edge{}
 			for capacity > 0 {
 				edge := this.plan_.FindWork()
 				if edge == nil {
 					break
 				}
 
+				if pending_commands > 0 && !this.command_runner_.CanRunEdge(edge) {
+					// Not enough memory for it yet; try it again once a
+					// running command has finished and freed some.
+					deferred = append(deferred, edge)
+					continue
+				}
+
 				if edge.GetBindingBool("generator") {
 					this.scan_.build_log().Close()
 				}
@@ -361,6 +430,9 @@ func (this *Builder) Build(err *string) bool {
 					}
 				}
 			}
+			for _, edge := range deferred {
+				this.plan_.ReturnWork(edge)
+			}
 
 			// We are finished with all work items and have no pending
 			// commands. Therefore, break out of the main loop.
@@ -387,7 +459,7 @@ func (this *Builder) Build(err *string) bool {
 				return false
 			}
 
-			if !result.success() {
+			if !result.success() && !result.retried {
 				if failures_allowed != 0 {
 					failures_allowed--
 				}
@@ -471,6 +543,15 @@ func (this *Builder) StartEdge(edge *Edge, err *string) bool {
 		}
 	}
 
+	// A restat rule may leave its outputs alone; remember what they hold so
+	// that we can tell once it finished.
+	if edge.GetBindingBool("restat") && !this.config_.DryRun {
+		edge.restat_digests_ = make([][]byte, len(edge.outputs_))
+		for i, o := range edge.outputs_ {
+			edge.restat_digests_[i], _ = o.Digest()
+		}
+	}
+
 	// start command computing and run it
 	if !this.command_runner_.StartCommand(edge) {
 		*err = "command '" + edge.EvaluateCommand(false) + "' failed."
@@ -508,6 +589,9 @@ func (this *Builder) FinishCommand(result *Result, err *string) bool {
 			result.status = ExitFailure
 		}
 	}
+	if this.config_.TraceAccess && result.accesses != nil {
+		this.ReportUndeclaredAccesses(result, deps_nodes)
+	}
 	//if depfile != "" {
 	//	var slash_bits uint64 = 0
 	//	CanonicalizePath(&depfile, &slash_bits)
@@ -521,8 +605,37 @@ func (this *Builder) FinishCommand(result *Result, err *string) bool {
 	end_time_millis = GetTimeMillis() - this.start_time_millis_
 	delete(this.running_edges_, edge)
 
+	if GTracer != nil {
+		args := map[string]string{"command": edge.EvaluateCommand(false)}
+		if !result.success() {
+			args["failed"] = "true"
+		}
+		if edge.retries_ != 0 {
+			args["retry"] = strconv.Itoa(edge.retries_)
+		}
+		GTracer.AddEdge(edge, this.start_time_millis_+start_time_millis,
+			this.start_time_millis_+end_time_millis, args)
+	}
+
+	if !result.success() && this.ShouldRetry(result) {
+		edge.retries_++
+		result.retried = true
+		this.status_.BuildEdgeRetried(edge, start_time_millis, end_time_millis,
+			result.status, result.exit_code, result.output)
+		for _, o := range edge.outputs_ {
+			o.ResetDigest()
+		}
+		this.plan_.RetryEdge(edge)
+		return true
+	}
+
 	this.status_.BuildEdgeFinished(edge, start_time_millis, end_time_millis,
-		result.success(), result.output)
+		result.status, result.exit_code, result.output)
+
+	// The command may have rewritten its outputs; forget their old digests.
+	for _, o := range edge.outputs_ {
+		o.ResetDigest()
+	}
 
 	// The rest of this function only applies to successful commands.
 	if !result.success() {
@@ -531,41 +644,46 @@ func (this *Builder) FinishCommand(result *Result, err *string) bool {
 
 	// Restat the edge outputs
 	var record_mtime TimeStamp = 0
+	var record_inputs_mtime TimeStamp = 0
 	if !this.config_.DryRun {
-		restat := edge.GetBindingBool("restat")
-		generator := edge.GetBindingBool("generator")
-		// node_cleaned := false
-		// record_mtime = edge.command_start_time_
-
-		// restat and generator rules must restat the outputs after the build
-		// has finished. if record_mtime == 0, then there was an error while
-		// attempting to touch/stat the temp file when the edge started and
-		// we should fall back to recording the outputs' current mtime in the
-		// log.
-		if record_mtime == 0 || restat || generator {
+		// The log records the state of the inputs that the outputs are now up
+		// to date with, whether or not the command rewrote them.  Taken from
+		// the inputs rather than StatNode(), so that it is also right for
+		// outputs a restat rule didn't create.  Rules that only go by mtimes
+		// skip the hashes.
+		var err1 error
+		if edge.GetHashMode(this.config_) != kHashMtime {
+			record_mtime, _, err1 = NodesHash(edge.inputs_, this.scan_.PrefixDir)
+		}
+		if err1 == nil {
+			record_inputs_mtime, err1 = NodesMtime(this.disk_interface_, edge.inputs_)
+		}
+		if err1 != nil {
+			*err = err1.Error()
+			return false
+		}
+
+		// Early cutoff: outputs left or rewritten with the same contents leave
+		// the dependents that only wait on them up to date.  A restat rule
+		// compares with the contents its outputs had when it started; any
+		// other rule with those they had after the last build.
+		unchanged := false
+		if edge.restat_digests_ != nil {
+			unchanged = this.OutputsUnchangedSinceStart(edge)
+		} else {
+			unchanged = this.OutputsUnchanged(edge)
+		}
+		if unchanged {
+			// Propagate the clean state through the build graph.  Note that
+			// this also applies to outputs that still don't exist.
 			for _, o := range edge.outputs_ {
-				new_mtime, _, err1 := this.disk_interface_.StatNode(o)
-				if err1 != nil {
+				if !this.plan_.CleanNode(this.scan_, o, err) {
 					return false
 				}
-				if new_mtime != record_mtime {
-					record_mtime = new_mtime
-				}
-				if (*o).mtime() == new_mtime && restat {
-					// The rule command did not change the output.  Propagate the clean
-					// state through the build graph.
-					// Note that this also applies to nonexistent outputs (mtime == 0).
-					if !this.plan_.CleanNode(this.scan_, o, err) {
-						return false
-					}
-					// node_cleaned = true
-				}
 			}
 		}
-		//if node_cleaned {
-		//	record_mtime = edge.command_start_time_
-		//}
 	}
+	edge.restat_digests_ = nil
 
 	if !this.plan_.EdgeFinished(edge, kEdgeSucceeded, err) {
 		return false
@@ -578,8 +696,16 @@ func (this *Builder) FinishCommand(result *Result, err *string) bool {
 	}
 
 	if this.scan_.build_log() != nil {
-		if !this.scan_.build_log().RecordCommand(edge, deps_nodes, int(start_time_millis),
-			int(end_time_millis), record_mtime) {
+		// The remote cache stores the depfile with the outputs; those that
+		// aren't read into the deps log are still on disk.
+		depfile_content := result.depfile
+		if deps_type == "" && edge.GetUnescapedDepfile() != "" && !this.config_.DryRun {
+			read_err := ""
+			this.disk_interface_.ReadFile(edge.GetUnescapedDepfile(), &depfile_content, &read_err)
+			depfile_content = strings.TrimSuffix(depfile_content, "\x00")
+		}
+		if !this.scan_.build_log().RecordCommand(edge, deps_nodes, depfile_content, int(start_time_millis),
+			int(end_time_millis), record_mtime, record_inputs_mtime) {
 			*err = string("Error writing to build log: ") + *err
 			return false
 		}
@@ -603,6 +729,54 @@ func (this *Builder) FinishCommand(result *Result, err *string) bool {
 	return true
 }
 
+// / Whether the outputs of |edge|, whose command just succeeded, hash the same
+// / as the build log recorded after their previous build.  Outputs the log
+// / has no hash for count as changed.
+func (this *Builder) OutputsUnchanged(edge *Edge) bool {
+	build_log := this.scan_.build_log()
+	if build_log == nil || len(edge.outputs_) == 0 {
+		return false
+	}
+	for _, o := range edge.outputs_ {
+		entry, ok := build_log.entries_[o.path()]
+		if !ok || entry.output_hash == "" {
+			return false
+		}
+		hash, err := OutputHash(o, build_log.PrefixDir)
+		if err != nil || hash != entry.output_hash {
+			return false
+		}
+	}
+	return true
+}
+
+// / Whether the outputs of the restat |edge|, whose command just succeeded,
+// / hold what they did when it started, or are still missing.
+func (this *Builder) OutputsUnchangedSinceStart(edge *Edge) bool {
+	for i, o := range edge.outputs_ {
+		digest, err := o.Digest()
+		if err != nil {
+			digest = nil
+		}
+		if !bytes.Equal(digest, edge.restat_digests_[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// / Whether the failed command of |result| should be run again instead of
+// / failing its edge: the edge must have retries left and, if it limits them
+// / to some exit codes, the command must have exited with one of those.
+func (this *Builder) ShouldRetry(result *Result) bool {
+	edge := result.edge
+	if edge.retries_ >= edge.GetRetries() {
+		return false
+	}
+	codes := edge.GetRetryExitCodes()
+	return len(codes) == 0 || slices.Contains(codes, result.exit_code)
+}
+
 // / Used for tests.
 func (this *Builder) SetBuildLog(log *BuildLog) {
 	this.scan_.set_build_log(log)
@@ -642,6 +816,8 @@ func (this *Builder) ExtractDeps(result *Result, deps_type string, deps_prefix s
 		if content == "" {
 			return true
 		}
+		// ReadFile() ends the contents with a NUL for the parser.
+		result.depfile = strings.TrimSuffix(content, "\x00")
 
 		deps := NewDepfileParser(this.config_.DepfileParserOptions)
 		if !deps.Parse([]byte(content), err) {
@@ -663,6 +839,20 @@ func (this *Builder) ExtractDeps(result *Result, deps_type string, deps_prefix s
 			}
 		}
 		*p_depfile = depfile
+	} else if deps_type == "trace" {
+		if result.accesses == nil {
+			if result.success() {
+				*err = "no file accesses were traced for deps=trace"
+				return false
+			}
+			return true
+		}
+		// Everything the command read but didn't produce itself.
+		for _, path := range result.accesses.reads_ {
+			var slash_bits uint64 = 0
+			CanonicalizePath(&path, &slash_bits)
+			*deps_nodes = append(*deps_nodes, this.state_.GetNode(path, slash_bits))
+		}
 	} else {
 		log.Fatalf("unknown deps type '%s'", deps_type)
 	}
@@ -670,6 +860,59 @@ func (this *Builder) ExtractDeps(result *Result, deps_type string, deps_prefix s
 	return true
 }
 
+// / Append a warning to |result|'s output for every file of the build tree
+// / its command read or wrote that its edge doesn't declare: as an input,
+// / one of the deps in |deps_nodes| or the deps log, or an output.
+func (this *Builder) ReportUndeclaredAccesses(result *Result, deps_nodes []*Node) {
+	edge := result.edge
+	root, err := os.Getwd()
+	if err != nil {
+		return
+	}
+	declared := map[string]bool{}
+	declare := func(path string) {
+		if path != "" {
+			RecordAccess(declared, root, filepath.Join(root, path), false)
+		}
+	}
+	for _, nodes := range [][]*Node{edge.inputs_, edge.outputs_, deps_nodes} {
+		for _, node := range nodes {
+			declare(node.path())
+		}
+	}
+	if this.scan_.deps_log() != nil {
+		for _, output := range edge.outputs_ {
+			if deps := this.scan_.deps_log().GetDeps(output); deps != nil {
+				for _, node := range deps.nodes {
+					declare(node.path())
+				}
+			}
+		}
+	}
+	declare(edge.GetUnescapedDepfile())
+	declare(edge.GetUnescapedRspfile())
+
+	warnings := ""
+	for _, path := range result.accesses.reads_ {
+		if _, ok := declared[path]; !ok {
+			warnings += "ninja: warning: read '" + path + "', which is not a declared input\n"
+		}
+	}
+	for _, path := range result.accesses.writes_ {
+		// Skip temporary files, which are gone again.
+		if _, ok := declared[path]; ok {
+			continue
+		}
+		if _, err := os.Lstat(path); err == nil {
+			warnings += "ninja: warning: wrote '" + path + "', which is not a declared output\n"
+		}
+	}
+	if warnings != "" && result.output != "" && !strings.HasSuffix(result.output, "\n") {
+		result.output += "\n"
+	}
+	result.output += warnings
+}
+
 // / Load the dyndep information provided by the given node.
 func (this *Builder) LoadDyndeps(node *Node, err *string) bool {
 	// Load the dyndep information provided by this node.
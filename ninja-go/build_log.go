@@ -2,12 +2,16 @@ package main
 
 import (
 	"bufio"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
+	"log"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 )
 
 type BuildLog struct {
@@ -17,6 +21,14 @@ type BuildLog struct {
 	needs_recompaction_ bool
 	config_             *BuildConfig
 	PrefixDir           string
+	/// Told about remote cache lookups while a Builder uses the log.
+	status_ Status
+	/// The Remote Execution API cache -r names, dialed on first use.
+	reapi_once_ sync.Once
+	reapi_      *ReapiCache
+	/// Remote cache hits restored, by RbeActionKey().  Misses aren't kept,
+	/// the next build in the same process may find the result there.
+	remote_hits_ map[string]*RemoteHit
 }
 
 type LogEntry struct {
@@ -26,6 +38,10 @@ type LogEntry struct {
 	start_time   int
 	end_time     int
 	mtime        TimeStamp
+	/// NodesMtime() of the inputs, next to their NodesHash() in mtime.
+	inputs_mtime TimeStamp
+	/// How many times the command failed and was rerun before succeeding.
+	retries int
 }
 type BuildLogUser interface {
 	IsPathDead(path string) bool
@@ -59,13 +75,17 @@ func (this *BuildLog) OpenForWrite(path string, user BuildLogUser, err *string)
 	return true
 }
 
-func (this *BuildLog) RecordCommand(edge *Edge, deps_nodes []*Node, start_time int, end_time int, mtime TimeStamp) bool {
+// / Record that |edge| ran.  |depfile| holds the contents of its depfile,
+// / which the remote cache stores with its outputs and |deps_nodes|.
+func (this *BuildLog) RecordCommand(edge *Edge, deps_nodes []*Node, depfile string, start_time int, end_time int, mtime, inputs_mtime TimeStamp) bool {
 	//if edge.deps_loaded_ {
 	//	depfile := edge.GetUnescapedDepfile()
 	//	//edge.dyndep_
 	//}
 	command := edge.EvaluateCommand(true)
 	command_hash := HashCommand(command)
+	// Rules that only go by mtimes don't hash anything, outputs included.
+	hash_outputs := edge.GetHashMode(this.config_) != kHashMtime
 	for _, out := range edge.outputs_ {
 		path := out.path()
 		second, ok := this.entries_[path]
@@ -80,22 +100,58 @@ func (this *BuildLog) RecordCommand(edge *Edge, deps_nodes []*Node, start_time i
 		log_entry.start_time = start_time
 		log_entry.end_time = end_time
 		log_entry.mtime = mtime
-		if !this.OpenForWriteIfNeeded() {
+		log_entry.inputs_mtime = inputs_mtime
+		log_entry.retries = edge.retries_
+		log_entry.output_hash = ""
+		if hash_outputs {
+			if hash, err1 := OutputHash(out, this.PrefixDir); err1 == nil {
+				log_entry.output_hash = hash
+			}
+		}
+		if !this.AppendEntry(log_entry) {
 			return false
 		}
-		if this.log_file_ != nil {
-			_, err1 := this.WriteEntry(this.log_file_, log_entry)
-			if err1 != nil {
-				return false
-			}
-			err1 = this.log_file_.Sync()
-			if err1 != nil {
-				return false
-			}
+	}
+	// The remote cache records the edge's outputs as one result.
+	if mtime != 0 && command_hash != 0 && this.config_.RbeService != "" {
+		deps, err := RemoteDepsOf(deps_nodes)
+		if err != nil {
+			// A dep that is gone already; a hit couldn't be checked.
+			return true
+		}
+		if IsReapiService(this.config_.RbeService) {
+			this.WriteEdgeReapi(edge, deps, depfile, start_time, end_time)
+		} else {
+			this.WriteEdgeRbe(edge, deps, command_hash, depfile, start_time, end_time, mtime)
 		}
 	}
 	return true
 }
+
+// / Update the input mtimes recorded in |entry|, whose inputs turned out to
+// / have the same contents as when it was built.
+func (this *BuildLog) RecordInputsMtime(entry *LogEntry, inputs_mtime TimeStamp) bool {
+	if entry.inputs_mtime == inputs_mtime || this.entries_[entry.output] != entry {
+		// Unchanged, or an entry of the remote log.
+		return true
+	}
+	entry.inputs_mtime = inputs_mtime
+	return this.AppendEntry(entry)
+}
+
+// / Append |entry| to the log file, if it is open for writing.
+func (this *BuildLog) AppendEntry(entry *LogEntry) bool {
+	if !this.OpenForWriteIfNeeded() {
+		return false
+	}
+	if this.log_file_ == nil {
+		return true
+	}
+	if _, err := this.WriteEntry(this.log_file_, entry); err != nil {
+		return false
+	}
+	return this.log_file_.Sync() == nil
+}
 func (this *BuildLog) Close() {
 	this.OpenForWriteIfNeeded() // create the file even if nothing has been recorded
 	if this.log_file_ != nil {
@@ -105,9 +161,11 @@ func (this *BuildLog) Close() {
 }
 
 // / Load the on-disk log.
+// / Both our own format and upstream ninja's v5-v7 logs are understood; the
+// / latter are rewritten in our format by the next recompaction.
 func (this *BuildLog) Load(path string, err1 *string) LoadStatus {
-	return LOAD_SUCCESS
-
+	METRIC_RECORD(".ninja_log load")
+	defer TraceSpan(kTraceMain, ".ninja_log load", "log")()
 	file, err := os.Open(path)
 	if err != nil {
 		if errors.Is(err, os.ErrNotExist) {
@@ -118,99 +176,159 @@ func (this *BuildLog) Load(path string, err1 *string) LoadStatus {
 	}
 	defer file.Close()
 
+	reader := bufio.NewReader(file)
+	header, err := reader.ReadString('\n')
+	if err != nil && err != io.EOF {
+		*err1 = err.Error()
+		return LOAD_ERROR
+	}
+	if header == "" {
+		// An empty file is what Close() leaves behind when nothing was recorded.
+		return LOAD_SUCCESS
+	}
+
 	logVersion := 0
+	upstream := false
+	if _, err := fmt.Sscanf(header, kFileSignature, &logVersion); err == nil {
+		if logVersion > kCurrentVersion {
+			*err1 = "build log version is too new; starting over"
+			file.Close()
+			os.Remove(path)
+			return LOAD_NOT_FOUND
+		}
+	} else if _, err := fmt.Sscanf(header, kUpstreamFileSignature, &logVersion); err == nil &&
+		logVersion >= kOldestUpstreamVersion && logVersion <= kNewestUpstreamVersion {
+		upstream = true
+	} else {
+		*err1 = "build log version is too old; starting over"
+		file.Close()
+		os.Remove(path)
+		return LOAD_NOT_FOUND
+	}
+
 	uniqueEntryCount := 0
 	totalEntryCount := 0
-
-	reader := bufio.NewReader(file)
+	corruptEntryCount := 0
 	for {
 		line, err := reader.ReadString('\n')
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
+		if err != nil && err != io.EOF {
 			*err1 = err.Error()
 			return LOAD_ERROR
 		}
-		line = strings.TrimSpace(line)
-
-		if logVersion == 0 {
-			_, err := fmt.Sscanf(line, kFileSignature, &logVersion)
-			if err != nil {
-				*err1 = err.Error()
-				return LOAD_ERROR
-			}
-
-			if logVersion < kOldestSupportedVersion {
-				*err1 = fmt.Errorf("build log version is too old; starting over").Error()
-				return LOAD_NOT_FOUND
-			} else if logVersion > kCurrentVersion {
-				*err1 = fmt.Errorf("build log version is too new; starting over").Error()
-				return LOAD_NOT_FOUND
-			}
-		}
-
-		fields := strings.Split(line, "\t")
-		if len(fields) < 4 {
-			continue
+		if line == "" {
+			break
 		}
-
-		startTime, err := strconv.Atoi(fields[0])
-		if err != nil {
-			continue
+		if !strings.HasSuffix(line, "\n") {
+			// The last write was interrupted; the entry is incomplete.
+			corruptEntryCount++
+			break
 		}
-		endTime, err := strconv.Atoi(fields[1])
-		if err != nil {
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
 			continue
 		}
-		mtime, err := strconv.ParseInt(fields[2], 10, 64)
-		if err != nil {
+
+		entry := this.ParseEntry(line, upstream, logVersion)
+		if entry == nil {
+			corruptEntryCount++
 			continue
 		}
-		output := fields[3]
-
-		entry, exists := this.entries_[output]
-		if !exists {
-			entry = &LogEntry{output: output}
-			this.entries_[output] = entry
+		if _, exists := this.entries_[entry.output]; !exists {
 			uniqueEntryCount++
 		}
+		this.entries_[entry.output] = entry
 		totalEntryCount++
-
-		entry.start_time = startTime
-		entry.end_time = endTime
-		entry.mtime = TimeStamp(mtime)
-
-		if len(fields) > 4 {
-			commandHash, err := strconv.ParseUint(fields[4], 16, 64)
-			if err != nil {
-				continue
-			}
-			entry.command_hash = commandHash
-		}
 	}
+
 	// Decide whether it's time to rebuild the log:
 	// - if we're upgrading versions
+	// - if it contains entries we could not read
 	// - if it's getting large
 	kMinCompactionEntryCount := 100
 	kCompactionRatio := 3
-	if logVersion < kCurrentVersion {
+	if upstream || logVersion < kCurrentVersion {
+		this.needs_recompaction_ = true
+	} else if corruptEntryCount > 0 {
 		this.needs_recompaction_ = true
 	} else if totalEntryCount > kMinCompactionEntryCount && totalEntryCount > uniqueEntryCount*kCompactionRatio {
 		this.needs_recompaction_ = true
 	}
 
-	if uniqueEntryCount == 0 {
-		return LOAD_SUCCESS
+	if corruptEntryCount > 0 {
+		// Hack: report this as a warning by returning LOAD_SUCCESS.
+		*err1 = fmt.Sprintf("build log %s: ignored %d corrupt or truncated entries", path, corruptEntryCount)
 	}
 
 	return LOAD_SUCCESS
 }
 
+// / Parse a single log line, returning nil if it is malformed.
+// / Upstream lines carry five fields; ours append the output hash, from v2
+// / on the retry count and from v3 on the inputs' mtimes.
+func (this *BuildLog) ParseEntry(line string, upstream bool, version int) *LogEntry {
+	fieldCount := 8
+	if upstream {
+		fieldCount = 5
+	} else if version < 2 {
+		fieldCount = 6
+	} else if version < 3 {
+		fieldCount = 7
+	}
+	fields := strings.SplitN(line, "\t", fieldCount)
+	if len(fields) != fieldCount || fields[3] == "" {
+		return nil
+	}
+
+	startTime, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return nil
+	}
+	endTime, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return nil
+	}
+	mtime, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return nil
+	}
+	commandHash, err := strconv.ParseUint(fields[4], 16, 64)
+	if err != nil {
+		return nil
+	}
+
+	entry := NewLogEntry1(fields[3], commandHash, startTime, endTime, TimeStamp(mtime))
+	if !upstream {
+		entry.output_hash = fields[5]
+	}
+	if fieldCount > 6 {
+		retries, err := strconv.Atoi(fields[6])
+		if err != nil {
+			return nil
+		}
+		entry.retries = retries
+	}
+	if fieldCount > 7 {
+		inputs_mtime, err := strconv.ParseInt(fields[7], 10, 64)
+		if err != nil {
+			return nil
+		}
+		entry.inputs_mtime = TimeStamp(inputs_mtime)
+	}
+	return entry
+}
+
 // / Lookup a previously-run command by its output path.
-func (this *BuildLog) LookupByOutput(config *BuildConfig, path string, commandHash uint64, currentMtime TimeStamp) *LogEntry {
-	if commandHash != 0 && config.RbeService != "" {
-		e := this.LookupByOutputRbe(config.RbeService, config.RbeInstance, path, commandHash, currentMtime)
+// / The remote cache, if any, is asked first for the |edge| that builds
+// / |path|.
+func (this *BuildLog) LookupByOutput(config *BuildConfig, edge *Edge, path string, commandHash uint64, currentMtime TimeStamp) *LogEntry {
+	if edge != nil && commandHash != 0 && config.RbeService != "" {
+		var e *LogEntry
+		if hit := this.LookupEdgeRemote(config, edge, commandHash, currentMtime); hit != nil {
+			e = hit.entries_[path]
+		}
+		if this.status_ != nil {
+			this.status_.CacheLookup(path, e != nil)
+		}
 		if e != nil {
 			return e
 		}
@@ -222,21 +340,218 @@ func (this *BuildLog) LookupByOutput(config *BuildConfig, path string, commandHa
 	return nil
 }
 
-// / Serialize an entry into a log file.
-func (this *BuildLog) WriteEntry(f *os.File, entry *LogEntry) (bool, error) {
-	_, err := fmt.Fprintf(f, "%d\t%d\t%d\t%s\t%x\n",
-		entry.start_time, entry.end_time, entry.mtime,
-		entry.output, entry.command_hash)
-	if err == nil && this.config_.RbeService != "" {
-		if entry.output_hash == "" {
-			hash, err1 := hashFileBase64(entry.output, this.PrefixDir)
-			if err1 != nil {
-				return err1 == nil, err1
+// / What the remote cache held for an edge, restored as a whole: an entry
+// / for each of its outputs, the contents of its depfile and the deps its
+// / command discovered.
+type RemoteHit struct {
+	entries_ map[string]*LogEntry
+	depfile_ string
+	deps_    []*RemoteDep
+}
+
+// / A dependency a command discovered, such as a header, with the blake3
+// / digest of its contents when the command ran.
+type RemoteDep struct {
+	path_   string
+	digest_ string
+}
+
+// / The deps |nodes| of an edge as the remote cache stores them.
+func RemoteDepsOf(nodes []*Node) ([]*RemoteDep, error) {
+	deps := []*RemoteDep{}
+	for _, node := range nodes {
+		digest, err := hashFileDigest(node.path())
+		if err != nil {
+			return nil, err
+		}
+		deps = append(deps, &RemoteDep{path_: node.path(), digest_: hex.EncodeToString(digest)})
+	}
+	return deps, nil
+}
+
+// / Whether the |deps| of a hit have the contents they had when it was
+// / stored.  The action key only covers the deps the edge had loaded then,
+// / none if the deps log was missing them.
+func RemoteDepsCurrent(deps []*RemoteDep) bool {
+	for _, dep := range deps {
+		digest, err := hashFileDigest(dep.path_)
+		if err != nil || hex.EncodeToString(digest) != dep.digest_ {
+			return false
+		}
+	}
+	return true
+}
+
+// / The remote cache hit LookupByOutput() restored |edge| from, if any.
+// / Doesn't ask the remote cache.
+func (this *BuildLog) RemoteHit(config *BuildConfig, edge *Edge, commandHash uint64, currentMtime TimeStamp) *RemoteHit {
+	return this.remote_hits_[RbeActionKey(config.RbeInstance, commandHash, currentMtime, EdgeOutputPaths(edge))]
+}
+
+// / An output of a remote cache hit, fetched next to |path_| unless |tmp_|
+// / is empty, when we had its contents already.
+type RemoteOutput struct {
+	path_ string
+	tmp_  string
+	/// The permission bits to give it, or 0 to leave them.
+	mode_ os.FileMode
+}
+
+// / The paths of the outputs of |edge|, which the remote cache keys its
+// / results with.
+func EdgeOutputPaths(edge *Edge) []string {
+	paths := []string{}
+	for _, o := range edge.outputs_ {
+		paths = append(paths, o.path())
+	}
+	return paths
+}
+
+// / Ask the remote cache for the result of |edge|, once for all of its
+// / outputs; outputs are only restored if all of them could be fetched.
+// / A hit is only restored once.
+func (this *BuildLog) LookupEdgeRemote(config *BuildConfig, edge *Edge, commandHash uint64, currentMtime TimeStamp) *RemoteHit {
+	key := RbeActionKey(config.RbeInstance, commandHash, currentMtime, EdgeOutputPaths(edge))
+	if hit, ok := this.remote_hits_[key]; ok {
+		return hit
+	}
+	defer TraceSpan(kTraceRemote, "query "+edge.outputs_[0].path(), "rbe")()
+	var hit *RemoteHit = nil
+	if IsReapiService(config.RbeService) {
+		hit = this.LookupEdgeReapi(edge, commandHash, currentMtime)
+	} else {
+		hit = this.LookupEdgeRbe(key, edge, commandHash, currentMtime)
+	}
+	if hit == nil {
+		return nil
+	}
+	if this.remote_hits_ == nil {
+		this.remote_hits_ = map[string]*RemoteHit{}
+	}
+	this.remote_hits_[key] = hit
+	return hit
+}
+
+// / Add the entries of a remote cache |hit| to the log, as built from inputs
+// / hashing to |mtime|, so that the next build needn't ask again.
+func (this *BuildLog) RecordRemoteHit(hit *RemoteHit, mtime, inputs_mtime TimeStamp) bool {
+	for _, e := range hit.entries_ {
+		log_entry := *e
+		log_entry.mtime = mtime
+		log_entry.inputs_mtime = inputs_mtime
+		this.entries_[log_entry.output] = &log_entry
+		if !this.AppendEntry(&log_entry) {
+			return false
+		}
+	}
+	return true
+}
+
+// / Fetch the outputs of |edge| that a remote cache result holds, each next
+// / to its path, all of them or none, so that a hit is restored as a whole.
+// / |fetch| fetches |o| to o.tmp_ and sets o.mode_, or clears o.tmp_ if
+// / o.path_ has those contents already; it returns false if the result
+// / doesn't hold |o|.
+func FetchRemoteOutputs(edge *Edge, fetch func(o *RemoteOutput) (bool, error)) []*RemoteOutput {
+	outputs := []*RemoteOutput{}
+	for _, node := range edge.outputs_ {
+		o := &RemoteOutput{path_: node.path(), tmp_: node.path() + ".tmp"}
+		found, err := fetch(o)
+		if err != nil {
+			log.Println(err)
+		}
+		if !found || err != nil {
+			// Not the whole edge; we'd rather run it.
+			RemoveRemoteOutputs(outputs)
+			return nil
+		}
+		outputs = append(outputs, o)
+	}
+	return outputs
+}
+
+// / Call |store| with each output of |edge|, which just ran successfully,
+// / and its file info.  Returns false if an output is missing or |store|
+// / fails, as the result would be incomplete.
+func StoreRemoteOutputs(edge *Edge, store func(path string, info os.FileInfo) error) bool {
+	for _, node := range edge.outputs_ {
+		path := node.path()
+		info, err := os.Stat(path)
+		if err != nil || !info.Mode().IsRegular() {
+			// An output a restat rule didn't create.
+			return false
+		}
+		if err := store(path, info); err != nil {
+			log.Println(err)
+			return false
+		}
+	}
+	return true
+}
+
+// / Remove what was fetched of the |outputs| of a hit we gave up on.
+func RemoveRemoteOutputs(outputs []*RemoteOutput) {
+	for _, o := range outputs {
+		if o.tmp_ != "" {
+			os.Remove(o.tmp_)
+		}
+	}
+}
+
+// / Move the fetched |outputs| of |edge| in place and write its |depfile|,
+// / if ninja reads it from disk rather than from the deps log.
+func (this *BuildLog) RestoreRemoteHit(edge *Edge, outputs []*RemoteOutput, depfile string, deps []*RemoteDep,
+	commandHash uint64, currentMtime TimeStamp, start_time, end_time int) *RemoteHit {
+	if path := edge.GetUnescapedDepfile(); path != "" && depfile != "" &&
+		(edge.GetBinding("deps") == "" || g_keep_depfile) {
+		err := os.MkdirAll(filepath.Dir(path), 0755)
+		if err == nil {
+			err = os.WriteFile(path, []byte(depfile), 0644)
+		}
+		if err != nil {
+			log.Println(err)
+			RemoveRemoteOutputs(outputs)
+			return nil
+		}
+	}
+	hit := &RemoteHit{entries_: map[string]*LogEntry{}, depfile_: depfile, deps_: deps}
+	for i, o := range outputs {
+		if o.tmp_ != "" {
+			if err := os.Rename(o.tmp_, o.path_); err != nil {
+				log.Println(err)
+				RemoveRemoteOutputs(outputs[i:])
+				return nil
 			}
-			entry.output_hash = string(hash)
 		}
-		this.WriteEntryRbe(entry)
+		if o.mode_ != 0 {
+			if err := os.Chmod(o.path_, o.mode_); err != nil {
+				log.Println(err)
+			}
+		}
+		digest, err := hashFileDigest(o.path_)
+		if err != nil {
+			log.Println(err)
+			RemoveRemoteOutputs(outputs[i+1:])
+			return nil
+		}
+		hit.entries_[o.path_] = &LogEntry{
+			output:       o.path_,
+			command_hash: commandHash,
+			start_time:   start_time,
+			end_time:     end_time,
+			mtime:        currentMtime,
+			output_hash:  hex.EncodeToString(hashFileEntry(digest, o.path_, this.PrefixDir)),
+		}
 	}
+	return hit
+}
+
+// / Serialize an entry into a log file.
+func (this *BuildLog) WriteEntry(f *os.File, entry *LogEntry) (bool, error) {
+	_, err := fmt.Fprintf(f, "%d\t%d\t%d\t%s\t%x\t%s\t%d\t%d\n",
+		entry.start_time, entry.end_time, entry.mtime,
+		entry.output, entry.command_hash, entry.output_hash, entry.retries,
+		entry.inputs_mtime)
 	return err == nil, err
 }
 
@@ -293,7 +608,8 @@ func (this *BuildLog) Recompact(path string, user BuildLogUser, err *string) boo
 	return true
 }
 
-// / Restat all outputs in the log
+// / Restat all outputs in the log, refreshing their recorded output hashes,
+// / which the early cutoff compares rebuilt outputs against.
 func (this *BuildLog) Restat(path string, disk_interface DiskInterface, outputs []string, err *string) bool {
 	METRIC_RECORD(".ninja_log restat")
 	output_count := len(outputs)
@@ -320,11 +636,13 @@ func (this *BuildLog) Restat(path string, disk_interface DiskInterface, outputs
 			}
 		}
 		if !skip {
-			//mtime, _, err1 := disk_interface.Stat(second.output)
-			//if err1 != nil {
-			return false
-			//}
-			//second.mtime = mtime
+			hash, err1 := hashFileBase64(second.output, this.PrefixDir)
+			if err1 != nil && !errors.Is(err1, os.ErrNotExist) {
+				*err = err1.Error()
+				return false
+			}
+			// The remote cache isn't updated: it records whole edges.
+			second.output_hash = hash
 		}
 		_, err1 = this.WriteEntry(file, second)
 		if err1 != nil {
@@ -351,9 +669,15 @@ type Entries map[string]*LogEntry
 
 func (this *BuildLog) entries() Entries { return this.entries_ }
 
-const kFileSignature = "# ninja log v%d\n"
-const kOldestSupportedVersion = 7
-const kCurrentVersion = 7
+const kFileSignature = "# ninja-go log v%d\n"
+const kCurrentVersion = 3
+
+// Upstream ninja logs we can import. Their command hashes only match ours
+// from v7 on (rapidhash), and their mtime column is a real mtime rather than
+// an input content hash, so imported entries are rebuilt once.
+const kUpstreamFileSignature = "# ninja log v%d\n"
+const kOldestUpstreamVersion = 5
+const kNewestUpstreamVersion = 7
 
 // / Should be called before using log_file_. When false is returned, errno
 // / will be set.
@@ -393,7 +717,8 @@ func HashCommand(command string) uint64 {
 func (this *LogEntry) CompareLogEntryEq(o *LogEntry) bool {
 	return this.output == o.output && this.command_hash == o.command_hash &&
 		this.start_time == o.start_time && this.end_time == o.end_time &&
-		this.mtime == o.mtime && this.output_hash == o.output_hash
+		this.mtime == o.mtime && this.output_hash == o.output_hash &&
+		this.retries == o.retries
 }
 
 func NewLogEntry(output string) *LogEntry {
@@ -3,13 +3,12 @@ package main
 import (
 	"bytes"
 	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
-	"errors"
 	"fmt"
-	"github.com/fatih/color"
+	"github.com/zeebo/blake3"
 	"io"
 	"log"
-	"mime/multipart"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -17,216 +16,245 @@ import (
 	"time"
 )
 
-type RbeLogEntry struct {
-	Id          int64
-	Output      string /* index_output */
-	CommandHash string /* index_hash,UNIQUE */
-	Mtime       string /* index_hash,UNIQUE */
-	StartTime   string
-	EndTime     string
-	OutputHash  string
-	//
-	Instance        string /* index_inst */
-	CreatedAt       int64
-	LastAccess      int64 /* index_last_access */
-	ExpiredDuration int64 /* index_expired */
-	Deleted         int64 /* 0 false 1 true */
+// / The remote cache speaks two protocols, both keyed by blake3 digests in
+// / hex:
+// /
+// /   - the CAS, where "/cas/<digest>" holds the bytes whose digest it is,
+// /     read with GET, probed with HEAD and stored with PUT.  Outputs with the
+// /     same contents are stored once, whatever produced them.
+// /   - the action cache, where "/ac/<key>" holds an RbeActionEntry, what the
+// /     edge with that key produced: every one of its outputs, as digests
+// /     into the CAS, and its depfile.
+type RbeActionEntry struct {
+	Instance    string            `json:"instance"`
+	CommandHash string            `json:"command_hash"`
+	InputHash   string            `json:"input_hash"`
+	StartTime   int64             `json:"start_time"`
+	EndTime     int64             `json:"end_time"`
+	Outputs     []*RbeOutputEntry `json:"outputs"`
+	/// The contents of the depfile, if the edge has one.
+	Depfile string `json:"depfile"`
+	/// The deps the command discovered, to check and record on a hit.
+	Deps []*RbeDepsEntry `json:"deps"`
 }
 
-func (this *BuildLog) LookupByOutputRbe(rbeService, rbeInstance, path string, commandHash uint64, currentMtime TimeStamp) *LogEntry {
-	url := fmt.Sprintf("%s/query", rbeService)
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		log.Println(err)
-		return nil
+type RbeDepsEntry struct {
+	Path string `json:"path"`
+	Hash string `json:"hash"`
+}
+
+type RbeOutputEntry struct {
+	Path   string `json:"path"`
+	Digest string `json:"digest"`
+	Size   int64  `json:"size"`
+	/// The permission bits of the file.
+	Mode uint32 `json:"mode"`
+}
+
+// / The key of the action that built the |outputs| of an edge with the
+// / command hashing to |command_hash| from inputs hashing to |input_hash|.
+func RbeActionKey(instance string, command_hash uint64, input_hash TimeStamp, outputs []string) string {
+	h := blake3.New()
+	fmt.Fprintf(h, "%s\x00%x\x00%d", instance, command_hash, input_hash)
+	for _, output := range outputs {
+		fmt.Fprintf(h, "\x00%s", output)
 	}
-	q := req.URL.Query()
-	q.Add("instance", rbeInstance)
-	q.Add("output", path)
-	q.Add("command_hash", strconv.FormatUint(commandHash, 16))
-	q.Add("mtime", strconv.FormatInt(int64(currentMtime), 10))
-	req.URL.RawQuery = q.Encode()
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func rbeClient(timeout time.Duration) *http.Client {
 	tr := &http.Transport{
 		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
 	}
-	client := http.Client{Transport: tr, Timeout: 3 * time.Second}
-	resp, err := client.Do(req)
+	return &http.Client{Transport: tr, Timeout: timeout}
+}
+
+// / Look up the action |key| of |edge| in the ninja-rbe cache, and fetch
+// / those of its outputs whose contents we don't have.
+func (this *BuildLog) LookupEdgeRbe(key string, edge *Edge, commandHash uint64, currentMtime TimeStamp) *RemoteHit {
+	rbeService := this.config_.RbeService
+	resp, err := rbeClient(3 * time.Second).Get(fmt.Sprintf("%s/ac/%s", rbeService, key))
 	if err != nil {
 		log.Println(err)
 		return nil
 	}
 	defer resp.Body.Close()
-	if resp.StatusCode == http.StatusOK {
-		data, err := io.ReadAll(resp.Body)
-		if err != nil {
-			log.Println(err)
-			return nil
-		}
-		ret := RbeLogEntry{}
-		err = json.Unmarshal(data, &ret)
-		if err != nil {
-			log.Println(err)
-			return nil
-		}
-		//iCommandHash, err := strconv.ParseInt(ret.CommandHash, 16, 64)
-		//if err != nil {
-		//	log.Println(err)
-		//	return nil
-		//}
-		startTime, err := strconv.ParseInt(ret.StartTime, 10, 64)
-		if err != nil {
-			log.Println(err)
-			return nil
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		log.Println(err)
+		return nil
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("StatusCode: %v, Body: %s\n", resp.StatusCode, string(data))
+		return nil
+	}
+	ret := RbeActionEntry{}
+	if err := json.Unmarshal(data, &ret); err != nil {
+		log.Println(err)
+		return nil
+	}
+	deps := []*RemoteDep{}
+	for _, d := range ret.Deps {
+		deps = append(deps, &RemoteDep{path_: d.Path, digest_: d.Hash})
+	}
+	if !RemoteDepsCurrent(deps) {
+		return nil
+	}
+	by_path := map[string]*RbeOutputEntry{}
+	for _, o := range ret.Outputs {
+		by_path[o.Path] = o
+	}
+	outputs := FetchRemoteOutputs(edge, func(o *RemoteOutput) (bool, error) {
+		output, ok := by_path[o.path_]
+		if !ok {
+			return false, nil
 		}
-		endTime, err := strconv.ParseInt(ret.EndTime, 10, 64)
-		if err != nil {
-			log.Println(err)
-			return nil
+		o.mode_ = os.FileMode(output.Mode)
+		if local, err := hashFileDigest(o.path_); err == nil && hex.EncodeToString(local) == output.Digest {
+			o.tmp_ = ""
+			return true, nil
 		}
-		//ucommandHash := uint64(iCommandHash)
-		istartTime := int(startTime)
-		iendTime := int(endTime)
-		//
-		{ // output md5 != remote md5 or output not exist download this
-			needDownload := false
-			if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) || errors.Is(err, os.ErrPermission) {
-				needDownload = true
-				color.Red("%s not exist.\n", path)
-			} else if err == nil {
-				hash, err2 := hashFileBase64(path, this.PrefixDir)
-				if err2 != nil {
-					needDownload = true
-					color.Red("%s hashFileBase64 fail %s.\n", path, err2.Error())
-				} else if string(hash) != ret.OutputHash {
-					needDownload = true
-					color.Red("%s  string(hash) != ret.OutputHash.\n", path)
-				} else {
-					color.Yellow("%s  string(hash) == ret.OutputHash.\n", path)
-				}
-			} else {
-				color.Red("%s err: %s.\n", path, err.Error())
-			}
-			if needDownload {
-				color.Green("RbeDownload %s\n", path)
-				err2 := this.RbeDownload(path, ret.OutputHash, rbeService)
-				if err2 != nil {
-					return nil
-				}
-			} else {
+		return true, rbeFetch(o.tmp_, output.Digest, rbeService)
+	})
+	if outputs == nil {
+		return nil
+	}
+	return this.RestoreRemoteHit(edge, outputs, ret.Depfile, deps, commandHash, currentMtime,
+		int(ret.StartTime), int(ret.EndTime))
+}
 
-			}
-		}
-		return &LogEntry{
-			output:       ret.Output,
-			command_hash: commandHash,
-			start_time:   istartTime,
-			end_time:     iendTime,
-			mtime:        currentMtime,
-		}
-	} else {
-		data, err := io.ReadAll(resp.Body)
+// / Upload the outputs of |edge|, which just ran successfully, to the CAS
+// / unless they are there already, then record them with its |depfile| and
+// / |deps| as the result of its action.
+func (this *BuildLog) WriteEdgeRbe(edge *Edge, deps []*RemoteDep, command_hash uint64, depfile string,
+	start_time, end_time int, mtime TimeStamp) {
+	rbeService := this.config_.RbeService
+	instance := this.config_.RbeInstance
+	entry := RbeActionEntry{
+		Instance:    instance,
+		CommandHash: strconv.FormatUint(command_hash, 16),
+		InputHash:   strconv.FormatInt(int64(mtime), 10),
+		StartTime:   int64(start_time),
+		EndTime:     int64(end_time),
+		Depfile:     depfile,
+	}
+	for _, dep := range deps {
+		entry.Deps = append(entry.Deps, &RbeDepsEntry{Path: dep.path_, Hash: dep.digest_})
+	}
+	client := rbeClient(10 * time.Minute)
+	stored := StoreRemoteOutputs(edge, func(path string, info os.FileInfo) error {
+		digest, err := hashFileDigest(path)
 		if err != nil {
-			log.Println(err)
-			return nil
+			return err
 		}
-		log.Printf("StatusCode: %v, Body: %s\n", resp.StatusCode, string(data))
+		digest_str := hex.EncodeToString(digest)
+		if err := RbeUploadBlob(client, rbeService, path, digest_str); err != nil {
+			return err
+		}
+		entry.Outputs = append(entry.Outputs, &RbeOutputEntry{
+			Path: path, Digest: digest_str, Size: info.Size(), Mode: uint32(info.Mode().Perm()),
+		})
+		return nil
+	})
+	if !stored {
+		return
 	}
-	return nil
-}
-
-func (this *BuildLog) WriteEntryRbe(entry *LogEntry) {
-	if entry.mtime == 0 || entry.command_hash == 0 {
+	body, err := json.Marshal(&entry)
+	if err != nil {
+		log.Println(err)
 		return
 	}
-	this.UpdateRbeCache(this.config_.RbeService,
-		entry.output, entry.output_hash,
-		entry.command_hash,
-		entry.start_time,
-		entry.end_time,
-		entry.mtime,
-		this.config_.RbeInstance, "12h")
+	key := RbeActionKey(instance, command_hash, mtime, EdgeOutputPaths(edge))
+	url := fmt.Sprintf("%s/ac/%s?expired_duration=%s", rbeService, key, "12h")
+	if err := rbePut(client, url, bytes.NewReader(body)); err != nil {
+		log.Println(err)
+	}
 }
 
-// https://github.com/PzaThief/benchmark-go-multipart
-func (this *BuildLog) UpdateRbeCache(rbeService,
-	output, output_hash string, command_hash uint64, start_time, end_time int,
-	mtime TimeStamp, instance, expired_duration string) error {
-	command_hash_str := strconv.FormatUint(command_hash, 16)
-	start_time_str := strconv.FormatInt(int64(start_time), 10)
-	end_time_str := strconv.FormatInt(int64(end_time), 10)
-	mtime_str := strconv.FormatInt(int64(mtime), 10)
-	file, err := os.Open(output)
+// / Store the contents of |path|, whose digest is |digest|, in the CAS,
+// / unless the CAS has them.
+func RbeUploadBlob(client *http.Client, rbeService, path, digest string) error {
+	url := fmt.Sprintf("%s/cas/%s", rbeService, digest)
+	resp, err := client.Head(url)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+	file, err := os.Open(path)
 	if err != nil {
 		return err
 	}
 	defer file.Close()
-	body := &bytes.Buffer{}
-	writer := multipart.NewWriter(body)
-	part, _ := writer.CreateFormFile("file", filepath.Base(output))
-	io.Copy(part, file)
-	writer.WriteField("output", output)
-	writer.WriteField("command_hash", command_hash_str)
-	writer.WriteField("start_time", start_time_str)
-	writer.WriteField("end_time", end_time_str)
-	writer.WriteField("mtime", mtime_str)
-	writer.WriteField("instance", instance)
-	writer.WriteField("expired_duration", expired_duration)
-	writer.WriteField("output_hash", output_hash)
-	writer.Close()
-	url := fmt.Sprintf("%s/upload", rbeService)
-	req, _ := http.NewRequest("POST", url, body)
-	req.Header.Add("Content-Type", writer.FormDataContentType())
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	return rbePut(client, url, file)
+}
+
+func rbePut(client *http.Client, url string, body io.Reader) error {
+	req, err := http.NewRequest("PUT", url, body)
+	if err != nil {
+		return err
 	}
-	client := http.Client{Transport: tr, Timeout: 10 * time.Minute}
 	resp, err := client.Do(req)
 	if err != nil {
-		log.Println(err)
-		return nil
+		return err
 	}
 	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		data, err := io.ReadAll(resp.Body)
-		if err != nil {
-			log.Println(err)
-			return nil
-		}
-		log.Printf("StatusCode: %v, Body: %s\n", resp.StatusCode, string(data))
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		data, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("PUT %s: StatusCode: %v, Body: %s", url, resp.StatusCode, string(data))
 	}
 	return nil
 }
 
-func (this *BuildLog) RbeDownload(path, outputHash, rbeService string) error {
-	// Create the file with .tmp extension, so that we won't overwrite a
-	// file until it's downloaded fully
-	out, err := os.Create(path + ".tmp")
-	if err != nil {
+// / Fetch the blob |digest| from the CAS into |path|, checking it against
+// / its digest.
+func RbeDownload(path, digest, rbeService string) error {
+	// Download to a .tmp file, so that we won't overwrite a file until it's
+	// downloaded fully
+	if err := rbeFetch(path+".tmp", digest, rbeService); err != nil {
 		return err
 	}
+	// Rename the tmp file back to the original file
+	return os.Rename(path+".tmp", path)
+}
 
-	// Get the data
-	url := fmt.Sprintf("%s/%s", rbeService, outputHash)
-	resp, err := http.Get(url)
+// / Write the blob |digest| to |path|, removing it if the download fails or
+// / doesn't match the digest.
+func rbeFetch(path, digest, rbeService string) error {
+	defer TraceSpan(kTraceRemote, "download "+path, "rbe")()
+	resp, err := rbeClient(10 * time.Minute).Get(fmt.Sprintf("%s/cas/%s", rbeService, digest))
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("downloading %s: StatusCode: %v", path, resp.StatusCode)
+	}
 
-	// Create our bytes counter and pass it to be used alongside our writer
-	_, err = io.Copy(out, resp.Body)
+	if dir := filepath.Dir(path); dir != "." {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	out, err := os.Create(path)
 	if err != nil {
 		return err
 	}
-
-	// The progress use the same line so print a new line once it's finished downloading
-	fmt.Println()
-	out.Close()
-	// Rename the tmp file back to the original file
-	err = os.Rename(path+".tmp", path)
+	h := blake3.New()
+	_, err = io.Copy(io.MultiWriter(out, h), resp.Body)
+	if err1 := out.Close(); err == nil {
+		err = err1
+	}
+	if err == nil && hex.EncodeToString(h.Sum(nil)) != digest {
+		err = fmt.Errorf("downloading %s: contents don't match digest %s", path, digest)
+	}
 	if err != nil {
-		return err
+		os.Remove(path)
 	}
-
-	return nil
+	return err
 }
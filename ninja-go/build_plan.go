@@ -110,6 +110,11 @@ func (this *Plan) FindWork() *Edge {
 	return work.(*Edge)
 }
 
+// / Put an edge obtained from FindWork() back, to be started later.
+func (this *Plan) ReturnWork(edge *Edge) {
+	this.ready_.Add(edge)
+}
+
 // / Returns true if there's more work to be done.
 func (this *Plan) more_to_do() bool {
 	return this.wanted_edges_ > 0 && this.command_edges_ > 0
@@ -164,6 +169,18 @@ func (this *Plan) EdgeFinished(edge *Edge, result EdgeResult, err *string) bool
 	return true
 }
 
+// / Queue |edge|, whose command failed but is to be run again, as if it had
+// / just become ready.  Its pool slot is released and taken anew.
+func (this *Plan) RetryEdge(edge *Edge) {
+	if this.want_[edge] != kWantToFinish {
+		panic("retrying an edge that is not running")
+	}
+	edge.pool().EdgeFinished(edge)
+	this.want_[edge] = kWantToStart
+	this.ScheduleWork(this.want_, edge)
+	edge.pool().RetrieveReadyEdges(this.ready_)
+}
+
 // / Clean the given node during the build.
 // / Return false on error.
 func (this *Plan) CleanNode(scan *DependencyScan, node *Node, err *string) bool {
@@ -182,40 +199,37 @@ func (this *Plan) CleanNode(scan *DependencyScan, node *Node, err *string) bool
 		}
 		// If all non-order-only inputs for this edge are now clean,
 		// we might have changed the dirty state of the outputs.
-		begin := 0
 		end := len(oe.inputs_) - oe.order_only_deps_
 		found := false
-		for i := begin; i < end; i++ {
+		for i := 0; i < end; i++ {
 			if oe.inputs_[i].dirty() {
 				found = true
 				break
 			}
 		}
-		if found {
-			// Recompute most_recent_input.
-			var inputs []*Node = oe.inputs_[0:end]
-			for i := begin; i < end; i++ {
-				// Now, this edge is dirty if any of the outputs are dirty.
-				// If the edge isn't dirty, clean the outputs and mark the edge as not
-				// wanted.
-				outputs_dirty := false
-				if !scan.RecomputeOutputsDirty(oe, inputs, &outputs_dirty, err) {
-					return false
-				}
-				if !outputs_dirty {
-					for _, o := range oe.outputs_ {
-						if !this.CleanNode(scan, o, err) {
-							return false
-						}
+		if !found {
+			// Now, this edge is dirty if any of the outputs are dirty.
+			// If the edge isn't dirty, clean the outputs and mark the edge as not
+			// wanted.  The inputs hash covers all inputs, as in the initial scan.
+			// Phony edges have no log entries; they are clean along with their
+			// inputs.
+			outputs_dirty := false
+			if !oe.is_phony() && !scan.RecomputeOutputsDirty(oe, oe.inputs_, &outputs_dirty, err) {
+				return false
+			}
+			if !outputs_dirty {
+				for _, o := range oe.outputs_ {
+					if !this.CleanNode(scan, o, err) {
+						return false
 					}
+				}
 
-					this.want_[oe] = kWantNothing
-					this.wanted_edges_--
-					if !oe.is_phony() {
-						this.command_edges_--
-						if this.builder_ != nil {
-							this.builder_.status_.EdgeRemovedFromPlan(oe)
-						}
+				this.want_[oe] = kWantNothing
+				this.wanted_edges_--
+				if !oe.is_phony() {
+					this.command_edges_--
+					if this.builder_ != nil {
+						this.builder_.status_.EdgeRemovedFromPlan(oe)
 					}
 				}
 			}
@@ -240,13 +254,61 @@ func (this *Plan) PrepareQueue() {
 	this.ComputeCriticalPath()
 	this.ScheduleInitialEdges()
 }
-func EdgeWeightHeuristic(edge *Edge) int64 {
+
+// / The expected cost of running |edge|, in milliseconds: how long it took
+// / in the previous build according to the build log, or |fallback| if that
+// / isn't known.  Phony edges cost nothing.
+func EdgeWeightHeuristic(edge *Edge, fallback int64) int64 {
 	if edge.is_phony() {
 		return 0
-	} else {
+	}
+	if edge.prev_elapsed_time_millis > 0 {
+		return edge.prev_elapsed_time_millis
+	}
+	if edge.prev_elapsed_time_millis == 0 {
+		// Count instant edges too, so that a chain of them still adds up.
 		return 1
 	}
+	return fallback
+}
 
+// / The fallback weights for edges the build log knows nothing about: the
+// / average duration of the other edges of the same rule, or failing that
+// / of all edges with a known duration, or 1 if there are none.
+type EdgeWeightFallback struct {
+	rule_average_ map[*Rule]int64
+	average_      int64
+}
+
+func NewEdgeWeightFallback(edges []*Edge) *EdgeWeightFallback {
+	ret := EdgeWeightFallback{rule_average_: make(map[*Rule]int64), average_: 1}
+	rule_total := make(map[*Rule]int64)
+	rule_count := make(map[*Rule]int64)
+	total, count := int64(0), int64(0)
+	for _, edge := range edges {
+		if edge.is_phony() || edge.prev_elapsed_time_millis < 0 {
+			continue
+		}
+		elapsed := EdgeWeightHeuristic(edge, 1)
+		rule_total[edge.rule_] += elapsed
+		rule_count[edge.rule_]++
+		total += elapsed
+		count++
+	}
+	for rule, n := range rule_count {
+		ret.rule_average_[rule] = rule_total[rule] / n
+	}
+	if count > 0 {
+		ret.average_ = total / count
+	}
+	return &ret
+}
+
+func (this *EdgeWeightFallback) Weight(edge *Edge) int64 {
+	if average, ok := this.rule_average_[edge.rule_]; ok {
+		return EdgeWeightHeuristic(edge, average)
+	}
+	return EdgeWeightHeuristic(edge, this.average_)
 }
 func (this *Plan) ComputeCriticalPath() {
 	METRIC_RECORD("ComputeCriticalPath")
@@ -270,10 +332,11 @@ func (this *Plan) ComputeCriticalPath() {
 	}
 
 	sorted_edges := topo_sort.result()
+	fallback := NewEdgeWeightFallback(sorted_edges)
 
-	// First, reset all weights to 1.
+	// First, reset all weights to the edges' own cost.
 	for _, edge := range sorted_edges {
-		edge.set_critical_path_weight(EdgeWeightHeuristic(edge))
+		edge.set_critical_path_weight(fallback.Weight(edge))
 	}
 
 	// Second propagate / increment weights from
@@ -289,7 +352,7 @@ func (this *Plan) ComputeCriticalPath() {
 				continue
 			}
 			producer_weight := producer.critical_path_weight()
-			candidate_weight := edge_weight + EdgeWeightHeuristic(producer)
+			candidate_weight := edge_weight + fallback.Weight(producer)
 			if candidate_weight > producer_weight {
 				producer.set_critical_path_weight(candidate_weight)
 			}
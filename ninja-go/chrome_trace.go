@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// / The kinds of spans in a trace.  Spans of the main group are recorded
+// / by the main goroutine and nest, so they share one lane; the others run
+// / concurrently and are spread over as many lanes as they need.
+type TraceGroup int8
+
+const (
+	kTraceMain TraceGroup = iota
+	kTraceEdges
+	kTraceHashing
+	kTraceRemote
+)
+
+var kTraceGroupNames = []string{"ninja", "job", "hash", "remote"}
+
+type traceSpan struct {
+	group_ TraceGroup
+	name_  string
+	cat_   string
+	start_ time.Time
+	end_   time.Time
+	args_  map[string]string
+}
+
+// / Tracer records what a build spends its time on, for a Chrome
+// / trace-event file that chrome://tracing and Perfetto can display.
+type Tracer struct {
+	/// Where to write the trace.
+	path_  string
+	start_ time.Time
+
+	mu_    sync.Mutex
+	spans_ []traceSpan
+}
+
+// / The tracer set up by -d trace=FILE, or nil.
+var GTracer *Tracer = nil
+
+func NewTracer(path string) *Tracer {
+	ret := Tracer{}
+	ret.path_ = path
+	ret.start_ = time.Now()
+	return &ret
+}
+
+// / Record a span from |start| to |end|.
+func (this *Tracer) Add(group TraceGroup, name, cat string, start, end time.Time, args map[string]string) {
+	this.mu_.Lock()
+	defer this.mu_.Unlock()
+	this.spans_ = append(this.spans_, traceSpan{group, name, cat, start, end, args})
+}
+
+// / Start a span if we are tracing, and return the function that ends it:
+// /   defer TraceSpan(kTraceMain, ".ninja_log load", "log")()
+func TraceSpan(group TraceGroup, name, cat string) func() {
+	tracer := GTracer
+	if tracer == nil {
+		return func() {}
+	}
+	start := time.Now()
+	return func() {
+		tracer.Add(group, name, cat, start, time.Now(), nil)
+	}
+}
+
+// / Record the run of |edge|'s command.  The times are in milliseconds, as
+// / the Builder keeps them.
+func (this *Tracer) AddEdge(edge *Edge, start_millis, end_millis int64, args map[string]string) {
+	outputs := []string{}
+	for _, o := range edge.outputs_ {
+		outputs = append(outputs, o.path())
+	}
+	if args == nil {
+		args = map[string]string{}
+	}
+	if description := edge.GetBinding("description"); description != "" {
+		args["description"] = description
+	}
+	this.Add(kTraceEdges, strings.Join(outputs, ", "), edge.rule().name(),
+		time.UnixMilli(start_millis), time.UnixMilli(end_millis), args)
+}
+
+type traceEvent struct {
+	Name string            `json:"name"`
+	Cat  string            `json:"cat,omitempty"`
+	Ph   string            `json:"ph"`
+	Ts   int64             `json:"ts"`
+	Dur  int64             `json:"dur,omitempty"`
+	Pid  int               `json:"pid"`
+	Tid  int               `json:"tid"`
+	Args map[string]string `json:"args,omitempty"`
+}
+
+// / Write the spans recorded so far as a trace-event JSON file, with each
+// / span a complete event on a lane of its group.  Lanes are assigned
+// / greedily in order of start time, so that no two spans on one lane
+// / overlap.
+func (this *Tracer) WriteJSON(w io.Writer) error {
+	this.mu_.Lock()
+	spans := slices.Clone(this.spans_)
+	this.mu_.Unlock()
+	slices.SortStableFunc(spans, func(a, b traceSpan) int {
+		return a.start_.Compare(b.start_)
+	})
+
+	events := []traceEvent{}
+	lane_name := func(tid int, name string) {
+		events = append(events, traceEvent{Name: "thread_name", Ph: "M", Pid: 1, Tid: tid,
+			Args: map[string]string{"name": name}})
+	}
+	lane_name(0, kTraceGroupNames[kTraceMain])
+	next_tid := 1
+	for group := kTraceEdges; int(group) < len(kTraceGroupNames); group++ {
+		// The tids of the group's lanes, and when each is free again.
+		tids := []int{}
+		free := []time.Time{}
+		for _, span := range spans {
+			if span.group_ != group {
+				continue
+			}
+			lane := slices.IndexFunc(free, func(t time.Time) bool { return !t.After(span.start_) })
+			if lane < 0 {
+				lane = len(tids)
+				tids = append(tids, next_tid)
+				free = append(free, span.end_)
+				lane_name(next_tid, fmt.Sprintf("%s %d", kTraceGroupNames[group], lane+1))
+				next_tid++
+			}
+			free[lane] = span.end_
+			events = append(events, this.event(span, tids[lane]))
+		}
+	}
+	for _, span := range spans {
+		if span.group_ == kTraceMain {
+			events = append(events, this.event(span, 0))
+		}
+	}
+
+	return json.NewEncoder(w).Encode(map[string]any{
+		"traceEvents":     events,
+		"displayTimeUnit": "ms",
+	})
+}
+
+func (this *Tracer) event(span traceSpan, tid int) traceEvent {
+	// Zero-length events are hard to find in the viewers.
+	dur := max(int(span.end_.Sub(span.start_).Microseconds()), 1)
+	return traceEvent{Name: span.name_, Cat: span.cat_, Ph: "X",
+		Ts: span.start_.Sub(this.start_).Microseconds(), Dur: int64(dur), Pid: 1, Tid: tid,
+		Args: span.args_}
+}
+
+// / Write the trace to the file given to -d trace.
+func (this *Tracer) Write() {
+	f, err := os.Create(this.path_)
+	if err != nil {
+		Warning("writing trace: %v", err)
+		return
+	}
+	defer f.Close()
+	if err := this.WriteJSON(f); err != nil {
+		Warning("writing trace %s: %v", this.path_, err)
+	}
+}
+
+// / Build a trace of the last build recorded in the build log at |path|:
+// / one span per edge, with outputs an edge produced together merged.  The
+// / log doesn't mark where builds start, but within one build the entries
+// / are written in the order the edges finished, so an entry that ends
+// / before the one above it starts a new build.  That order is lost when the
+// / log is recompacted, after which the trace mixes up several builds.
+func TraceFromBuildLog(path string, state *State) (*Tracer, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	header, _ := reader.ReadString('\n')
+	version := 0
+	upstream := false
+	if _, err := fmt.Sscanf(header, kFileSignature, &version); err != nil {
+		if _, err := fmt.Sscanf(header, kUpstreamFileSignature, &version); err != nil {
+			return nil, fmt.Errorf("%s is not a build log", path)
+		}
+		upstream = true
+	}
+
+	build_log := NewBuildLog(NewBuildConfig(), "")
+	entries := []*LogEntry{}
+	for {
+		line, err := reader.ReadString('\n')
+		if line == "" || !strings.HasSuffix(line, "\n") {
+			break
+		}
+		entry := build_log.ParseEntry(strings.TrimRight(line, "\r\n"), upstream, version)
+		if entry == nil {
+			continue
+		}
+		if len(entries) != 0 && entry.end_time < entries[len(entries)-1].end_time {
+			entries = entries[:0]
+		}
+		entries = append(entries, entry)
+		if err != nil {
+			break
+		}
+	}
+
+	// The times are relative to the start of the build.
+	ret := NewTracer("")
+	ret.start_ = time.UnixMilli(0)
+	type key struct {
+		command_hash         uint64
+		start_time, end_time int
+	}
+	index := map[key]int{}
+	for _, entry := range entries {
+		k := key{entry.command_hash, entry.start_time, entry.end_time}
+		if i, ok := index[k]; ok {
+			ret.spans_[i].name_ += ", " + entry.output
+			continue
+		}
+		cat := ""
+		if node := state.LookupNode(entry.output); node != nil && node.in_edge() != nil {
+			cat = node.in_edge().rule().name()
+		}
+		index[k] = len(ret.spans_)
+		ret.Add(kTraceEdges, entry.output, cat, time.UnixMilli(int64(entry.start_time)),
+			time.UnixMilli(int64(entry.end_time)), nil)
+	}
+	return ret, nil
+}
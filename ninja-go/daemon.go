@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+// / What a client asks the daemon for: a build with these flags and targets,
+// / as given on its command line.
+type DaemonRequest struct {
+	Args []string
+	/// The client's working directory, once -C was applied.  It has to be
+	/// the daemon's.
+	Dir string
+	/// Whether the client's output is a terminal the status line can
+	/// overprint.
+	SmartTerminal bool
+}
+
+// / The frames the daemon answers with: output for the client's stdout or
+// / stderr, and finally the exit code of the build.
+const (
+	kDaemonStdout = 'o'
+	kDaemonStderr = 'e'
+	kDaemonExit   = 'x'
+)
+
+// / Write one frame: its type, the length of |payload| and |payload|.
+func WriteDaemonFrame(w io.Writer, kind byte, payload []byte) error {
+	header := [5]byte{kind}
+	binary.BigEndian.PutUint32(header[1:], uint32(len(payload)))
+	if _, err := w.Write(header[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+func ReadDaemonFrame(r io.Reader) (byte, []byte, error) {
+	header := [5]byte{}
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	payload := make([]byte, binary.BigEndian.Uint32(header[1:]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	return header[0], payload, nil
+}
+
+// / The socket the daemon for |build_dir| listens on.
+func DaemonSocketPath(build_dir string) string {
+	if build_dir == "" {
+		return ".ninja_daemon"
+	}
+	return build_dir + "/.ninja_daemon"
+}
+
+// / Find the build dir |input_file| sets without loading the manifest, so
+// / that a client can tell quickly whether a daemon serves it.  Only the
+// / top-level bindings of the file itself are looked at.  The daemon places
+// / its socket the same way, so the two always agree.
+func PeekBuildDir(input_file string) string {
+	data, err := os.ReadFile(input_file)
+	if err != nil {
+		return ""
+	}
+	bindings := map[string]string{}
+	for _, line := range strings.Split(string(data), "\n") {
+		if line == "" || line[0] == ' ' || line[0] == '\t' || line[0] == '#' {
+			continue
+		}
+		name, value, ok := strings.Cut(line, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" || strings.IndexFunc(name, func(r rune) bool { return !isVarNameChar(r) }) >= 0 {
+			continue
+		}
+		bindings[name] = expandPeekedValue(strings.TrimSpace(value), bindings)
+	}
+	return bindings["builddir"]
+}
+
+func isVarNameChar(r rune) bool {
+	return r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' ||
+		r == '_' || r == '-' || r == '.'
+}
+
+// / Expand the variables and escapes of a binding's value.
+func expandPeekedValue(value string, bindings map[string]string) string {
+	out := strings.Builder{}
+	for i := 0; i < len(value); i++ {
+		if value[i] != '$' || i+1 == len(value) {
+			out.WriteByte(value[i])
+			continue
+		}
+		i++
+		switch c := value[i]; {
+		case c == '$' || c == ' ' || c == ':':
+			out.WriteByte(c)
+		case c == '{':
+			end := strings.IndexByte(value[i:], '}')
+			if end < 0 {
+				return out.String()
+			}
+			out.WriteString(bindings[value[i+1:i+end]])
+			i += end
+		default:
+			end := i
+			for end < len(value) && isVarNameChar(rune(value[end])) && value[end] != '.' {
+				end++
+			}
+			out.WriteString(bindings[value[i:end]])
+			i = end - 1
+		}
+	}
+	return out.String()
+}
+
+// / If a daemon serves the manifest of |options|, have it build |args|, the
+// / command line flags and targets, and relay its output.  Returns the exit
+// / code of the build, and false if no daemon is running.
+func ForwardToDaemon(options *Options, args []string) (int, bool) {
+	path := DaemonSocketPath(PeekBuildDir(options.InputFile))
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return 0, false
+	}
+	defer conn.Close()
+
+	dir, err := os.Getwd()
+	if err != nil {
+		return 0, false
+	}
+	request := DaemonRequest{Args: args, Dir: dir,
+		SmartTerminal: NewLinePrinter().is_smart_terminal()}
+	if err := json.NewEncoder(conn).Encode(&request); err != nil {
+		return 0, false
+	}
+
+	// On an interrupt, let the daemon know that we are no longer interested
+	// by closing our end; it stops the build and still reports the outcome.
+	interrupted := make(chan os.Signal, 1)
+	signal.Notify(interrupted, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(interrupted)
+	go func() {
+		if _, ok := <-interrupted; ok {
+			conn.(*net.UnixConn).CloseWrite()
+		}
+	}()
+
+	for {
+		kind, payload, err := ReadDaemonFrame(conn)
+		if err != nil {
+			Error("lost the connection to the daemon: %v", err)
+			return 1, true
+		}
+		switch kind {
+		case kDaemonStdout:
+			os.Stdout.Write(payload)
+		case kDaemonStderr:
+			os.Stderr.Write(payload)
+		case kDaemonExit:
+			return int(int32(binary.BigEndian.Uint32(payload))), true
+		}
+	}
+}
@@ -0,0 +1,580 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// / Watcher tells which files changed through inotify watches on the
+// / directories they are in.
+type Watcher struct {
+	fd_ int
+	/// An epoll instance for waiting on fd_ with a timeout.
+	epoll_fd_ int
+	/// The watched directories by watch descriptor, and the reverse.
+	dirs_    map[int32]string
+	watches_ map[string]int32
+}
+
+const kWatchMask = syscall.IN_MODIFY | syscall.IN_ATTRIB | syscall.IN_CLOSE_WRITE |
+	syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO |
+	syscall.IN_DELETE_SELF | syscall.IN_MOVE_SELF | syscall.IN_ONLYDIR
+
+func NewWatcher() (*Watcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_NONBLOCK | syscall.IN_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	epoll_fd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	event := syscall.EpollEvent{Events: syscall.EPOLLIN, Fd: int32(fd)}
+	if err := syscall.EpollCtl(epoll_fd, syscall.EPOLL_CTL_ADD, fd, &event); err != nil {
+		syscall.Close(epoll_fd)
+		syscall.Close(fd)
+		return nil, err
+	}
+	return &Watcher{fd_: fd, epoll_fd_: epoll_fd, dirs_: map[int32]string{},
+		watches_: map[string]int32{}}, nil
+}
+
+func (this *Watcher) Close() {
+	syscall.Close(this.epoll_fd_)
+	syscall.Close(this.fd_)
+}
+
+// / Block until there are changes to read or |timeout| passed.  Returns
+// / whether there are.
+func (this *Watcher) Wait(timeout time.Duration) bool {
+	events := [1]syscall.EpollEvent{}
+	n, err := syscall.EpollWait(this.epoll_fd_, events[:], int(timeout.Milliseconds()))
+	return err == nil && n > 0
+}
+
+func (this *Watcher) Watching(dir string) bool {
+	_, ok := this.watches_[dir]
+	return ok
+}
+
+func (this *Watcher) Watch(dir string) error {
+	wd, err := syscall.InotifyAddWatch(this.fd_, dir, kWatchMask)
+	if err != nil {
+		return err
+	}
+	this.dirs_[int32(wd)] = dir
+	this.watches_[dir] = int32(wd)
+	return nil
+}
+
+func (this *Watcher) forget(wd int32) {
+	delete(this.watches_, this.dirs_[wd])
+	delete(this.dirs_, wd)
+}
+
+// / Read the events queued since the last call, without blocking.  Returns
+// / the paths that changed, including directories that are no longer
+// / watched, and false if the kernel dropped events, after which anything
+// / may have changed.
+func (this *Watcher) ReadChanges() ([]string, bool) {
+	changed := []string{}
+	complete := true
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := syscall.Read(this.fd_, buf)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil || n <= 0 {
+			// EAGAIN: we have seen everything.
+			return changed, complete && (err == nil || err == syscall.EAGAIN)
+		}
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			name_start := offset + syscall.SizeofInotifyEvent
+			offset = name_start + int(event.Len)
+			name := string(bytes.TrimRight(buf[name_start:offset], "\x00"))
+
+			if event.Mask&syscall.IN_Q_OVERFLOW != 0 {
+				complete = false
+				continue
+			}
+			dir, ok := this.dirs_[event.Wd]
+			if !ok {
+				continue
+			}
+			switch {
+			case event.Mask&syscall.IN_IGNORED != 0:
+				// The directory is gone.
+				this.forget(event.Wd)
+				changed = append(changed, dir)
+			case event.Mask&syscall.IN_MOVE_SELF != 0:
+				// The watch would follow the directory to its new name.
+				syscall.InotifyRmWatch(this.fd_, uint32(event.Wd))
+				this.forget(event.Wd)
+				changed = append(changed, dir)
+			case name == "":
+				changed = append(changed, dir)
+			case dir == ".":
+				changed = append(changed, name)
+			default:
+				changed = append(changed, dir+"/"+name)
+			}
+		}
+	}
+}
+
+// / A FileReader that notes which files the manifest was read from.
+type manifestRecorder struct {
+	FileReader
+	files_ map[string]bool
+}
+
+func (this *manifestRecorder) ReadFile(path string, contents, err *string) StatusEnum {
+	this.files_[filepath.Clean(path)] = true
+	return this.FileReader.ReadFile(path, contents, err)
+}
+
+// / The flags of -d, which every request sets anew.
+type debugFlags struct {
+	explaining             bool
+	keep_depfile           bool
+	keep_rsp               bool
+	experimental_statcache bool
+	metrics                *Metrics
+	tracer                 *Tracer
+}
+
+func saveDebugFlags() debugFlags {
+	return debugFlags{g_explaining, g_keep_depfile, g_keep_rsp, g_experimental_statcache, GMetrics, GTracer}
+}
+
+func (this debugFlags) restore() {
+	g_explaining = this.explaining
+	g_keep_depfile = this.keep_depfile
+	g_keep_rsp = this.keep_rsp
+	g_experimental_statcache = this.experimental_statcache
+	GMetrics = this.metrics
+	GTracer = this.tracer
+}
+
+// / Daemon keeps a loaded manifest, the logs and the digests of the files
+// / in memory, and builds for the clients that connect to its socket.  It
+// / watches the directories of all nodes, so that it only has to hash the
+// / files that changed since the last build again.
+type Daemon struct {
+	ninja_command_ string
+	options_       *Options
+	config_        *BuildConfig
+	debug_         debugFlags
+
+	ninja_    *NinjaMain
+	snapshot_ *StateSnapshot
+	watcher_  *Watcher
+
+	/// The files the manifest was read from.  A change to one reloads it.
+	manifest_files_ map[string]bool
+	/// The directories to watch, with the nodes in them or, for directory
+	/// nodes, below them.
+	nodes_by_dir_ map[string][]*Node
+	known_nodes_  map[*Node]bool
+
+	/// Whether the manifest has to be loaded again before the next build.
+	reload_ bool
+}
+
+// / Load the manifest and the logs, and start watching the files they
+// / mention.  The files the manifest was read from are watched even if it
+// / is broken, so that we notice when it is fixed.
+func (this *Daemon) Load() bool {
+	if this.ninja_ != nil {
+		this.ninja_.CloseHashCache()
+		this.ninja_.Release()
+		this.ninja_ = nil
+	}
+	if this.watcher_ != nil {
+		this.watcher_.Close()
+		this.watcher_ = nil
+	}
+	watcher, err1 := NewWatcher()
+	if err1 != nil {
+		Error("watching files: %v", err1)
+		return false
+	}
+	this.watcher_ = watcher
+	this.nodes_by_dir_ = map[string][]*Node{}
+	this.known_nodes_ = map[*Node]bool{}
+	this.reload_ = true
+
+	ninja := NewNinjaMain(this.ninja_command_, this.options_.WorkingDir, this.config_)
+	parser_opts := NewManifestParserOptions()
+	if this.options_.PhonyCycleShouldErr {
+		parser_opts.PhonyCycleAction = KPhonyCycleActionError
+	}
+	parser_opts.PoolDepths = this.options_.PoolDepths
+	reader := &manifestRecorder{FileReader: ninja.DiskInterface, files_: map[string]bool{}}
+	parser := NewManifestParser(ninja.State_, reader, parser_opts)
+	err := ""
+	loaded := parser.Load(this.options_.InputFile, &err, nil)
+	this.manifest_files_ = reader.files_
+	for path := range this.manifest_files_ {
+		this.nodes_by_dir_[filepath.Dir(path)] = nil
+	}
+	this.WatchNodes()
+	if !loaded {
+		Error("%s", err)
+		return false
+	}
+	if !ninja.EnsureBuildDirExists() {
+		return false
+	}
+	if !ninja.OpenBuildLog(false) || !ninja.OpenDepsLog(false) || !ninja.OpenHashCache() {
+		return false
+	}
+
+	this.ninja_ = ninja
+	this.snapshot_ = ninja.State_.Snapshot()
+	this.WatchNodes()
+	this.reload_ = false
+	return true
+}
+
+// / Watch the directories of the nodes the graph gained since the last call
+// / and those we failed to watch before.  Files in a directory that was not
+// / watched may have changed unseen, so we forget what we know of them.
+func (this *Daemon) WatchNodes() {
+	if this.ninja_ != nil && len(this.known_nodes_) != len(this.ninja_.State_.paths_) {
+		for _, node := range this.ninja_.State_.paths_ {
+			if this.known_nodes_[node] {
+				continue
+			}
+			this.known_nodes_[node] = true
+			dir := filepath.Dir(node.path())
+			this.nodes_by_dir_[dir] = append(this.nodes_by_dir_[dir], node)
+			// A directory node hashes everything below it.
+			if info, err := os.Lstat(node.path()); err == nil && info.IsDir() {
+				filepath.Walk(node.path(), func(path string, info os.FileInfo, err error) error {
+					if err == nil && info.IsDir() {
+						this.nodes_by_dir_[path] = append(this.nodes_by_dir_[path], node)
+					}
+					return nil
+				})
+			}
+		}
+	}
+	for dir, nodes := range this.nodes_by_dir_ {
+		if this.watcher_.Watching(dir) {
+			continue
+		}
+		this.watcher_.Watch(dir)
+		for _, node := range nodes {
+			this.Invalidate(node)
+		}
+	}
+}
+
+// / Forget what we know of |node|, whose file changed, and the stat()
+// / results of the outputs of the edges that use it: they hash their inputs.
+func (this *Daemon) Invalidate(node *Node) {
+	node.ResetState()
+	for _, edge := range node.out_edges() {
+		for _, o := range edge.outputs_ {
+			o.ResetStat()
+		}
+	}
+}
+
+// / Take in what changed on disk since the last build.  Returns whether a
+// / source changed: a file the manifest was read from, or one that no edge
+// / produces.
+func (this *Daemon) Sync() bool {
+	if this.watcher_ == nil {
+		return false
+	}
+	changed, complete := this.watcher_.ReadChanges()
+	if !complete {
+		// Anything may have changed; start from scratch.
+		this.reload_ = true
+		return true
+	}
+	source_changed := false
+	for _, path := range changed {
+		if this.manifest_files_[path] {
+			this.reload_ = true
+			source_changed = true
+		}
+		for manifest := range this.manifest_files_ {
+			if filepath.Dir(manifest) == path && !this.watcher_.Watching(path) {
+				// The directory went away, and we can't tell what is in it now.
+				this.reload_ = true
+				source_changed = true
+			}
+		}
+		if this.ninja_ == nil {
+			continue
+		}
+		// Directory nodes hash what is below them.
+		for p := path; ; p = filepath.Dir(p) {
+			if node := this.ninja_.State_.LookupNode(p); node != nil {
+				this.Invalidate(node)
+				if node.in_edge() == nil {
+					source_changed = true
+				}
+			}
+			if p == "." || p == filepath.Dir(p) {
+				break
+			}
+		}
+	}
+	this.WatchNodes()
+	return source_changed
+}
+
+// / Build what |request| asks for, with our output going to |conn|.
+// / Returns the exit code.
+func (this *Daemon) Run(request *DaemonRequest, conn net.Conn) int {
+	restore, err := RedirectOutput(conn)
+	if err != nil {
+		WriteDaemonFrame(conn, kDaemonStderr, []byte(fmt.Sprintf("ninja: error: daemon: %v\n", err)))
+		return 1
+	}
+	defer restore()
+
+	this.debug_.restore()
+	options := Options{InputFile: "build.ninja"}
+	config := NewBuildConfig()
+	args := append([]string{this.ninja_command_}, request.Args...)
+	if ReadFlags(&args, &options, config) >= 0 {
+		return 1
+	}
+	if dir, err := os.Getwd(); err != nil || dir != request.Dir {
+		Error("the daemon builds in %s, not %s", dir, request.Dir)
+		return 1
+	}
+	if options.InputFile != this.options_.InputFile ||
+		!maps.Equal(options.PoolDepths, this.options_.PoolDepths) {
+		Error("the daemon was started with another manifest or other pool depths; stop it to build with these")
+		return 1
+	}
+	*this.config_ = *config
+
+	status, err := Statusfactory(this.config_)
+	if err != nil {
+		Error("%v", err)
+		return 1
+	}
+	defer status.ReleaseStatus()
+	printer, ok := status.(*StatusPrinter)
+	if fanout, is_fanout := status.(*StatusFanout); is_fanout {
+		printer, ok = fanout.statuses_[0].(*StatusPrinter)
+	}
+	if ok && this.config_.Verbosity == NORMAL {
+		printer.printer_.set_smart_terminal(request.SmartTerminal)
+	}
+	return this.Build(args, status)
+}
+
+// / Bring the graph up to date with the disk, rebuilding the manifest first
+// / if needed, and build |targets|.  Returns the exit code.
+func (this *Daemon) Build(targets []string, status Status) int {
+	this.Sync()
+
+	// Limit number of rebuilds, to prevent infinite loops.
+	kCycleLimit := 100
+	for cycle := 1; cycle <= kCycleLimit; cycle++ {
+		if this.reload_ || this.ninja_ == nil {
+			if !this.Load() {
+				return 1
+			}
+		}
+		ninja := this.ninja_
+		ninja.State_.Restore(this.snapshot_)
+		ninja.StartTimeMillis = GetTimeMillis()
+
+		err := ""
+		if ninja.RebuildManifest(this.options_.InputFile, &err, status) {
+			if this.config_.DryRun {
+				return 0
+			}
+			this.reload_ = true
+			continue
+		} else if err != "" {
+			status.Error("rebuilding '%s': %s", this.options_.InputFile, err)
+			return 1
+		}
+
+		// Checking the manifest loaded the deps of the edges it scanned.
+		ninja.State_.Restore(this.snapshot_)
+		ninja.ParsePreviousElapsedTimes()
+		result := ninja.RunBuild(&targets, status)
+		ninja.CloseHashCache()
+		if GMetrics != nil {
+			ninja.DumpMetrics()
+		}
+		if GTracer != nil {
+			GTracer.Write()
+		}
+		this.WatchNodes()
+		return result
+	}
+
+	status.Error("manifest '%s' still dirty after %d tries", this.options_.InputFile, kCycleLimit)
+	return 1
+}
+
+// / Serve one client: run its build and send back its output and exit code.
+// / If the client closes its end before the build is over, the build is
+// / interrupted.
+func (this *Daemon) Serve(conn net.Conn) {
+	defer conn.Close()
+	request := DaemonRequest{}
+	decoder := json.NewDecoder(conn)
+	if err := decoder.Decode(&request); err != nil {
+		return
+	}
+
+	mu := sync.Mutex{}
+	building := true
+	go func() {
+		io.Copy(io.Discard, io.MultiReader(decoder.Buffered(), conn))
+		mu.Lock()
+		defer mu.Unlock()
+		if building {
+			select {
+			case g_interrupt_build <- syscall.SIGINT:
+			default:
+			}
+		}
+	}()
+
+	exit_code := this.Run(&request, conn)
+
+	mu.Lock()
+	building = false
+	mu.Unlock()
+	select {
+	case <-g_interrupt_build:
+	default:
+	}
+
+	payload := [4]byte{}
+	binary.BigEndian.PutUint32(payload[:], uint32(exit_code))
+	WriteDaemonFrame(conn, kDaemonExit, payload[:])
+}
+
+// / Point our stdout and stderr, and so whatever we and the commands in the
+// / console pool print, at pipes whose contents are sent as frames on
+// / |conn|.  The returned function puts them back once everything was sent.
+func RedirectOutput(conn net.Conn) (func(), error) {
+	wg := sync.WaitGroup{}
+	// Frames from the two pipes must not interleave.
+	mu := sync.Mutex{}
+	saved := []int{}
+	restore := func() {
+		for i, fd := range saved {
+			syscall.Dup3(fd, i+1, 0)
+			syscall.Close(fd)
+		}
+		wg.Wait()
+	}
+	for _, kind := range []byte{kDaemonStdout, kDaemonStderr} {
+		fd := len(saved) + 1
+		r, w, err := os.Pipe()
+		if err != nil {
+			restore()
+			return nil, err
+		}
+		saved_fd, err := syscall.Dup(fd)
+		if err != nil {
+			r.Close()
+			w.Close()
+			restore()
+			return nil, err
+		}
+		syscall.Dup3(int(w.Fd()), fd, 0)
+		w.Close()
+		saved = append(saved, saved_fd)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer r.Close()
+			buf := make([]byte, 32*1024)
+			for {
+				n, err := r.Read(buf)
+				if n > 0 {
+					mu.Lock()
+					WriteDaemonFrame(conn, kind, buf[:n])
+					mu.Unlock()
+				}
+				if err != nil {
+					return
+				}
+			}
+		}()
+	}
+	return restore, nil
+}
+
+// / Run as the daemon for the manifest of |options| until interrupted.
+// / Returns the exit code.
+func DaemonMain(ninja_command string, options *Options, config *BuildConfig) int {
+	daemon := Daemon{ninja_command_: ninja_command, options_: options, config_: config,
+		debug_: saveDebugFlags()}
+	if !daemon.Load() {
+		return 1
+	}
+
+	path := DaemonSocketPath(PeekBuildDir(options.InputFile))
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		Error("a daemon already serves %s", path)
+		return 1
+	}
+	// What is left of a daemon that didn't exit cleanly.
+	os.Remove(path)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		Error("%v", err)
+		return 1
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		Error("listening on %s: %v", path, err)
+		return 1
+	}
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-quit
+		listener.Close()
+	}()
+
+	Info("daemon serving builds on %s", path)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			break
+		}
+		daemon.Serve(conn)
+	}
+	if daemon.ninja_ != nil {
+		daemon.ninja_.CloseHashCache()
+		daemon.ninja_.Release()
+	}
+	return 0
+}
@@ -0,0 +1,9 @@
+//go:build windows
+
+package main
+
+// / The daemon relies on inotify and Unix fd redirection.
+func DaemonMain(ninja_command string, options *Options, config *BuildConfig) int {
+	Error("the daemon is not supported on Windows")
+	return 1
+}
@@ -127,6 +127,7 @@ func binaryLittleEndianToIntSlice(buf []byte) []int {
 }
 
 func (this *DepsLog) Load(path string, state *State, err1 *string) LoadStatus {
+	defer TraceSpan(kTraceMain, ".ninja_deps load", "log")()
 	this.file_path_ = path
 	_, err := os.Stat(path)
 	if err != nil {
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
 	"github.com/segmentio/fasthash/fnv1a"
@@ -13,19 +12,26 @@ import (
 )
 
 func hashFile(path, prefix string) ([]byte, error) {
-	h := blake3.New()
-	r, err := os.Open(path)
+	digest, err := hashFileDigest(path)
 	if err != nil {
 		return nil, err
 	}
-	hf := blake3.New()
-	_, err = io.Copy(hf, r)
-	r.Close()
-	if err != nil {
-		return nil, err
+	return hashFileEntry(digest, path, prefix), nil
+}
+
+// / Bind a file's content digest to its path relative to |prefix|.
+func hashFileEntry(digest []byte, path, prefix string) []byte {
+	h := blake3.New()
+	fmt.Fprintf(h, "f: %x %s\n", digest, strings.TrimPrefix(path, prefix))
+	return h.Sum(nil)
+}
+
+// / The blake3 digest of a file's contents, served from GHashCache if we have one.
+func hashFileDigest(path string) ([]byte, error) {
+	if GHashCache != nil {
+		return GHashCache.Hash(path)
 	}
-	fmt.Fprintf(h, "f: %x %s\n", hf.Sum(nil), strings.TrimPrefix(path, prefix))
-	return h.Sum(nil), nil
+	return hashFileContents(path)
 }
 
 func hashFileBase64(path, prefix string) (string, error) {
@@ -36,6 +42,61 @@ func hashFileBase64(path, prefix string) (string, error) {
 	return hex.EncodeToString(buf), nil
 }
 
+// / Combine the mtimes of |nodes|, as read through |disk_interface|, into
+// / one value, to tell cheaply whether any of them changed.  Missing nodes
+// / count with an mtime of 0.
+func NodesMtime(disk_interface DiskInterface, nodes []*Node) (TimeStamp, error) {
+	h := fnv1a.Init64
+	for _, node := range nodes {
+		mtime, _, err := disk_interface.StatMtime(node.path())
+		if err != nil {
+			return 0, err
+		}
+		h = fnv1a.AddString64(h, node.path())
+		h = fnv1a.AddUint64(h, uint64(mtime))
+	}
+	return TimeStamp(h), nil
+}
+
+// / The mtime of |path| in nanoseconds, or 0 if missing.  A directory's own
+// / mtime doesn't move when a file in it changes, so for a directory this
+// / combines the mtimes of the files below it instead.
+func DirMtime(path string) (mtime TimeStamp, notExist bool, err error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, true, nil
+		}
+		return -1, true, err
+	}
+	if !info.IsDir() {
+		return TimeStamp(info.ModTime().UnixNano()), false, nil
+	}
+	h := fnv1a.Init64
+	err = filepath.Walk(path, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		h = fnv1a.AddString64(h, path)
+		h = fnv1a.AddUint64(h, uint64(info.ModTime().UnixNano()))
+		return nil
+	})
+	if err != nil {
+		return -1, true, err
+	}
+	return TimeStamp(h), false, nil
+}
+
+// / The hash of |node|'s contents the build log records, as hashFileBase64()
+// / computes it, but from the node's cached digest.
+func OutputHash(node *Node, prefix string) (string, error) {
+	digest, err := node.Digest()
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hashFileEntry(digest, node.path(), prefix)), nil
+}
+
 type HashFunc func(files []string, prefix string, open func(string) (io.ReadCloser, error)) ([]byte, error)
 
 func hashDir(dir, prefix string) ([]byte, error) {
@@ -44,17 +105,15 @@ func hashDir(dir, prefix string) ([]byte, error) {
 		if info.IsDir() {
 			return nil
 		}
-		r, err := os.Open(path)
-		if err != nil {
-			return err
+		// Sockets and the like, such as the daemon's, have no contents.
+		if !info.Mode().IsRegular() && info.Mode()&os.ModeSymlink == 0 {
+			return nil
 		}
-		hf := sha256.New()
-		_, err = io.Copy(hf, r)
-		r.Close()
+		digest, err := hashFileDigest(path)
 		if err != nil {
 			return err
 		}
-		fmt.Fprintf(h, "%x  %s\n", hf.Sum(nil), strings.TrimPrefix(path, prefix))
+		fmt.Fprintf(h, "%x  %s\n", digest, strings.TrimPrefix(path, prefix))
 		return nil
 	})
 	if err != nil {
@@ -97,13 +156,18 @@ func DirHash(path, prefix string) (mtime TimeStamp, notExist bool, err error) {
 }
 
 func NodesHash(nodes []*Node, prefix string) (mtime TimeStamp, notExist bool, err error) {
+	// Queue all files first so that they are read in parallel, then combine
+	// the digests in order.
+	for _, node := range nodes {
+		node.PrefetchDigest()
+	}
 	h2 := fnv1a.Init64
 	for _, node := range nodes {
-		hash, err := hashFile(node.path(), prefix)
+		digest, err := node.Digest()
 		if err != nil {
 			return -1, true, err
 		}
-		h2 = fnv1a.AddBytes64(h2, hash)
+		h2 = fnv1a.AddBytes64(h2, hashFileEntry(digest, node.path(), prefix))
 	}
 	return TimeStamp(h2), false, nil
 }
@@ -25,6 +25,10 @@ type RealDiskInterface struct {
 	// works out, come up with a better data structure.
 	cache_ Cache
 
+	/// StatMtime() results by path while stat information can be cached,
+	/// on every platform; nil otherwise.
+	mtimes_ map[string]TimeStamp
+
 	BuildDir string
 }
 
@@ -41,6 +45,7 @@ type FileReader interface {
 type DiskInterface interface {
 	FileReader
 	StatNode(node *Node) (mtime TimeStamp, notExist bool, err error)
+	StatMtime(path string) (mtime TimeStamp, notExist bool, err error)
 	WriteFile(path string, contents string) bool
 	MakeDir(path string) bool
 	MakeDirs(path string, err *string) bool
@@ -69,7 +74,7 @@ func (this *RealDiskInterface) MakeDirs(path string, err1 *string) bool {
 	_, notExist, err := this.Stat(dir)
 	if err != nil {
 		*err1 = err.Error()
-		Error("%s", err1)
+		Error("%s", *err1)
 		return false
 	}
 	if !notExist {
@@ -182,8 +187,13 @@ func (this *RealDiskInterface) RemoveFile(path string) int {
 	return 0
 }
 
-// / Whether stat information can be cached.  Only has an effect on Windows.
+// / Whether stat information can be cached.  Only StatMtime() caches outside
+// / Windows.
 func (this *RealDiskInterface) AllowStatCache(allow bool) {
+	this.mtimes_ = nil
+	if allow {
+		this.mtimes_ = map[string]TimeStamp{}
+	}
 	if runtime.GOOS == "windows" {
 		this.use_cache_ = allow
 		if !this.use_cache_ {
@@ -192,6 +202,19 @@ func (this *RealDiskInterface) AllowStatCache(allow bool) {
 	}
 }
 
+// / The DirMtime() of |path|, 0 if missing and -1 on other errors.
+func (this *RealDiskInterface) StatMtime(path string) (mtime TimeStamp, notExist bool, err error) {
+	METRIC_RECORD("node stat mtime")
+	if mtime, ok := this.mtimes_[path]; ok {
+		return mtime, mtime == 0, nil
+	}
+	mtime, notExist, err = DirMtime(path)
+	if err == nil && this.mtimes_ != nil {
+		this.mtimes_[path] = mtime
+	}
+	return mtime, notExist, err
+}
+
 // / Whether long paths are enabled.  Only has an effect on Windows.
 func (this *RealDiskInterface) AreLongPathsEnabled() bool {
 	return this.long_paths_enabled_
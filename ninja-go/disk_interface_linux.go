@@ -3,29 +3,29 @@
 package main
 
 import (
-	"fmt"
 	"os"
 )
 
-func (this *RealDiskInterface) Stat(path, prefix string) (TimeStamp, error) {
+// / Node in_edge所有文件的Hash, path_也可能存在于远程，in_edge中的文件也可能存在于远程
+func (this *RealDiskInterface) StatNode(node *Node) (mtime TimeStamp, notExist bool, err error) {
+	if node.in_edge() == nil {
+		return this.Stat(node.path())
+	}
 	METRIC_RECORD("node stat")
-	var st syscall.Stat_t
-
-	err := syscall.Stat(path, &st)
+	_, err = os.Stat(node.path())
 	if err != nil {
 		if os.IsNotExist(err) || os.IsPermission(err) {
-			// 文件不存在或没有权限时返回0
-			return 0
+			return 0, true, nil
 		}
-		*err1 = fmt.Errorf("stat(%s): %s", path, err).Error()
-		return -1
-	}
-
-	if info.IsDir() {
-		return HashDirectory(path, prefix)
-	} else {
-		return HashSingleFile(path, prefix)
+		return -1, true, err
 	}
+	return NodesHash(node.in_edge().inputs_, this.BuildDir)
+}
 
-	return TimeStamp(mtime)
+// / stat() a file, returning its content hash, or 0 if missing and -1 on
+// / other errors.  Unlike Windows there is no per-directory stat cache; the
+// / hash cache already avoids rereading unchanged files.
+func (this *RealDiskInterface) Stat(path string) (mtime TimeStamp, notExist bool, err error) {
+	METRIC_RECORD("node stat")
+	return DirHash(path, this.BuildDir)
 }
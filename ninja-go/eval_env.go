@@ -152,7 +152,17 @@ func IsReservedBinding(var1 string) bool {
 		var1 == "restat" ||
 		var1 == "rspfile" ||
 		var1 == "rspfile_content" ||
-		var1 == "msvc_deps_prefix"
+		var1 == "msvc_deps_prefix" ||
+		var1 == "timeout" ||
+		var1 == "retries" ||
+		var1 == "retry_on_exit_codes" ||
+		var1 == "memory" ||
+		var1 == "pool_weight" ||
+		var1 == "sandbox" ||
+		var1 == "sandbox_paths" ||
+		var1 == "remote" ||
+		var1 == "remote_paths" ||
+		var1 == "hash"
 }
 
 func (this *Rule) GetBinding(key string) *EvalString {
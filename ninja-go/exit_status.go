@@ -6,4 +6,6 @@ const (
 	ExitSuccess     ExitStatus = 0
 	ExitFailure     ExitStatus = 1
 	ExitInterrupted ExitStatus = 2
+	/// The command ran past its timeout and was terminated.
+	ExitTimedOut ExitStatus = 3
 )
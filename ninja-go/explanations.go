@@ -9,7 +9,7 @@ type Explanations interface {
 	dummy()
 	Record(item interface{}, fmt string, args ...interface{})
 	RecordArgs(item interface{}, fmt1 string, args []interface{})
-	LookupAndAppend(item interface{}, out []string)
+	LookupAndAppend(item interface{}, out *[]string)
 	ptr() Explanations
 }
 
@@ -33,21 +33,21 @@ func (this *OptionalExplanations) Record(item interface{}, fmt string, args ...i
 
 // / Same as Record(), but uses a va_list to pass formatting arguments.
 func (this *OptionalExplanations) RecordArgs(item interface{}, fmt1 string, args []interface{}) {
-	buffer := fmt.Sprintf(fmt1, args)
+	buffer := fmt.Sprintf(fmt1, args...)
 	color.Black(fmt1, args)
 	this.map_[item] = append(this.map_[item], buffer)
 }
 
 // / Lookup the explanations recorded for |item|, and append them
 // / to |*out|, if any.
-func (this *OptionalExplanations) LookupAndAppend(item interface{}, out []string) {
+func (this *OptionalExplanations) LookupAndAppend(item interface{}, out *[]string) {
 	it, ok := this.map_[item]
 	if !ok {
 		return
 	}
 
 	for _, explanation := range it {
-		out = append(out, explanation)
+		*out = append(*out, explanation)
 	}
 }
 
@@ -1,5 +1,11 @@
 package main
 
+import (
+	"fmt"
+	"git.sr.ht/~sircmpwn/getopt"
+	"strings"
+)
+
 /* macros defined by this include file */
 const (
 	no_argument       = 0
@@ -27,3 +33,98 @@ var optind int = 0
 // var optarg string = ""
 var opterr int = 1
 var optopt int = '?'
+
+// / getopt_long(3) on top of a POSIX short option |spec|: "--name" and
+// / "--name=value" (or "--name value" for required_argument) are matched
+// / against |longopts| and reported with their |val| as the option rune.
+// / Parsing stops at the first non-option, at "--", or right after an option
+// / listed in |stop_after| (ninja's -t, whose flags belong to the tool).
+// / Returns the options and the index of the first unparsed argument.
+func GetoptLong(argv []string, spec string, longopts []option, stop_after string) ([]getopt.Option, int, error) {
+	has_arg := make(map[rune]bool)
+	runes := []rune(spec)
+	for i, rn := range runes {
+		if rn == ':' {
+			continue
+		}
+		has_arg[rn] = i+1 < len(runes) && runes[i+1] == ':'
+	}
+
+	opts := []getopt.Option{}
+	i := 1
+	for ; i < len(argv); i++ {
+		arg := argv[i]
+		if arg == "--" {
+			i++
+			break
+		}
+		if len(arg) < 2 || arg[0] != '-' {
+			break
+		}
+		if strings.HasPrefix(arg, "--") {
+			name, value, has_value := strings.Cut(arg[2:], "=")
+			var found *option = nil
+			for j := range longopts {
+				if longopts[j].name == name {
+					found = &longopts[j]
+					break
+				}
+			}
+			if found == nil {
+				return opts, i, fmt.Errorf("%s: unrecognized option '--%s'", argv[0], name)
+			}
+			switch found.has_arg {
+			case no_argument:
+				if has_value {
+					return opts, i, fmt.Errorf("%s: option '--%s' doesn't allow an argument", argv[0], name)
+				}
+			case required_argument:
+				if !has_value {
+					if i+1 >= len(argv) {
+						return opts, i, fmt.Errorf("%s: option '--%s' requires an argument", argv[0], name)
+					}
+					i++
+					value = argv[i]
+				}
+			}
+			if found.flag != nil {
+				*found.flag = found.val
+				continue
+			}
+			opts = append(opts, getopt.Option{Option: rune(found.val), Value: value})
+			continue
+		}
+
+		stop := false
+		shorts := []rune(arg[1:])
+		for j := 0; j < len(shorts); j++ {
+			rn := shorts[j]
+			takes_arg, ok := has_arg[rn]
+			if !ok {
+				return opts, i, getopt.UnknownOptionError(rn)
+			}
+			if !takes_arg {
+				opts = append(opts, getopt.Option{Option: rn})
+			} else {
+				value := string(shorts[j+1:])
+				if value == "" {
+					if i+1 >= len(argv) {
+						return opts, i, getopt.MissingOptionError(rn)
+					}
+					i++
+					value = argv[i]
+				}
+				opts = append(opts, getopt.Option{Option: rn, Value: value})
+				j = len(shorts)
+			}
+			if strings.ContainsRune(stop_after, rn) {
+				stop = true
+			}
+		}
+		if stop {
+			i++
+			break
+		}
+	}
+	return opts, i, nil
+}
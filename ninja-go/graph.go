@@ -8,7 +8,9 @@ import (
 	"log"
 	"runtime"
 	"slices"
+	"strconv"
 	"strings"
+	"time"
 )
 
 func NewNode(path string, slash_bits uint64) *Node {
@@ -63,9 +65,68 @@ func (this *Node) StatIfNecessary(disk_interface DiskInterface, err *string) boo
 
 // / Mark as not-yet-stat()ed and not dirty.
 func (this *Node) ResetState() {
+	this.ResetStat()
+	this.dirty_ = false
+	this.ResetDigest()
+}
+
+// / Mark as not-yet-stat()ed.
+func (this *Node) ResetStat() {
 	this.mtime_ = -1
 	this.exists_ = ExistenceStatusUnknown
-	this.dirty_ = false
+}
+
+// / Start hashing the contents of |node| unless its digest is already known.
+func (this *Node) PrefetchDigest() {
+	if this.digest_ == nil && GHashService != nil {
+		GHashService.Start(this.path())
+	}
+}
+
+// / The blake3 digest of |node|'s contents, computed at most once until the
+// / node is reset or rebuilt.
+func (this *Node) Digest() ([]byte, error) {
+	if this.digest_ != nil {
+		return this.digest_, nil
+	}
+	var digest []byte
+	var err error
+	if GHashService != nil {
+		digest, err = GHashService.Start(this.path()).Wait()
+	} else {
+		digest, err = hashFileDigest(this.path())
+	}
+	if err != nil {
+		// Don't remember failures, the file may well appear later.
+		if GHashService != nil {
+			GHashService.Forget(this.path())
+		}
+		return nil, err
+	}
+	this.digest_ = digest
+	return digest, nil
+}
+
+// / Take |node|'s digest from the hash cache if its mtime, as read through
+// / |disk_interface|, is the one the cached digest was computed for, so that
+// / Digest() needn't hash it.
+func (this *Node) DigestFromMtime(disk_interface DiskInterface) {
+	if this.digest_ != nil || GHashCache == nil {
+		return
+	}
+	mtime, notExist, err := disk_interface.StatMtime(this.path())
+	if err != nil || notExist {
+		return
+	}
+	this.digest_ = GHashCache.Lookup(this.path(), int64(mtime))
+}
+
+// / Forget the digest of |node|, whose file is about to change.
+func (this *Node) ResetDigest() {
+	this.digest_ = nil
+	if GHashService != nil {
+		GHashService.Forget(this.path())
+	}
 }
 
 // / Mark the Node as already-stat()ed and missing.
@@ -229,6 +290,8 @@ func (this *InputsCollector) Reset() {
 
 func NewEdge() *Edge {
 	ret := Edge{}
+	ret.prev_elapsed_time_millis = -1
+	ret.weight_ = 1
 	return &ret
 }
 
@@ -266,6 +329,109 @@ func (this *Edge) GetBindingBool(key string) bool {
 	return this.GetBinding(key) != ""
 }
 
+// / How long the edge's command may run before it is terminated: the
+// / "timeout" binding if set, else |config|'s JobTimeout.  0 means no limit.
+func (this *Edge) GetTimeout(config *BuildConfig) time.Duration {
+	if value := this.GetBinding("timeout"); value != "" {
+		if timeout, err := ParseTimeout(value); err == nil {
+			return timeout
+		}
+	}
+	return config.JobTimeout
+}
+
+// / How many times a failed command may be run again, per the "retries"
+// / binding.
+func (this *Edge) GetRetries() int {
+	retries, err := strconv.Atoi(this.GetBinding("retries"))
+	if err != nil || retries < 0 {
+		return 0
+	}
+	return retries
+}
+
+// / The exit codes the "retry_on_exit_codes" binding limits retries to, or
+// / nil if any failure may be retried.
+func (this *Edge) GetRetryExitCodes() []int {
+	codes, _ := ParseExitCodes(this.GetBinding("retry_on_exit_codes"))
+	return codes
+}
+
+// / How much memory the command is expected to need, per the "memory"
+// / binding, in bytes.  0 if unknown.
+func (this *Edge) GetMemory() int64 {
+	memory, err := ParseMemorySize(this.GetBinding("memory"))
+	if err != nil {
+		return 0
+	}
+	return memory
+}
+
+// / How an edge tells whether its inputs changed since its last build.
+type HashMode int8
+
+const (
+	/// Hash the contents of every input.
+	kHashContent HashMode = iota
+	/// Only compare the inputs' mtimes; nothing is hashed.
+	kHashMtime
+	/// Compare the mtimes first, and hash the inputs when they moved.
+	kHashBoth
+)
+
+// / Parse a "hash" binding or --hash flag: content, mtime or both.
+func ParseHashMode(value string) (HashMode, error) {
+	switch value {
+	case "content":
+		return kHashContent, nil
+	case "mtime":
+		return kHashMtime, nil
+	case "both":
+		return kHashBoth, nil
+	}
+	return kHashContent, fmt.Errorf("unknown hash mode '%s'", value)
+}
+
+// / How |edge| tells whether its inputs changed: per its "hash" binding if
+// / set, else |config|'s HashMode.
+func (this *Edge) GetHashMode(config *BuildConfig) HashMode {
+	if value := this.GetBinding("hash"); value != "" {
+		if mode, err := ParseHashMode(value); err == nil {
+			return mode
+		}
+	}
+	return config.HashMode
+}
+
+// / Parse a list of exit codes separated by spaces or commas.
+func ParseExitCodes(value string) ([]int, error) {
+	var codes []int
+	for _, field := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ' ' }) {
+		code, err := strconv.Atoi(field)
+		if err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+	}
+	return codes, nil
+}
+
+// / Parse a timeout binding or flag: a Go duration such as "90s" or "10m",
+// / or a plain number of seconds.
+func ParseTimeout(value string) (time.Duration, error) {
+	if seconds, err := strconv.Atoi(value); err == nil {
+		value = strconv.Itoa(seconds) + "s"
+	}
+	timeout, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, err
+	}
+	if timeout < 0 {
+		return 0, fmt.Errorf("negative timeout %s", value)
+	}
+	return timeout, nil
+}
+
 // / Like GetBinding("depfile"), but without shell escaping.
 func (this *Edge) GetUnescapedDepfile() string {
 	env := NewEdgeEnv(this, kDoNotEscape)
@@ -320,7 +486,7 @@ func (this *Edge) set_critical_path_weight(critical_path_weight int64) {
 
 func (this *Edge) rule() *Rule         { return this.rule_ }
 func (this *Edge) pool() *Pool         { return this.pool_ }
-func (this *Edge) weight() int         { return 1 }
+func (this *Edge) weight() int         { return this.weight_ }
 func (this *Edge) outputs_ready() bool { return this.outputs_ready_ }
 
 func (this *Edge) is_implicit(index int64) bool {
@@ -379,6 +545,9 @@ func (this *DependencyScan) RecomputeDirty(builder *Builder, initial_node *Node,
 	new_validation_nodes := []*Node{}
 	nodes := deque.NewDeque() //(1, initial_node);
 	nodes.PushBack(initial_node)
+	if GHashService != nil {
+		GHashService.Reset()
+	}
 
 	// RecomputeNodeDirty might return new validation nodes that need to be
 	// checked for dirty state, keep a queue of nodes to visit.
@@ -420,6 +589,63 @@ func (this *DependencyScan) RecomputeOutputsDirty(edge *Edge, inputs []*Node, ou
 	return true
 }
 
+// / Record in the deps log the deps that came with the remote cache hit the
+// / outputs of |edge| were restored from, and in the build log the outputs
+// / as built from the inputs with those deps, which the next build sees.
+// / @return false on error, or without filling \a err if there was no hit.
+func (this *DependencyScan) RecordRemoteHit(edge *Edge, inputs []*Node, err *string) bool {
+	if this.build_log() == nil || this.deps_log() == nil || this.Config_.RbeService == "" ||
+		edge.GetBinding("deps") == "" {
+		return false
+	}
+	command_hash := HashCommand(edge.EvaluateCommand( /*incl_rsp_file=*/ true))
+	mtime, _, err1 := NodesHash(inputs, this.PrefixDir)
+	if err1 != nil {
+		return false
+	}
+	hit := this.build_log().RemoteHit(this.Config_, edge, command_hash, mtime)
+	if hit == nil {
+		return false
+	}
+	nodes := []*Node{}
+	for _, dep := range hit.deps_ {
+		path := dep.path_
+		var slash_bits uint64 = 0
+		CanonicalizePath(&path, &slash_bits)
+		nodes = append(nodes, this.dep_loader_.state_.GetNode(path, slash_bits))
+	}
+	for _, o := range edge.outputs_ {
+		deps_mtime, _, err1 := this.disk_interface_.StatNode(o)
+		if err1 != nil {
+			*err = err1.Error()
+			return false
+		}
+		if !this.deps_log().RecordDeps(o, deps_mtime, nodes, err) {
+			*err = "Error writing to deps log: " + *err
+			return false
+		}
+	}
+
+	// LoadDepsFromLog() appends the deps to the inputs.
+	if edge.deps_missing_ {
+		inputs = append(inputs[:len(inputs):len(inputs)], nodes...)
+		if mtime, _, err1 = NodesHash(inputs, this.PrefixDir); err1 != nil {
+			*err = err1.Error()
+			return false
+		}
+	}
+	inputs_mtime, err1 := NodesMtime(this.disk_interface_, inputs)
+	if err1 != nil {
+		*err = err1.Error()
+		return false
+	}
+	if !this.build_log().RecordRemoteHit(hit, mtime, inputs_mtime) {
+		*err = "Error writing to build log"
+		return false
+	}
+	return true
+}
+
 func (this *DependencyScan) build_log() *BuildLog {
 	return this.build_log_
 }
@@ -478,6 +704,7 @@ func (this *DependencyScan) RecomputeNodeDirty(builder *Builder, node *Node,
 	*stack = append(*stack, node)
 
 	dirty := false
+	inputs_dirty := false
 	edge.outputs_ready_ = true
 	edge.deps_missing_ = false
 
@@ -535,6 +762,14 @@ func (this *DependencyScan) RecomputeNodeDirty(builder *Builder, node *Node,
 	// and recurse into them.
 	*validation_nodes = append(*validation_nodes, edge.validations_...)
 
+	// Start hashing source inputs now so that they are read while we walk
+	// the rest of the graph.  Generated inputs may still be rebuilt.
+	for _, i := range edge.inputs_ {
+		if i.in_edge() == nil {
+			i.PrefetchDigest()
+		}
+	}
+
 	// Visit all inputs; we're dirty if any of the inputs are dirty.
 	var inputs []*Node = edge.inputs_
 	for index, i := range edge.inputs_ {
@@ -557,6 +792,7 @@ func (this *DependencyScan) RecomputeNodeDirty(builder *Builder, node *Node,
 			if i.dirty() {
 				this.explanations_.Record(node, "%s is dirty", (*i).path())
 				dirty = true
+				inputs_dirty = true
 			}
 		}
 	}
@@ -567,6 +803,26 @@ func (this *DependencyScan) RecomputeNodeDirty(builder *Builder, node *Node,
 		if !this.RecomputeOutputsDirty(edge, inputs, &dirty, err) {
 			return false
 		}
+		if !dirty && !this.RecordRemoteHit(edge, inputs, err) && *err != "" {
+			return false
+		}
+	} else if edge.deps_missing_ && !inputs_dirty && this.Config_.RbeService != "" &&
+		edge.GetBinding("deps") != "" {
+		// A remote cache hit brings the deps along; look the edge up rather
+		// than rebuild it only to discover them.
+		dirty = false
+		if !this.RecomputeOutputsDirty(edge, inputs, &dirty, err) {
+			return false
+		}
+		if !dirty {
+			if this.RecordRemoteHit(edge, inputs, err) {
+				edge.deps_missing_ = false
+			} else if *err != "" {
+				return false
+			} else {
+				dirty = true
+			}
+		}
 	}
 
 	// Finally, visit each output and update their dirty state if necessary.
@@ -663,19 +919,10 @@ func (this *DependencyScan) RecomputeOutputDirty(edge *Edge, inputs []*Node, com
 
 	var entry *LogEntry = nil
 
-	// If this is a restat rule, we may have cleaned the output in a
-	// previous run and stored the command start time in the build log.
-	// We don't want to consider a restat rule's outputs as dirty unless
-	// an input changed since the last run, so we'll skip checking the
-	// output file's actual mtime and simply check the recorded mtime from
-	// the log against the most recent input's mtime (see below)
-	//used_restat := false
-	//if edge.GetBindingBool("restat") && this.build_log() != nil {
-	//	entry = this.build_log().LookupByOutput(this.Config_, output.path())
-	//	if entry != nil {
-	//		used_restat = true
-	//	}
-	//}
+	// Restat rules need no special case: even when the command left the
+	// output alone, the log records the state of the inputs it is up to
+	// date with (see Builder::FinishCommand), which is what we compare the
+	// current inputs against below.
 
 	// Dirty if the output is older than the input.
 	//if !used_restat && most_recent_input != nil && output.mtime() != most_recent_input.mtime() {
@@ -689,12 +936,48 @@ func (this *DependencyScan) RecomputeOutputDirty(edge *Edge, inputs []*Node, com
 
 	if this.build_log() != nil {
 		generator := edge.GetBindingBool("generator")
-		currentMtime, _, err := NodesHash(inputs, this.PrefixDir)
 		currentHash := HashCommand(command)
+
+		// Compare the inputs' mtimes with those the log recorded first, which
+		// is much cheaper than hashing them.
+		mode := edge.GetHashMode(this.Config_)
+		var currentInputsMtime TimeStamp = 0
+		if mode != kHashContent {
+			var err error
+			currentInputsMtime, err = NodesMtime(this.disk_interface_, inputs)
+			entry = this.build_log().entries_[output.path()]
+			if entry != nil && err == nil && entry.inputs_mtime == currentInputsMtime &&
+				(generator || currentHash == entry.command_hash) {
+				return false
+			}
+			if mode == kHashMtime {
+				if entry == nil {
+					if generator {
+						return false
+					}
+					this.explanations_.Record(output, "command line not found in log for %s",
+						output.path())
+				} else if !generator && currentHash != entry.command_hash {
+					this.explanations_.Record(output, "command line changed for %s", output.path())
+				} else {
+					this.explanations_.Record(output, "inputs of %s changed since it was built",
+						output.path())
+				}
+				return true
+			}
+			// The mtimes moved; let the contents decide, hashing again only the
+			// inputs whose own mtime moved.
+			for _, input := range inputs {
+				input.DigestFromMtime(this.disk_interface_)
+			}
+			entry = nil
+		}
+
+		currentMtime, _, err := NodesHash(inputs, this.PrefixDir)
 		color.Blue("command: %s, currentHash: %x, currentMtime: %d", command, currentHash, currentMtime)
 
 		if entry != nil || func() bool {
-			entry = this.build_log().LookupByOutput(this.Config_, output.path(), currentHash, currentMtime)
+			entry = this.build_log().LookupByOutput(this.Config_, edge, output.path(), currentHash, currentMtime)
 			return entry != nil
 		}() {
 			if !generator && currentHash != entry.command_hash {
@@ -724,6 +1007,11 @@ func (this *DependencyScan) RecomputeOutputDirty(edge *Edge, inputs []*Node, com
 				output.path())
 			return true
 		}
+		if entry != nil && mode == kHashBoth && err == nil {
+			// Only the mtimes changed, say by a touch; record the new ones so
+			// that we don't hash the inputs again next time.
+			this.build_log().RecordInputsMtime(entry, currentInputsMtime)
+		}
 	}
 
 	return false
@@ -51,23 +51,44 @@ type Edge struct {
 	// Historical info: how long did this edge take last time,
 	// as per .ninja_log, if known? Defaults to -1 if unknown.
 	prev_elapsed_time_millis int64
+
+	// How many times the command failed and was run again during this build.
+	retries_ int
+
+	// For a restat edge whose command is running, the digests of its
+	// outputs when the command started, nil for outputs that were missing.
+	restat_digests_ [][]byte
+
+	// How many slots of its pool the edge takes, per its "pool_weight"
+	// binding.  Defaults to 1.
+	weight_ int
 }
 
 type EdgeCmp struct {
 }
 
-// Compare returns reverse order
+// Compare orders the ready queue, a min-heap, so that the edge with the
+// heaviest critical path comes out first.  Ties go to the edge declared
+// first, which keeps the order deterministic.
 func (this *EdgeCmp) Compare(a1, b1 interface{}) (int, error) {
 	a, b := a1.(*Edge), b1.(*Edge)
-	if a.id_ > b.id_ {
-		return 1, nil
-	}
-	if a.id_ < b.id_ {
+	if EdgePriorityLess(b, a) {
 		return -1, nil
 	}
+	if EdgePriorityLess(a, b) {
+		return 1, nil
+	}
 	return 0, nil
 }
 
+// EdgePriorityLess reports whether |a| should be scheduled after |b|.
+func EdgePriorityLess(a, b *Edge) bool {
+	if a.critical_path_weight_ != b.critical_path_weight_ {
+		return a.critical_path_weight_ < b.critical_path_weight_
+	}
+	return a.id_ > b.id_
+}
+
 type ExistenceStatus int8
 
 const (
@@ -94,6 +115,9 @@ type Node struct {
 
 	exists_ ExistenceStatus
 
+	/// blake3 digest of the file's contents once hashed, nil if unknown.
+	digest_ []byte
+
 	/// Dirty is true when the underlying file is out-of-date.
 	/// But note that Edge::outputs_ready_ is also used in judging which
 	/// edges to build.
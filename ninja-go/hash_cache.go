@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/zeebo/blake3"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// / The identity of a file as far as the hash cache is concerned.  If none
+// / of these change, the contents are assumed unchanged.
+type FileStat struct {
+	dev      uint64
+	ino      uint64
+	size     int64
+	mtime_ns int64
+	ctime_ns int64
+}
+
+type HashCacheEntry struct {
+	stat_ FileStat
+
+	/// When the digest was computed, used to detect racily clean entries.
+	hashed_ns_ int64
+
+	/// blake3 digest of the file contents.
+	digest_ []byte
+}
+
+// / HashCache remembers the content digest of every file we hashed, keyed by
+// / path and validated against the file's stat tuple, much like git's index.
+// / It lets a no-op build skip reading inputs whose stat tuple is unchanged.
+type HashCache struct {
+	/// Guards entries_ and dirty_, Hash() is called from HashService workers.
+	mu_ sync.Mutex
+
+	entries_   map[string]*HashCacheEntry
+	file_path_ string
+
+	/// Whether entries_ changed since the cache was loaded.
+	dirty_ bool
+}
+
+// / The hash cache used by hashFile(), or nil to always read files in full.
+var GHashCache *HashCache = nil
+
+const kHashCacheSignature = "# ninja-go hashes v%d\n"
+const kHashCacheVersion = 1
+
+func NewHashCache() *HashCache {
+	ret := HashCache{}
+	ret.entries_ = make(map[string]*HashCacheEntry)
+	return &ret
+}
+
+// / Load the on-disk cache.  Unreadable entries are dropped, they will just
+// / be hashed again.
+func (this *HashCache) Load(path string, err1 *string) LoadStatus {
+	METRIC_RECORD(".ninja_hashes load")
+	defer TraceSpan(kTraceMain, ".ninja_hashes load", "log")()
+	this.file_path_ = path
+	file, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return LOAD_NOT_FOUND
+		}
+		*err1 = err.Error()
+		return LOAD_ERROR
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	header, err := reader.ReadString('\n')
+	if err != nil && err != io.EOF {
+		*err1 = err.Error()
+		return LOAD_ERROR
+	}
+	version := 0
+	if _, err := fmt.Sscanf(header, kHashCacheSignature, &version); err != nil || version != kHashCacheVersion {
+		// Start over; the file is rewritten on Save().
+		this.dirty_ = true
+		return LOAD_NOT_FOUND
+	}
+
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			*err1 = err.Error()
+			return LOAD_ERROR
+		}
+		if !strings.HasSuffix(line, "\n") {
+			if line != "" {
+				this.dirty_ = true
+			}
+			break
+		}
+		path, entry := ParseHashCacheEntry(strings.TrimSuffix(line, "\n"))
+		if entry == nil {
+			this.dirty_ = true
+			continue
+		}
+		this.entries_[path] = entry
+	}
+	return LOAD_SUCCESS
+}
+
+func ParseHashCacheEntry(line string) (string, *HashCacheEntry) {
+	fields := strings.SplitN(line, "\t", 8)
+	if len(fields) != 8 || fields[7] == "" {
+		return "", nil
+	}
+	var nums [6]int64
+	for i := 0; i < 6; i++ {
+		v, err := strconv.ParseInt(fields[i], 10, 64)
+		if err != nil {
+			return "", nil
+		}
+		nums[i] = v
+	}
+	digest, err := hex.DecodeString(fields[6])
+	if err != nil {
+		return "", nil
+	}
+	entry := HashCacheEntry{}
+	entry.stat_ = FileStat{dev: uint64(nums[0]), ino: uint64(nums[1]), size: nums[2],
+		mtime_ns: nums[3], ctime_ns: nums[4]}
+	entry.hashed_ns_ = nums[5]
+	entry.digest_ = digest
+	return fields[7], &entry
+}
+
+// / Write the cache back to disk if anything changed.
+func (this *HashCache) Save(err *string) bool {
+	this.mu_.Lock()
+	defer this.mu_.Unlock()
+	if !this.dirty_ || this.file_path_ == "" {
+		return true
+	}
+	METRIC_RECORD(".ninja_hashes save")
+	temp_path := this.file_path_ + ".tmp"
+	f, err1 := os.OpenFile(temp_path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err1 != nil {
+		*err = err1.Error()
+		return false
+	}
+	w := bufio.NewWriter(f)
+	fmt.Fprintf(w, kHashCacheSignature, kHashCacheVersion)
+	for path, e := range this.entries_ {
+		fmt.Fprintf(w, "%d\t%d\t%d\t%d\t%d\t%d\t%x\t%s\n",
+			int64(e.stat_.dev), int64(e.stat_.ino), e.stat_.size, e.stat_.mtime_ns,
+			e.stat_.ctime_ns, e.hashed_ns_, e.digest_, path)
+	}
+	if err1 = w.Flush(); err1 != nil {
+		f.Close()
+		*err = err1.Error()
+		return false
+	}
+	if err1 = f.Close(); err1 != nil {
+		*err = err1.Error()
+		return false
+	}
+	if err1 = os.Rename(temp_path, this.file_path_); err1 != nil {
+		*err = err1.Error()
+		return false
+	}
+	this.dirty_ = false
+	return true
+}
+
+// / The cached digest of |path| if it was computed for the file as it was
+// / at |mtime_ns|, without stat()ing it; nil otherwise.
+func (this *HashCache) Lookup(path string, mtime_ns int64) []byte {
+	this.mu_.Lock()
+	defer this.mu_.Unlock()
+	e, ok := this.entries_[path]
+	if !ok || e.stat_.mtime_ns != mtime_ns || e.IsRacy() {
+		return nil
+	}
+	return e.digest_
+}
+
+// / Return the blake3 digest of |path|'s contents, reading the file only if
+// / its stat tuple differs from the cached one.
+func (this *HashCache) Hash(path string) ([]byte, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		this.mu_.Lock()
+		if _, ok := this.entries_[path]; ok {
+			delete(this.entries_, path)
+			this.dirty_ = true
+		}
+		this.mu_.Unlock()
+		return nil, err
+	}
+	stat := StatFileInfo(info)
+	this.mu_.Lock()
+	e, ok := this.entries_[path]
+	this.mu_.Unlock()
+	if ok && e.stat_ == stat && !e.IsRacy() {
+		return e.digest_, nil
+	}
+
+	METRIC_RECORD("hash cache miss")
+	// Take the timestamp before reading so that a write racing with the read
+	// is caught by IsRacy() next time.
+	hashed_ns := time.Now().UnixNano()
+	digest, err := hashFileContents(path)
+	if err != nil {
+		return nil, err
+	}
+	this.mu_.Lock()
+	this.entries_[path] = &HashCacheEntry{stat_: stat, hashed_ns_: hashed_ns, digest_: digest}
+	this.dirty_ = true
+	this.mu_.Unlock()
+	return digest, nil
+}
+
+// / An entry is racily clean if the file was modified in the same second we
+// / hashed it: filesystems with coarse timestamps could then hide a later
+// / write behind an unchanged stat tuple, so such entries are never trusted.
+func (this *HashCacheEntry) IsRacy() bool {
+	changed_ns := this.stat_.mtime_ns
+	if this.stat_.ctime_ns > changed_ns {
+		changed_ns = this.stat_.ctime_ns
+	}
+	return changed_ns/int64(time.Second) >= this.hashed_ns_/int64(time.Second)
+}
+
+// / Read and hash a file in full, bypassing any cache.
+func hashFileContents(path string) ([]byte, error) {
+	defer TraceSpan(kTraceHashing, path, "hash")()
+	r, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	hf := blake3.New()
+	_, err = io.Copy(hf, r)
+	r.Close()
+	if err != nil {
+		return nil, err
+	}
+	return hf.Sum(nil), nil
+}
@@ -0,0 +1,22 @@
+//go:build linux
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+func StatFileInfo(info os.FileInfo) FileStat {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return FileStat{size: info.Size(), mtime_ns: info.ModTime().UnixNano()}
+	}
+	return FileStat{
+		dev:      st.Dev,
+		ino:      st.Ino,
+		size:     st.Size,
+		mtime_ns: st.Mtim.Nano(),
+		ctime_ns: st.Ctim.Nano(),
+	}
+}
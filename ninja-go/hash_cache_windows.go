@@ -0,0 +1,22 @@
+//go:build windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// Windows has no inode number in the stat data; the path key plus size and
+// both timestamps identify the file well enough.
+func StatFileInfo(info os.FileInfo) FileStat {
+	st, ok := info.Sys().(*syscall.Win32FileAttributeData)
+	if !ok {
+		return FileStat{size: info.Size(), mtime_ns: info.ModTime().UnixNano()}
+	}
+	return FileStat{
+		size:     info.Size(),
+		mtime_ns: st.LastWriteTime.Nanoseconds(),
+		ctime_ns: st.CreationTime.Nanoseconds(),
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"sync"
+)
+
+// / A file digest being computed, or already computed, by the HashService.
+type HashRequest struct {
+	path_   string
+	done_   chan struct{}
+	digest_ []byte
+	err_    error
+}
+
+// / Wait for the digest to be computed.
+func (this *HashRequest) Wait() ([]byte, error) {
+	<-this.done_
+	return this.digest_, this.err_
+}
+
+// / HashService hashes input files on a fixed pool of goroutines.  Requests
+// / are keyed by path, so the same file reached from several edges during one
+// / RecomputeDirty walk is only read once; the waiting side keeps the result
+// / on the Node so later lookups don't even need the service.
+type HashService struct {
+	/// The requests the workers pull; there are as many workers as files
+	/// read at once.
+	queue_ chan *HashRequest
+
+	mu_       sync.Mutex
+	requests_ map[string]*HashRequest
+}
+
+// / The hashing service used by NodesHash(), or nil to hash serially.
+var GHashService *HashService = nil
+
+func NewHashService(parallelism int) *HashService {
+	if parallelism < 1 {
+		parallelism = 1
+	}
+	ret := HashService{}
+	ret.queue_ = make(chan *HashRequest, 64*parallelism)
+	ret.requests_ = make(map[string]*HashRequest)
+	for i := 0; i < parallelism; i++ {
+		go ret.Work()
+	}
+	return &ret
+}
+
+// / Hash the files of queued requests, for the life of the process.
+func (this *HashService) Work() {
+	for req := range this.queue_ {
+		req.digest_, req.err_ = hashFileDigest(req.path_)
+		close(req.done_)
+	}
+}
+
+// / Start hashing |path| in the background unless a request for it is
+// / already pending, and return that request.
+func (this *HashService) Start(path string) *HashRequest {
+	this.mu_.Lock()
+	if req, ok := this.requests_[path]; ok {
+		this.mu_.Unlock()
+		return req
+	}
+	req := &HashRequest{path_: path, done_: make(chan struct{})}
+	this.requests_[path] = req
+	this.mu_.Unlock()
+	// Blocks while the queue is full, which only slows down prefetching.
+	this.queue_ <- req
+	return req
+}
+
+// / Drop the result for |path|, e.g. because an edge just rewrote it.
+func (this *HashService) Forget(path string) {
+	this.mu_.Lock()
+	defer this.mu_.Unlock()
+	delete(this.requests_, path)
+}
+
+// / Drop all results; called at the start of each RecomputeDirty walk.
+func (this *HashService) Reset() {
+	this.mu_.Lock()
+	defer this.mu_.Unlock()
+	this.requests_ = make(map[string]*HashRequest)
+}
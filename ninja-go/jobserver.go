@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// / Where to find a GNU make jobserver, as announced in MAKEFLAGS by
+// / --jobserver-auth=fifo:PATH (make >= 4.4) or --jobserver-auth=R,W (older
+// / makes, which pass an inherited pipe).
+type JobserverConfig struct {
+	fifo_     string
+	read_fd_  int
+	write_fd_ int
+}
+
+// / Parse MAKEFLAGS.  Returns nil if it doesn't name a jobserver.
+func ParseJobserverFlags(makeflags string) (*JobserverConfig, error) {
+	value := ""
+	for _, word := range strings.Fields(makeflags) {
+		// make repeats the flag for each level of recursion; the last wins.
+		if v, ok := strings.CutPrefix(word, "--jobserver-auth="); ok {
+			value = v
+		} else if v, ok := strings.CutPrefix(word, "--jobserver-fds="); ok {
+			value = v
+		}
+	}
+	if value == "" {
+		return nil, nil
+	}
+
+	ret := JobserverConfig{read_fd_: -1, write_fd_: -1}
+	if fifo, ok := strings.CutPrefix(value, "fifo:"); ok {
+		ret.fifo_ = fifo
+		return &ret, nil
+	}
+	r, w, ok := strings.Cut(value, ",")
+	if !ok {
+		return nil, fmt.Errorf("unsupported jobserver '%s'", value)
+	}
+	var err1, err2 error
+	ret.read_fd_, err1 = strconv.Atoi(r)
+	ret.write_fd_, err2 = strconv.Atoi(w)
+	if err1 != nil || err2 != nil || ret.read_fd_ < 0 || ret.write_fd_ < 0 {
+		return nil, fmt.Errorf("invalid jobserver file descriptors '%s'", value)
+	}
+	return &ret, nil
+}
+
+// / Replace any -j and jobserver flags in |makeflags| by |jobs| and |auth|.
+func RewriteMakeflags(makeflags string, jobs int, auth string) string {
+	words := []string{}
+	for _, word := range strings.Fields(makeflags) {
+		if strings.HasPrefix(word, "-j") || strings.HasPrefix(word, "--jobs") ||
+			strings.HasPrefix(word, "--jobserver-") {
+			continue
+		}
+		words = append(words, word)
+	}
+	if jobs > 0 {
+		words = append(words, "-j"+strconv.Itoa(jobs))
+	}
+	words = append(words, "--jobserver-auth="+auth)
+	return strings.Join(words, " ")
+}
+
+// / JobserverClient takes a token from the jobserver for every job beyond
+// / the first, which runs on the slot implicitly owned by each client.
+type JobserverClient struct {
+	read_  *os.File
+	write_ *os.File
+
+	/// Tokens read from the jobserver; they are written back as they were.
+	tokens_ []byte
+
+	/// The fifo we created when acting as the jobserver, removed on Close().
+	server_dir_ string
+}
+
+// / The jobserver shared by every command runner of this process.
+var g_jobserver *JobserverClient = nil
+var g_jobserver_setup bool = false
+
+// / Connect to the jobserver named in MAKEFLAGS, or, if |config| asks for
+// / it and there is none, create one sized to the -j limit and announce it
+// / to our children through MAKEFLAGS.  Returns nil if no jobserver is used.
+func SetupJobserver(config *BuildConfig) *JobserverClient {
+	if g_jobserver_setup {
+		return g_jobserver
+	}
+	g_jobserver_setup = true
+
+	makeflags := os.Getenv("MAKEFLAGS")
+	jobserver, err := ParseJobserverFlags(makeflags)
+	if err != nil {
+		Warning("ignoring jobserver: %s", err.Error())
+		return nil
+	}
+	if jobserver != nil {
+		client, err := OpenJobserverClient(jobserver)
+		if err != nil {
+			Warning("ignoring jobserver: %s", err.Error())
+			return nil
+		}
+		// Children inherit MAKEFLAGS, and with the pipe variant also the
+		// inherited fds, so they share the same jobserver.
+		g_jobserver = client
+		return g_jobserver
+	}
+
+	if !config.Jobserver || config.Parallelism <= 1 {
+		return nil
+	}
+	client, fifo, err := CreateJobserver(config.Parallelism - 1)
+	if err != nil {
+		Warning("cannot create jobserver: %s", err.Error())
+		return nil
+	}
+	os.Setenv("MAKEFLAGS", RewriteMakeflags(makeflags, config.Parallelism, "fifo:"+fifo))
+	g_jobserver = client
+	return g_jobserver
+}
+
+// / Return all tokens and remove the jobserver we created, if any.
+func CloseJobserver() {
+	if g_jobserver != nil {
+		g_jobserver.Close()
+		g_jobserver = nil
+	}
+}
+
+// / Number of tokens currently held.
+func (this *JobserverClient) Tokens() int {
+	return len(this.tokens_)
+}
+
+// / Take a token if one is available, without blocking.
+func (this *JobserverClient) Acquire() bool {
+	token, ok := this.TryReadToken()
+	if ok {
+		this.tokens_ = append(this.tokens_, token)
+	}
+	return ok
+}
+
+// / Give one token back.
+func (this *JobserverClient) Release() {
+	if len(this.tokens_) == 0 {
+		return
+	}
+	token := this.tokens_[len(this.tokens_)-1]
+	if _, err := this.write_.Write([]byte{token}); err != nil {
+		Warning("returning jobserver token: %s", err.Error())
+	}
+	this.tokens_ = this.tokens_[:len(this.tokens_)-1]
+}
+
+func (this *JobserverClient) Close() {
+	for len(this.tokens_) != 0 {
+		this.Release()
+	}
+	this.read_.Close()
+	if this.write_ != this.read_ {
+		this.write_.Close()
+	}
+	if this.server_dir_ != "" {
+		os.RemoveAll(this.server_dir_)
+	}
+}
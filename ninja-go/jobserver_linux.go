@@ -0,0 +1,101 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+// / Open our own non-blocking handles on the jobserver.  For the pipe
+// / variant we reopen the inherited fds through /proc so that O_NONBLOCK
+// / doesn't leak into make's file description of the pipe.  The original
+// / fds stay open, so our children inherit them just like we did.
+func OpenJobserverClient(config *JobserverConfig) (*JobserverClient, error) {
+	ret := JobserverClient{}
+	if config.fifo_ != "" {
+		f, err := os.OpenFile(config.fifo_, os.O_RDWR|syscall.O_NONBLOCK, 0)
+		if err != nil {
+			return nil, err
+		}
+		ret.read_ = f
+		ret.write_ = f
+		return &ret, nil
+	}
+
+	for _, fd := range []int{config.read_fd_, config.write_fd_} {
+		if _, err := fcntl(fd, syscall.F_GETFD); err != nil {
+			return nil, fmt.Errorf("jobserver fd %d is not open; is the command marked with '+' in the Makefile?", fd)
+		}
+	}
+	r, err := os.OpenFile("/proc/self/fd/"+strconv.Itoa(config.read_fd_), os.O_RDONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, err
+	}
+	w, err := os.OpenFile("/proc/self/fd/"+strconv.Itoa(config.write_fd_), os.O_WRONLY, 0)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	ret.read_ = r
+	ret.write_ = w
+	return &ret, nil
+}
+
+// / Create a fifo jobserver holding |tokens| tokens and connect to it.
+func CreateJobserver(tokens int) (*JobserverClient, string, error) {
+	dir, err := os.MkdirTemp("", "ninja-jobserver-")
+	if err != nil {
+		return nil, "", err
+	}
+	fifo := filepath.Join(dir, "fifo")
+	if err := syscall.Mkfifo(fifo, 0600); err != nil {
+		os.RemoveAll(dir)
+		return nil, "", err
+	}
+	client, err := OpenJobserverClient(&JobserverConfig{fifo_: fifo, read_fd_: -1, write_fd_: -1})
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, "", err
+	}
+	client.server_dir_ = dir
+	buf := make([]byte, tokens)
+	for i := range buf {
+		buf[i] = '+'
+	}
+	if _, err := client.write_.Write(buf); err != nil {
+		client.Close()
+		return nil, "", err
+	}
+	return client, fifo, nil
+}
+
+// / Read one token without blocking.
+func (this *JobserverClient) TryReadToken() (byte, bool) {
+	conn, err := this.read_.SyscallConn()
+	if err != nil {
+		return 0, false
+	}
+	buf := []byte{0}
+	n := 0
+	var err1 error
+	conn.Read(func(fd uintptr) bool {
+		n, err1 = syscall.Read(int(fd), buf)
+		return true // Never wait for the poller, EAGAIN means no token.
+	})
+	if err1 != nil || n != 1 {
+		return 0, false
+	}
+	return buf[0], true
+}
+
+func fcntl(fd int, cmd int) (int, error) {
+	r, _, errno := syscall.Syscall(syscall.SYS_FCNTL, uintptr(fd), uintptr(cmd), 0)
+	if errno != 0 {
+		return -1, errno
+	}
+	return int(r), nil
+}
@@ -0,0 +1,21 @@
+//go:build windows
+
+package main
+
+import (
+	"errors"
+)
+
+// / GNU make on Windows announces a named semaphore rather than a pipe or
+// / fifo, which we don't support.
+func OpenJobserverClient(config *JobserverConfig) (*JobserverClient, error) {
+	return nil, errors.New("jobserver is not supported on Windows")
+}
+
+func CreateJobserver(tokens int) (*JobserverClient, string, error) {
+	return nil, "", errors.New("jobserver is not supported on Windows")
+}
+
+func (this *JobserverClient) TryReadToken() (byte, bool) {
+	return 0, false
+}
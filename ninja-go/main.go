@@ -5,6 +5,7 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"slices"
 	"syscall"
 )
 
@@ -28,13 +29,24 @@ func real_main(args []string) error {
 
 	// setvbuf(stdout, NULL, _IOLBF, BUFSIZ)
 	ninja_command := args[0]
+	// What to forward to a daemon, before ReadFlags consumes it.
+	argv := slices.Clone(args[1:])
 
 	exit_code := ReadFlags(&args, &options, config)
 	if exit_code >= 0 {
 		os.Exit(exit_code)
 	}
 
-	status := Statusfactory(config)
+	// Close the --events stream, which os.Exit() would leave unflushed, and
+	// remove the jobserver any command runner may have created.
+	var status Status = nil
+	exit := func(code int) {
+		if status != nil {
+			status.ReleaseStatus()
+		}
+		CloseJobserver()
+		os.Exit(code)
+	}
 
 	if options.WorkingDir != "" {
 		// The formatting of this string, complete with funny quotes, is
@@ -43,7 +55,7 @@ func real_main(args []string) error {
 		// Don't print this if a tool is being used, so that tool output
 		// can be piped into a file without this string showing up.
 		if options.Tool == nil && config.Verbosity != NO_STATUS_UPDATE {
-			status.Info("Entering directory `%s'", options.WorkingDir)
+			NewStatusPrinter(config).Info("Entering directory `%s'", options.WorkingDir)
 		}
 
 		if err := os.Chdir(options.WorkingDir); err != nil {
@@ -51,11 +63,26 @@ func real_main(args []string) error {
 		}
 	}
 
+	if options.Daemon {
+		exit(DaemonMain(ninja_command, &options, config))
+	}
+	if options.Tool == nil {
+		// Before opening --events: the daemon opens it for the build.
+		if exit_code, ok := ForwardToDaemon(&options, argv); ok {
+			exit(exit_code)
+		}
+	}
+
+	status, err := Statusfactory(config)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
 	if options.Tool != nil && options.Tool.When == RUN_AFTER_FLAGS {
 		// None of the RUN_AFTER_FLAGS actually use a NinjaMain, but it's needed
 		// by other tools.
-		// ninja := NewNinjaMain(ninja_command, &config)
-		os.Exit(options.Tool.Func1(&options, &args))
+		ninja := NewNinjaMain(ninja_command, options.WorkingDir, config)
+		exit(options.Tool.Func1(ninja, &options, &args))
 	}
 
 	// Limit number of rebuilds, to prevent infinite loops.
@@ -67,27 +94,29 @@ func real_main(args []string) error {
 		if options.PhonyCycleShouldErr {
 			parser_opts.PhonyCycleAction = KPhonyCycleActionError
 		}
+		parser_opts.PoolDepths = options.PoolDepths
 		parser := NewManifestParser(ninjaMain.State_, ninjaMain.DiskInterface, parser_opts)
 		var err string
 		if !parser.Load(options.InputFile, &err, nil) {
 			status.Error("%s", err)
-			os.Exit(1)
+			exit(1)
 		}
 
 		if options.Tool != nil && options.Tool.When == RUN_AFTER_LOAD {
-			os.Exit(options.Tool.Func1(&options, &args))
+			exit(options.Tool.Func1(ninjaMain, &options, &args))
 		}
 
 		if !ninjaMain.EnsureBuildDirExists() {
-			os.Exit(1)
+			exit(1)
 		}
 
-		if !ninjaMain.OpenBuildLog(false) || !ninjaMain.OpenDepsLog(false) {
-			os.Exit(1)
+		if !ninjaMain.OpenBuildLog(false) || !ninjaMain.OpenDepsLog(false) ||
+			!ninjaMain.OpenHashCache() {
+			exit(1)
 		}
 
 		if options.Tool != nil && options.Tool.When == RUN_AFTER_LOGS {
-			os.Exit(options.Tool.Func1(&options, &args))
+			exit(options.Tool.Func1(ninjaMain, &options, &args))
 		}
 
 		// Attempt to rebuild the manifest before building anything else
@@ -95,30 +124,41 @@ func real_main(args []string) error {
 			// In dry_run mode the regeneration will succeed without changing the
 			// manifest forever. Better to return immediately.
 			if config.DryRun {
-				os.Exit(0)
+				exit(0)
 			}
 			// Start the build over with the new manifest.
+			ninjaMain.CloseHashCache()
 			continue
 		} else if err != "" {
 			status.Error("rebuilding '%s': %s", options.InputFile, err)
-			os.Exit(1)
+			exit(1)
 		}
 
 		ninjaMain.ParsePreviousElapsedTimes()
 
 		result := ninjaMain.RunBuild(&args, status)
+		ninjaMain.CloseHashCache()
 		if GMetrics != nil {
 			ninjaMain.DumpMetrics()
 		}
-		os.Exit(result)
+		if GTracer != nil {
+			GTracer.Write()
+		}
+		exit(result)
 	}
 
 	status.Error("manifest '%s' still dirty after %d tries, perhaps system time is not set", options.InputFile, kCycleLimit)
-	os.Exit(1)
+	exit(1)
 	return nil
 }
 
 func main() {
+	if os.Args[0] == kSandboxArgv0 && len(os.Args) == 2 {
+		os.Exit(SandboxMain(os.Args[1]))
+	}
+	if os.Args[0] == kTraceArgv0 && len(os.Args) == 3 {
+		os.Exit(TraceMain(os.Args[1], os.Args[2]))
+	}
 	go TerminateHandler()
 	err := real_main(os.Args)
 	if err != nil {
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"slices"
 	"strconv"
 )
@@ -14,6 +15,9 @@ const (
 
 type ManifestParserOptions struct {
 	PhonyCycleAction PhonyCycleAction
+	/// Depths overriding those of the manifest's pools, or defining pools
+	/// the manifest doesn't, by pool name.
+	PoolDepths map[string]int
 }
 
 func NewManifestParserOptions() *ManifestParserOptions {
@@ -124,6 +128,21 @@ func (this *ManifestParser) Parse(filename, input string, err *string) bool {
 	return false // not reached
 }
 
+// / Look up a pool by name.  Pools that only exist as overrides are created
+// / when first used.
+func (this *ManifestParser) LookupPool(name string) *Pool {
+	if pool := this.state_.LookupPool(name); pool != nil {
+		return pool
+	}
+	depth, ok := this.options_.PoolDepths[name]
+	if !ok {
+		return nil
+	}
+	pool := NewPool(name, depth)
+	this.state_.AddPool(pool)
+	return pool
+}
+
 // / Parse various statement types.
 func (this *ManifestParser) ParsePool(err *string) bool {
 	name := ""
@@ -162,6 +181,9 @@ func (this *ManifestParser) ParsePool(err *string) bool {
 	if depth < 0 {
 		return this.lexer_.Error("expected 'depth =' line", err)
 	}
+	if override, ok := this.options_.PoolDepths[name]; ok {
+		depth = override
+	}
 
 	this.state_.AddPool(NewPool(name, depth))
 	return true
@@ -379,13 +401,51 @@ func (this *ManifestParser) ParseEdge(err *string) bool {
 
 	pool_name := edge.GetBinding("pool")
 	if pool_name != "" {
-		pool := this.state_.LookupPool(pool_name)
+		pool := this.LookupPool(pool_name)
 		if pool == nil {
 			return this.lexer_.Error("unknown pool name '"+pool_name+"'", err)
 		}
 		edge.pool_ = pool
 	}
 
+	if weight := edge.GetBinding("pool_weight"); weight != "" {
+		n, err1 := strconv.Atoi(weight)
+		if err1 != nil || n < 1 {
+			return this.lexer_.Error("invalid pool_weight '"+weight+"'", err)
+		}
+		edge.weight_ = n
+	}
+	if edge.pool_.depth() != 0 && edge.weight() > edge.pool_.depth() {
+		return this.lexer_.Error(fmt.Sprintf("pool_weight %d exceeds the depth %d of pool '%s'",
+			edge.weight(), edge.pool_.depth(), edge.pool_.name()), err)
+	}
+
+	if timeout := edge.GetBinding("timeout"); timeout != "" {
+		if _, err1 := ParseTimeout(timeout); err1 != nil {
+			return this.lexer_.Error("invalid timeout '"+timeout+"'", err)
+		}
+	}
+	if retries := edge.GetBinding("retries"); retries != "" {
+		if n, err1 := strconv.Atoi(retries); err1 != nil || n < 0 {
+			return this.lexer_.Error("invalid retries '"+retries+"'", err)
+		}
+	}
+	if codes := edge.GetBinding("retry_on_exit_codes"); codes != "" {
+		if _, err1 := ParseExitCodes(codes); err1 != nil {
+			return this.lexer_.Error("invalid retry_on_exit_codes '"+codes+"'", err)
+		}
+	}
+	if memory := edge.GetBinding("memory"); memory != "" {
+		if _, err1 := ParseMemorySize(memory); err1 != nil {
+			return this.lexer_.Error("invalid memory '"+memory+"'", err)
+		}
+	}
+	if mode := edge.GetBinding("hash"); mode != "" {
+		if _, err1 := ParseHashMode(mode); err1 != nil {
+			return this.lexer_.Error("invalid hash '"+mode+"', expected content, mtime or both", err)
+		}
+	}
+
 	//edge.outputs_.reserve(len(this.outs_))
 	for i := 0; i < len(this.outs_); i++ {
 		path := this.outs_[i].Evaluate(env)
@@ -541,6 +601,7 @@ func (this *ManifestParser) Load(filename string, err *string, parent *Lexer) bo
 	// Parser::Load() in our call stack. Do not start a new one here to avoid
 	// over-counting parsing times.
 	METRIC_RECORD_IF(".ninja parse", parent == nil)
+	defer TraceSpan(kTraceMain, "parse "+filename, "manifest")()
 	contents := ""
 	read_err := ""
 	if this.file_reader_.ReadFile(filename, &contents, &read_err) != Okay {
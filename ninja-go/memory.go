@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// / Parse a memory size such as "4G", "512M", "1.5GiB" or a plain number of
+// / bytes.  Suffixes are binary: K is 1024 bytes.
+func ParseMemorySize(value string) (int64, error) {
+	s := strings.TrimSpace(value)
+	s = strings.TrimSuffix(strings.TrimSuffix(s, "B"), "i")
+	unit := int64(1)
+	if s != "" {
+		switch strings.ToUpper(s[len(s)-1:]) {
+		case "K":
+			unit = 1 << 10
+		case "M":
+			unit = 1 << 20
+		case "G":
+			unit = 1 << 30
+		case "T":
+			unit = 1 << 40
+		}
+		if unit != 1 {
+			s = s[:len(s)-1]
+		}
+	}
+	size, err := strconv.ParseFloat(s, 64)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("invalid memory size '%s'", value)
+	}
+	return int64(size * float64(unit)), nil
+}
+
+// / AvailableMemory returns how many bytes the jobs we start may still
+// / allocate: the smaller of what the system reports as available and the
+// / headroom left below the memory limit of our cgroup, if any.  Returns -1
+// / if this can't be determined.
+func AvailableMemory() int64 {
+	available := SystemAvailableMemory()
+	if headroom := CgroupMemoryHeadroom(); headroom >= 0 && (available < 0 || headroom < available) {
+		available = headroom
+	}
+	return available
+}
@@ -0,0 +1,85 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// / MemAvailable from /proc/meminfo, in bytes, or -1.
+func SystemAvailableMemory() int64 {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return -1
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// MemAvailable:   12345678 kB
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != "MemAvailable:" {
+			continue
+		}
+		kb, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return -1
+		}
+		return kb << 10
+	}
+	return -1
+}
+
+// / The smallest memory.max - memory.current of our cgroup v2 and its
+// / ancestors, or -1 if none of them has a limit.
+func CgroupMemoryHeadroom() int64 {
+	data, err := os.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return -1
+	}
+	path := ""
+	for _, line := range strings.Split(string(data), "\n") {
+		// The unified hierarchy is the "0::/path" entry.
+		if p, ok := strings.CutPrefix(line, "0::"); ok {
+			path = p
+			break
+		}
+	}
+	if path == "" {
+		return -1
+	}
+
+	headroom := int64(-1)
+	for dir := filepath.Join("/sys/fs/cgroup", path); strings.HasPrefix(dir, "/sys/fs/cgroup/"); dir = filepath.Dir(dir) {
+		limit, ok1 := readCgroupValue(filepath.Join(dir, "memory.max"))
+		current, ok2 := readCgroupValue(filepath.Join(dir, "memory.current"))
+		if !ok1 || !ok2 {
+			continue
+		}
+		left := limit - current
+		if left < 0 {
+			left = 0
+		}
+		if headroom < 0 || left < headroom {
+			headroom = left
+		}
+	}
+	return headroom
+}
+
+// / Read a cgroup file holding a number of bytes; "max" means no limit and
+// / is reported as not ok, like a missing file.
+func readCgroupValue(path string) (int64, bool) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, false
+	}
+	value, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return value, true
+}
@@ -0,0 +1,37 @@
+//go:build windows
+
+package main
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+type memoryStatusEx struct {
+	dwLength                uint32
+	dwMemoryLoad            uint32
+	ullTotalPhys            uint64
+	ullAvailPhys            uint64
+	ullTotalPageFile        uint64
+	ullAvailPageFile        uint64
+	ullTotalVirtual         uint64
+	ullAvailVirtual         uint64
+	ullAvailExtendedVirtual uint64
+}
+
+var procGlobalMemoryStatusEx = syscall.NewLazyDLL("kernel32.dll").NewProc("GlobalMemoryStatusEx")
+
+// / Available physical memory, in bytes, or -1.
+func SystemAvailableMemory() int64 {
+	status := memoryStatusEx{}
+	status.dwLength = uint32(unsafe.Sizeof(status))
+	if r, _, _ := procGlobalMemoryStatusEx.Call(uintptr(unsafe.Pointer(&status))); r == 0 {
+		return -1
+	}
+	return int64(status.ullAvailPhys)
+}
+
+// / There are no cgroups on Windows.
+func CgroupMemoryHeadroom() int64 {
+	return -1
+}
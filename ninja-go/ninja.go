@@ -24,6 +24,12 @@ type Options struct {
 
 	/// Whether phony cycles should warn or print an error.
 	PhonyCycleShouldErr bool
+
+	/// Pool depths set by NINJA_POOLS and --pool, by pool name.
+	PoolDepths map[string]int
+
+	/// Whether to serve builds as a daemon rather than build.
+	Daemon bool
 }
 
 type When int8
@@ -41,7 +47,7 @@ const (
 )
 
 // / The type of functions that are the entry points to tools (subcommands).
-type ToolFunc func(*Options, *[]string) int
+type ToolFunc func(*NinjaMain, *Options, *[]string) int
 
 // / Subtools, accessible via "-t foo".
 type Tool struct {
@@ -76,8 +82,9 @@ type NinjaMain struct {
 	/// The build directory, used for storing the build log etc.
 	BuildDir string
 
-	BuildLog *BuildLog
-	DepsLog  *DepsLog
+	BuildLog  *BuildLog
+	DepsLog   *DepsLog
+	HashCache *HashCache
 
 	PrefixDir string
 
@@ -92,6 +99,7 @@ func NewNinjaMain(ninja_command, prefixDir string, config *BuildConfig) *NinjaMa
 	ret.State_ = NewState()
 	ret.BuildLog = NewBuildLog(config, prefixDir)
 	ret.DepsLog = NewDepsLog()
+	ret.HashCache = NewHashCache()
 	ret.PrefixDir = prefixDir
 	ret.DiskInterface = NewRealDiskInterface(prefixDir)
 	return &ret
@@ -249,6 +257,34 @@ func (this *NinjaMain) OpenDepsLog(recompact_only bool) bool {
 	return true
 }
 
+// / Load the file hash cache and make it the one used for hashing inputs.
+// / A cache that cannot be read is only a warning; files are hashed again.
+func (this *NinjaMain) OpenHashCache() bool {
+	path := ".ninja_hashes"
+	if this.BuildDir != "" {
+		path = this.BuildDir + "/" + path
+	}
+
+	err := ""
+	if this.HashCache.Load(path, &err) == LOAD_ERROR {
+		Warning("loading hash cache %s: %s", path, err)
+	}
+	GHashCache = this.HashCache
+	GHashService = NewHashService(this.Config_.HashParallelism)
+	return true
+}
+
+// / Write the file hash cache back to the build dir.
+func (this *NinjaMain) CloseHashCache() {
+	if this.Config_.DryRun {
+		return
+	}
+	err := ""
+	if !this.HashCache.Save(&err) {
+		Warning("writing hash cache: %s", err)
+	}
+}
+
 // / Rebuild the build manifest, if necessary.
 // / Returns true if the manifest was rebuilt.
 func (this *NinjaMain) RebuildManifest(input_file string, err *string, status Status) bool {
@@ -295,7 +331,7 @@ func (this *NinjaMain) ParsePreviousElapsedTimes() {
 		//currentMtime, _, _ := NodesHash(edge.inputs_, this.PrefixDir)
 		for _, out := range edge.outputs_ {
 			//currentHash := HashCommand(command)
-			log_entry := this.BuildLog.LookupByOutput(this.Config_, out.path(), 0, 0)
+			log_entry := this.BuildLog.LookupByOutput(this.Config_, nil, out.path(), 0, 0)
 			if log_entry == nil {
 				continue // Maybe we'll have log entry for next output of this edge?
 			}
@@ -427,29 +463,73 @@ func (this *DeferGuessParallelism) Refresh() {
 func (this *DeferGuessParallelism) ReleaseDeferGuessParallelism() { this.Refresh() }
 
 const (
-	OPT_VERSION = 1
-	OPT_QUIET   = 2
+	OPT_VERSION     = 1
+	OPT_QUIET       = 2
+	OPT_HASH_JOBS   = 3
+	OPT_JOB_TIMEOUT = 4
+	OPT_JOBSERVER   = 5
+	OPT_POOL        = 6
+	OPT_SANDBOX     = 7
+	OPT_TRACE       = 8
+	OPT_HASH        = 9
+	OPT_DAEMON      = 10
+	OPT_EVENTS      = 11
+	OPT_REMOTE_JOBS = 12
 )
 
+// / Parse a pool depth override of the form NAME=DEPTH into |depths|.
+func ParsePoolOverride(value string, depths map[string]int) error {
+	name, depth_string, ok := strings.Cut(value, "=")
+	if !ok || name == "" {
+		return fmt.Errorf("expected NAME=DEPTH, got '%s'", value)
+	}
+	if name == kConsolePool.name() {
+		return fmt.Errorf("the depth of the console pool can't be changed")
+	}
+	depth, err := strconv.Atoi(depth_string)
+	if err != nil || depth < 0 {
+		return fmt.Errorf("invalid depth for pool '%s': '%s'", name, depth_string)
+	}
+	depths[name] = depth
+	return nil
+}
+
 // / Parse argv for command-line options.
 // / Returns an exit code, or -1 if Ninja should continue.
 func ReadFlags(args *[]string, options *Options, config *BuildConfig) int {
 	deferGuessParallelism := NewDeferGuessParallelism(config)
 	defer deferGuessParallelism.ReleaseDeferGuessParallelism()
-	//kLongOptions  :=  []option{
-	//  { "help", no_argument, nil, 'h' },
-	//  { "version", no_argument, nil, OPT_VERSION },
-	//  { "verbose", no_argument, nil, 'v' },
-	//  { "quiet", no_argument, nil, OPT_QUIET },
-	//  { "", 0, nil, 0 },
-	//}
+	kLongOptions := []option{
+		{"help", no_argument, nil, 'h'},
+		{"version", no_argument, nil, OPT_VERSION},
+		{"verbose", no_argument, nil, 'v'},
+		{"quiet", no_argument, nil, OPT_QUIET},
+		{"hash-jobs", required_argument, nil, OPT_HASH_JOBS},
+		{"job-timeout", required_argument, nil, OPT_JOB_TIMEOUT},
+		{"jobserver", no_argument, nil, OPT_JOBSERVER},
+		{"pool", required_argument, nil, OPT_POOL},
+		{"sandbox", no_argument, nil, OPT_SANDBOX},
+		{"trace-access", no_argument, nil, OPT_TRACE},
+		{"hash", required_argument, nil, OPT_HASH},
+		{"daemon", no_argument, nil, OPT_DAEMON},
+		{"events", required_argument, nil, OPT_EVENTS},
+		{"remote-jobs", required_argument, nil, OPT_REMOTE_JOBS},
+	}
+
+	// NINJA_POOLS holds overrides separated by commas or spaces; --pool
+	// flags take precedence over it.
+	options.PoolDepths = make(map[string]int)
+	for _, value := range strings.FieldsFunc(os.Getenv("NINJA_POOLS"), func(r rune) bool { return r == ',' || r == ' ' }) {
+		if err := ParsePoolOverride(value, options.PoolDepths); err != nil {
+			log.Fatalln("invalid NINJA_POOLS: " + err.Error())
+		}
+	}
 
-	opts, optind, err := getopt.Getopts(*args, "d:f:j:k:l:nt:vw:C:h:r:R")
+	opts, optind, err := GetoptLong(*args, "d:f:j:k:l:m:nt:vw:C:h:r:R", kLongOptions, "t")
 	if err != nil {
 		log.Fatalln(err)
 	}
 	*args = (*args)[optind:]
-	//for options.tool==nil && (opt = getopt_long(os.Args, "d:f:j:k:l:nt:vw:C:h", kLongOptions, nil)) != -1 {
 	for _, optV := range opts {
 		opt := optV.Option
 		optarg := optV.Value
@@ -504,6 +584,14 @@ func ReadFlags(args *[]string, options *Options, config *BuildConfig) int {
 				}
 				config.MaxLoadAverage = value
 			}
+		case 'm':
+			{
+				value, err := ParseMemorySize(optV.Value)
+				if err != nil {
+					log.Fatalln("-m parameter not a memory size: did you mean -m 2G?")
+				}
+				config.MinAvailableMemory = value
+			}
 		case 'n':
 			config.DryRun = true
 		case 't':
@@ -521,8 +609,55 @@ func ReadFlags(args *[]string, options *Options, config *BuildConfig) int {
 			}
 		case 'C':
 			options.WorkingDir = optarg
+		case OPT_REMOTE_JOBS:
+			{
+				value, err := strconv.Atoi(optV.Value)
+				if err != nil || value < 0 {
+					log.Fatalln("invalid --remote-jobs parameter")
+				}
+				config.RemoteJobs = value
+			}
+		case OPT_HASH_JOBS:
+			{
+				value, err := strconv.Atoi(optV.Value)
+				if err != nil || value <= 0 {
+					log.Fatalln("invalid --hash-jobs parameter")
+				}
+				config.HashParallelism = value
+			}
+		case OPT_JOB_TIMEOUT:
+			{
+				value, err := ParseTimeout(optV.Value)
+				if err != nil {
+					log.Fatalln("invalid --job-timeout parameter, expected e.g. 90s or 10m")
+				}
+				config.JobTimeout = value
+			}
+		case OPT_JOBSERVER:
+			config.Jobserver = true
+		case OPT_SANDBOX:
+			config.Sandbox = true
+		case OPT_TRACE:
+			config.TraceAccess = true
+		case OPT_HASH:
+			{
+				value, err := ParseHashMode(optV.Value)
+				if err != nil {
+					log.Fatalln("invalid --hash parameter, expected content, mtime or both")
+				}
+				config.HashMode = value
+			}
+		case OPT_DAEMON:
+			options.Daemon = true
+		case OPT_EVENTS:
+			config.EventsPath = optV.Value
+		case OPT_POOL:
+			if err := ParsePoolOverride(optV.Value, options.PoolDepths); err != nil {
+				log.Fatalln("invalid --pool parameter: " + err.Error())
+			}
 		case OPT_VERSION:
 			fmt.Printf("%s\n", kNinjaVersion)
+			return 0
 		default: // case 'h':
 			deferGuessParallelism.Refresh()
 			UsageMain(config)
@@ -550,13 +685,38 @@ func UsageMain(config *BuildConfig) {
 			"  -j N     run N jobs in parallel (0 means infinity) [default=%d on this system]\n"+
 			"  -k N     keep going until N jobs fail (0 means infinity) [default=1]\n"+
 			"  -l N     do not start new jobs if the load average is greater than N\n"+
+			"  -m SIZE  do not start new jobs if less than SIZE of memory (e.g. 2G) is\n"+
+			"           available, beyond what the edges' memory bindings ask for\n"+
 			"  -n       dry run (don't run commands but act like they succeeded)\n"+
+			"  --hash-jobs N  hash up to N input files in parallel [default=%d on this system]\n"+
+			"  --hash MODE    tell changed inputs by their content, mtime or both (hashing\n"+
+			"                 only when the mtimes moved), unless the edge sets a hash\n"+
+			"                 binding [default=content]\n"+
+			"  --job-timeout T  terminate commands running longer than T (e.g. 10m), unless\n"+
+			"                 their edge sets a timeout binding [default=none]\n"+
+			"  --jobserver    share the -j budget with sub-makes through a GNU make jobserver\n"+
+			"                 (a jobserver announced in MAKEFLAGS is always honoured)\n"+
+			"  --pool NAME=DEPTH  set the depth of pool NAME, creating it if the manifest\n"+
+			"                 doesn't; may be repeated, and NINJA_POOLS may hold a list\n"+
+			"  --sandbox      run commands in a sandbox that only shows their declared\n"+
+			"                 inputs and outputs of the build tree (Linux only)\n"+
+			"  --trace-access trace the files commands access and warn about those their\n"+
+			"                 edges don't declare (Linux only)\n"+
+			"  --daemon       keep the graph in memory and serve builds of this manifest to\n"+
+			"                 later invocations, which forward to it (Linux only)\n"+
+			"  --events=PATH  write build events as newline-delimited JSON to PATH, a file\n"+
+			"                 or a Unix socket\n"+
+			"\n"+
+			"  -r URL   use the remote cache at URL: http:// for a ninja-rbe, grpc:// or\n"+
+			"           grpcs:// for a Bazel Remote Execution API v2 cache\n"+
+			"  --remote-jobs N  also run up to N commands at once on the workers of the\n"+
+			"                 ninja-rbe -r names, on top of the -j local ones [default=0]\n"+
 			"\n"+
 			"  -d MODE  enable debugging (use '-d list' to list modes)\n"+
 			"  -t TOOL  run a subtool (use '-t list' to list subtools)\n"+
 			"    terminates toplevel options; further flags are passed to the tool\n"+
 			"  -w FLAG  adjust warnings (use '-w list' to list warnings)\n",
-		kNinjaVersion, config.Parallelism)
+		kNinjaVersion, config.Parallelism, config.HashParallelism)
 }
 
 func (this *NinjaMain) ToolBrowse(options *Options, args *[]string) int {
@@ -1001,6 +1161,68 @@ func PrintCompdb(directory string, edges []*Edge, eval_mode EvaluateCommandMode)
 	fmt.Print("\n]")
 }
 
+func (this *NinjaMain) ToolTrace(options *Options, args *[]string) int {
+	// getopt expects argv[0] to contain the name of the tool, i.e. "trace",
+	// which ReadFlags consumed.
+	argv := append([]string{"trace"}, *args...)
+	opts, optind, err := getopt.Getopts(argv, "h")
+	if err != nil {
+		log.Fatalln(err)
+	}
+	*args = argv[optind:]
+	for _, optV := range opts {
+		switch optV.Option {
+		default: // case 'h':
+			fmt.Printf("usage: ninja -t trace [FILE]\n" +
+				"writes the trace to FILE, or to stdout\n")
+			return 1
+		}
+	}
+	if len(*args) > 1 {
+		fmt.Printf("usage: ninja -t trace [FILE]\n")
+		return 1
+	}
+
+	log_path := ".ninja_log"
+	if build_dir := this.State_.bindings_.LookupVariable("builddir"); build_dir != "" {
+		log_path = build_dir + "/" + log_path
+	}
+	tracer, err := TraceFromBuildLog(log_path, this.State_)
+	if err != nil {
+		Error("%v", err)
+		return 1
+	}
+	if len(*args) == 0 {
+		if err := tracer.WriteJSON(os.Stdout); err != nil {
+			Error("%v", err)
+			return 1
+		}
+		return 0
+	}
+	tracer.path_ = (*args)[0]
+	tracer.Write()
+	return 0
+}
+
+func (this *NinjaMain) ToolWatch(options *Options, args *[]string) int {
+	// getopt expects argv[0] to contain the name of the tool, i.e. "watch",
+	// which ReadFlags consumed.
+	argv := append([]string{"watch"}, *args...)
+	opts, optind, err := getopt.Getopts(argv, "h")
+	if err != nil {
+		log.Fatalln(err)
+	}
+	*args = argv[optind:]
+	for _, optV := range opts {
+		switch optV.Option {
+		default: // case 'h':
+			fmt.Printf("usage: ninja -t watch [targets]\n")
+			return 1
+		}
+	}
+	return WatchMain(this.NinjaCommand, options, this.Config_, *args)
+}
+
 func (this *NinjaMain) ToolUrtle(options *Options, args *[]string) int {
 	// RLE encoded.
 	urtle :=
@@ -1443,6 +1665,32 @@ func (this *NinjaMain) IsPathDead(s string) bool {
 	return notExist
 }
 
+func (this *NinjaMain) ToolPools(options *Options, args *[]string) int {
+	// Include overrides for pools no edge uses, which exist nowhere else.
+	depths := map[string]int{}
+	for name, depth := range options.PoolDepths {
+		depths[name] = depth
+	}
+	for name, pool := range this.State_.pools_ {
+		if pool != kDefaultPool {
+			depths[name] = pool.depth()
+		}
+	}
+	names := []string{}
+	for name := range depths {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Printf("%s %d", name, depths[name])
+		if _, ok := options.PoolDepths[name]; ok {
+			fmt.Printf(" (overridden)")
+		}
+		fmt.Printf("\n")
+	}
+	return 0
+}
+
 func (this *NinjaMain) ToolRules(options *Options, args *[]string) int {
 	// Parse options.
 
@@ -1492,47 +1740,52 @@ func (this *NinjaMain) ToolRules(options *Options, args *[]string) int {
 }
 
 func ChooseTool(tool_name string) *Tool {
-	this := &NinjaMain{}
 	kTools := []Tool{
 		{"browse", "browse dependency graph in a web browser",
-			RUN_AFTER_LOAD, this.ToolBrowse},
+			RUN_AFTER_LOAD, (*NinjaMain).ToolBrowse},
 		{"msvc", "build helper for MSVC cl.exe (DEPRECATED)",
-			RUN_AFTER_FLAGS, this.ToolMSVC},
+			RUN_AFTER_FLAGS, (*NinjaMain).ToolMSVC},
 		{"clean", "clean built files",
-			RUN_AFTER_LOAD, this.ToolClean},
+			RUN_AFTER_LOAD, (*NinjaMain).ToolClean},
 		{"commands", "list all commands required to rebuild given targets",
-			RUN_AFTER_LOAD, this.ToolCommands},
+			RUN_AFTER_LOAD, (*NinjaMain).ToolCommands},
 		{"inputs", "list all inputs required to rebuild given targets",
-			RUN_AFTER_LOAD, this.ToolInputs},
+			RUN_AFTER_LOAD, (*NinjaMain).ToolInputs},
 		{"multi-inputs", "print one or more sets of inputs required to build targets",
-			RUN_AFTER_LOAD, this.ToolMultiInputs},
+			RUN_AFTER_LOAD, (*NinjaMain).ToolMultiInputs},
 		{"deps", "show dependencies stored in the deps log",
-			RUN_AFTER_LOGS, this.ToolDeps},
+			RUN_AFTER_LOGS, (*NinjaMain).ToolDeps},
 		{"missingdeps", "check deps log dependencies on generated files",
-			RUN_AFTER_LOGS, this.ToolMissingDeps},
+			RUN_AFTER_LOGS, (*NinjaMain).ToolMissingDeps},
 		{"graph", "output graphviz dot file for targets",
-			RUN_AFTER_LOAD, this.ToolGraph},
+			RUN_AFTER_LOAD, (*NinjaMain).ToolGraph},
 		{"query", "show inputs/outputs for a path",
-			RUN_AFTER_LOGS, this.ToolQuery},
+			RUN_AFTER_LOGS, (*NinjaMain).ToolQuery},
 		{"targets", "list targets by their rule or depth in the DAG",
-			RUN_AFTER_LOAD, this.ToolTargets},
+			RUN_AFTER_LOAD, (*NinjaMain).ToolTargets},
 		{"compdb", "dump JSON compilation database to stdout",
-			RUN_AFTER_LOAD, this.ToolCompilationDatabase},
+			RUN_AFTER_LOAD, (*NinjaMain).ToolCompilationDatabase},
 		{"compdb-targets",
 			"dump JSON compilation database for a given list of targets to stdout",
-			RUN_AFTER_LOAD, this.ToolCompilationDatabaseForTargets},
+			RUN_AFTER_LOAD, (*NinjaMain).ToolCompilationDatabaseForTargets},
 		{"recompact", "recompacts ninja-internal data structures",
-			RUN_AFTER_LOAD, this.ToolRecompact},
+			RUN_AFTER_LOAD, (*NinjaMain).ToolRecompact},
 		{"restat", "restats all outputs in the build log",
-			RUN_AFTER_FLAGS, this.ToolRestat},
+			RUN_AFTER_FLAGS, (*NinjaMain).ToolRestat},
+		{"pools", "list all pools with their effective depths",
+			RUN_AFTER_LOAD, (*NinjaMain).ToolPools},
 		{"rules", "list all rules",
-			RUN_AFTER_LOAD, this.ToolRules},
+			RUN_AFTER_LOAD, (*NinjaMain).ToolRules},
 		{"cleandead", "clean built files that are no longer produced by the manifest",
-			RUN_AFTER_LOGS, this.ToolCleanDead},
+			RUN_AFTER_LOGS, (*NinjaMain).ToolCleanDead},
+		{"trace", "write a Chrome trace of the last build in the log",
+			RUN_AFTER_LOAD, (*NinjaMain).ToolTrace},
+		{"watch", "build the given targets and again whenever their sources change",
+			RUN_AFTER_FLAGS, (*NinjaMain).ToolWatch},
 		{"urtle", "",
-			RUN_AFTER_FLAGS, this.ToolUrtle},
+			RUN_AFTER_FLAGS, (*NinjaMain).ToolUrtle},
 		{"wincodepage", "print the Windows code page used by ninja",
-			RUN_AFTER_FLAGS, this.ToolWinCodePage},
+			RUN_AFTER_FLAGS, (*NinjaMain).ToolWinCodePage},
 		{"", "", RUN_AFTER_FLAGS, nil},
 	}
 
@@ -1575,6 +1828,8 @@ func DebugEnable(name string) bool {
 			"  keepdepfile  don't delete depfiles after they're read by ninja\n" +
 			"  keeprsp      don't delete @response files on success\n" +
 			"  nostatcache  don't batch stat() calls per directory and cache them\n" +
+			"  trace=FILE   write a Chrome trace of the build to FILE, for chrome://tracing\n" +
+			"               or Perfetto\n" +
 			"multiple modes can be enabled via -d FOO -d BAR\n")
 		return false
 	} else if name == "stats" {
@@ -1592,8 +1847,11 @@ func DebugEnable(name string) bool {
 	} else if name == "nostatcache" {
 		g_experimental_statcache = false
 		return true
+	} else if path, ok := strings.CutPrefix(name, "trace="); ok && path != "" {
+		GTracer = NewTracer(path)
+		return true
 	} else {
-		suggestion := SpellcheckString(name, "stats", "explain", "keepdepfile", "keeprsp", "nostatcache", "\000")
+		suggestion := SpellcheckString(name, "stats", "explain", "keepdepfile", "keeprsp", "nostatcache", "trace=", "\000")
 		if suggestion != "" {
 			Error("unknown debug setting '%s', did you mean '%s'?", name, suggestion)
 		} else {
@@ -1,16 +1,33 @@
 package main
 
+import (
+	"math"
+	"os"
+)
+
 type RealCommandRunner struct {
 	CommandRunner
 	config_          *BuildConfig
-	subprocs_        SubprocessSet
+	subprocs_        *SubprocessSet
 	subproc_to_edge_ map[*Subprocess]*Edge
+	/// The GNU make jobserver we share our -j budget with, if any.
+	jobserver_ *JobserverClient
+	/// The memory promised to the running commands by their "memory"
+	/// bindings.  It stays reserved until they finish, even once they have
+	/// allocated it, so we err on the side of starting too few jobs.
+	memory_reserved_ int64
+	/// AvailableMemory() as read once per scheduling pass, that is until a
+	/// command finishes; valid if memory_sampled_.
+	memory_available_ int64
+	memory_sampled_   bool
 }
 
 func NewRealCommandRunner(config *BuildConfig) *RealCommandRunner {
 	ret := RealCommandRunner{}
 	ret.config_ = config
+	ret.subprocs_ = NewSubprocessSet()
 	ret.subproc_to_edge_ = make(map[*Subprocess]*Edge)
+	ret.jobserver_ = SetupJobserver(config)
 	return &ret
 }
 func (this *RealCommandRunner) CanRunMore() int64 {
@@ -25,10 +42,33 @@ func (this *RealCommandRunner) CanRunMore() int64 {
 		}
 	}
 
+	if this.config_.MinAvailableMemory > 0 {
+		// Commands with a "memory" binding are checked by CanRunEdge();
+		// the others are assumed to need little beyond the -m minimum.
+		if available := this.AvailableMemory(); available >= 0 && available < this.config_.MinAvailableMemory {
+			capacity = 0
+		}
+	}
+
 	if capacity < 0 {
 		capacity = 0
 	}
 
+	if this.jobserver_ != nil && capacity > 0 {
+		// Each job beyond the first needs a token.  Take as many as we could
+		// use now; any left unused go back when the next job finishes.
+		free := 1 + this.jobserver_.Tokens() - subproc_number
+		for float64(free) < capacity && this.jobserver_.Acquire() {
+			free++
+		}
+		if free < 0 {
+			free = 0
+		}
+		if float64(free) < capacity {
+			capacity = float64(free)
+		}
+	}
+
 	if capacity == 0 && len(this.subprocs_.running_) == 0 {
 		// Ensure that we make progress.
 		capacity = 1
@@ -37,13 +77,71 @@ func (this *RealCommandRunner) CanRunMore() int64 {
 	return int64(capacity)
 }
 
+// / AvailableMemory(), read again only once a command finished, so that
+// / checking each edge FindWork() returns doesn't reread /proc and the
+// / cgroup files; the commands started meanwhile are in memory_reserved_.
+func (this *RealCommandRunner) AvailableMemory() int64 {
+	if !this.memory_sampled_ {
+		this.memory_available_ = AvailableMemory()
+		this.memory_sampled_ = true
+	}
+	return this.memory_available_
+}
+
+// / Read the available memory again on the next scheduling pass.
+func (this *RealCommandRunner) ResampleMemory() {
+	this.memory_sampled_ = false
+}
+
+// / The memory left for new commands beyond the -m minimum, or
+// / math.MaxInt64 if we don't track memory.
+func (this *RealCommandRunner) MemoryHeadroom() int64 {
+	if this.config_.MinAvailableMemory <= 0 && this.memory_reserved_ == 0 {
+		return math.MaxInt64
+	}
+	available := this.AvailableMemory()
+	if available < 0 {
+		return math.MaxInt64
+	}
+	return available - this.memory_reserved_ - this.config_.MinAvailableMemory
+}
+
+func (this *RealCommandRunner) CanRunEdge(edge *Edge) bool {
+	memory := edge.GetMemory()
+	return memory == 0 || this.MemoryHeadroom() >= memory
+}
+
 func (this *RealCommandRunner) StartCommand(edge *Edge) bool {
 	command := edge.EvaluateCommand(false)
-	subproc := this.subprocs_.Add(command, edge.use_console())
+	var sandbox *SandboxSpec = nil
+	if edge.UseSandbox(this.config_) {
+		var err error
+		if sandbox, err = NewSandboxSpec(edge, command); err != nil {
+			// An explicit "sandbox = 1" means the command must not run
+			// unchecked, unless it only has to discover its deps first.
+			if edge.GetBinding("sandbox") != "" && err != errSandboxDepsUnknown {
+				Error("can't sandbox %s: %v", edge.outputs_[0].path(), err)
+				return false
+			}
+			Warning("running %s outside the sandbox: %v", edge.outputs_[0].path(), err)
+		}
+	}
+	trace_file := ""
+	if edge.UseTracing(this.config_) {
+		f, err := os.CreateTemp("", "ninja-trace-")
+		if err != nil {
+			Error("tracing: %s", err.Error())
+			return false
+		}
+		f.Close()
+		trace_file = f.Name()
+	}
+	subproc := this.subprocs_.Add(command, edge.use_console(), edge.GetTimeout(this.config_), sandbox, trace_file)
 	if subproc == nil {
 		return false
 	}
 	this.subproc_to_edge_[subproc] = edge
+	this.memory_reserved_ += edge.GetMemory()
 
 	return true
 }
@@ -60,15 +158,35 @@ func (this *RealCommandRunner) WaitForCommand(result *Result) bool {
 			return false
 		}
 	}
+	this.FinishSubprocess(subproc, result)
+	return true
+}
 
+// / Fill |result| in for |subproc|, which finished, and forget about it.
+func (this *RealCommandRunner) FinishSubprocess(subproc *Subprocess, result *Result) {
 	result.status = subproc.Finish()
+	result.exit_code = subproc.ExitCode()
 	result.output = subproc.GetOutput()
+	if subproc.trace_file_ != "" {
+		if result.success() {
+			result.accesses, _ = LoadAccesses(subproc.trace_file_)
+		}
+		os.Remove(subproc.trace_file_)
+	}
 
 	second, _ := this.subproc_to_edge_[subproc]
 	result.edge = second
 	delete(this.subproc_to_edge_, subproc)
+	this.memory_reserved_ -= second.GetMemory()
+	this.ResampleMemory()
 
-	return true
+	// Give back the tokens we no longer need.
+	if this.jobserver_ != nil {
+		active := len(this.subprocs_.running_) + len(this.subprocs_.finished_)
+		for this.jobserver_.Tokens() > 0 && this.jobserver_.Tokens() >= active {
+			this.jobserver_.Release()
+		}
+	}
 }
 
 func (this *RealCommandRunner) GetActiveEdges() []*Edge {
@@ -80,4 +198,11 @@ func (this *RealCommandRunner) GetActiveEdges() []*Edge {
 }
 func (this *RealCommandRunner) Abort() {
 	this.subprocs_.Clear()
+	this.memory_reserved_ = 0
+	this.ResampleMemory()
+	if this.jobserver_ != nil {
+		for this.jobserver_.Tokens() > 0 {
+			this.jobserver_.Release()
+		}
+	}
 }
@@ -0,0 +1,716 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	repb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/google/uuid"
+	bspb "google.golang.org/genproto/googleapis/bytestream"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// / Blobs up to this size go through the batch calls of the CAS, larger
+// / ones are streamed through ByteStream, in chunks of kReapiChunkSize.
+const kReapiBatchLimit = 1 << 20
+const kReapiChunkSize = 64 * 1024
+
+// / The deps an edge discovered go in the auxiliary metadata of its result,
+// / as a Struct whose kReapiDepsField lists {path, digest} Structs.
+const kReapiDepsField = "ninja-deps"
+
+// / ReapiCache is a remote cache served over gRPC by an implementation of
+// / Bazel's Remote Execution API v2: an ActionCache that maps the digest of
+// / an Action to its ActionResult, and a ContentAddressableStorage (with
+// / ByteStream for large blobs) that holds the outputs.  Digests are SHA-256,
+// / which every server supports.
+type ReapiCache struct {
+	instance_ string
+	ac_       repb.ActionCacheClient
+	cas_      repb.ContentAddressableStorageClient
+	bs_       bspb.ByteStreamClient
+
+	mu_ sync.Mutex
+	/// SHA-256 digests of files, by path and blake3 digest of their contents.
+	digests_ map[string]*repb.Digest
+	/// Action results already fetched or stored, by action digest.  All
+	/// outputs of an edge are looked up in the same result.  Misses aren't
+	/// kept, another build may store the result meanwhile.
+	results_ map[string]*repb.ActionResult
+}
+
+// / Whether the -r |service| is a Remote Execution API cache, grpc://HOST:PORT,
+// / or grpcs:// for TLS, rather than a ninja-rbe over HTTP.
+func IsReapiService(service string) bool {
+	return strings.HasPrefix(service, "grpc://") || strings.HasPrefix(service, "grpcs://")
+}
+
+// / Connect to the cache at |service|.  The connection is made on the
+// / first call.
+func DialReapiCache(service, instance string) (*ReapiCache, error) {
+	creds := insecure.NewCredentials()
+	target, ok := strings.CutPrefix(service, "grpc://")
+	if !ok {
+		target = strings.TrimPrefix(service, "grpcs://")
+		creds = credentials.NewTLS(&tls.Config{})
+	}
+	conn, err := grpc.NewClient(target, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return nil, err
+	}
+	return NewReapiCache(conn, instance), nil
+}
+
+// / A cache talking over |conn|, which may as well lead to a server in this
+// / process, as reapi_cache_test.go sets up with bufconn.
+func NewReapiCache(conn grpc.ClientConnInterface, instance string) *ReapiCache {
+	ret := ReapiCache{}
+	ret.instance_ = instance
+	ret.ac_ = repb.NewActionCacheClient(conn)
+	ret.cas_ = repb.NewContentAddressableStorageClient(conn)
+	ret.bs_ = bspb.NewByteStreamClient(conn)
+	ret.digests_ = map[string]*repb.Digest{}
+	ret.results_ = map[string]*repb.ActionResult{}
+	return &ret
+}
+
+func reapiDigest(data []byte) *repb.Digest {
+	sum := sha256.Sum256(data)
+	return &repb.Digest{Hash: hex.EncodeToString(sum[:]), SizeBytes: int64(len(data))}
+}
+
+func reapiKey(digest *repb.Digest) string {
+	return fmt.Sprintf("%s/%d", digest.Hash, digest.SizeBytes)
+}
+
+// / The serialized form of |m| and its digest; the serialization must be
+// / deterministic for the same action to get the same digest.
+func reapiMarshal(m proto.Message) ([]byte, *repb.Digest, error) {
+	data, err := proto.MarshalOptions{Deterministic: true}.Marshal(m)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, reapiDigest(data), nil
+}
+
+// / The digest of the file at |path|, hashed again only when its blake3
+// / digest, which the hash cache keeps, changed.
+func (this *ReapiCache) FileDigest(path string) (*repb.Digest, error) {
+	content, err := hashFileDigest(path)
+	if err != nil {
+		return nil, err
+	}
+	key := path + "\x00" + hex.EncodeToString(content)
+	this.mu_.Lock()
+	digest, ok := this.digests_[key]
+	this.mu_.Unlock()
+	if ok {
+		return digest, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return nil, err
+	}
+	digest = &repb.Digest{Hash: hex.EncodeToString(h.Sum(nil)), SizeBytes: size}
+	this.mu_.Lock()
+	this.digests_[key] = digest
+	this.mu_.Unlock()
+	return digest, nil
+}
+
+// / A blob to store in the CAS, with its contents in data_ or in the file
+// / path_.
+type reapiBlob struct {
+	digest_ *repb.Digest
+	data_   []byte
+	path_   string
+}
+
+// / ReapiAction is the Action that runs an edge's command.
+type ReapiAction struct {
+	command_ *repb.Command
+	digest_  *repb.Digest
+	/// The serialized Action and Command, to store along the result.
+	blobs_ []reapiBlob
+}
+
+// / A directory of the input root, as it is built.
+type reapiDir struct {
+	files_ map[string]*repb.FileNode
+	dirs_  map[string]*reapiDir
+}
+
+func newReapiDir() *reapiDir {
+	return &reapiDir{files_: map[string]*repb.FileNode{}, dirs_: map[string]*reapiDir{}}
+}
+
+func (this *reapiDir) Add(path string, file *repb.FileNode) {
+	dir := this
+	parts := strings.Split(path, "/")
+	for _, part := range parts[:len(parts)-1] {
+		sub, ok := dir.dirs_[part]
+		if !ok {
+			sub = newReapiDir()
+			dir.dirs_[part] = sub
+		}
+		dir = sub
+	}
+	file.Name = parts[len(parts)-1]
+	dir.files_[file.Name] = file
+}
+
+// / The digest of the Directory message for |this|; REAPI wants its entries
+// / sorted by name.
+func (this *reapiDir) Digest() (*repb.Digest, error) {
+	msg := repb.Directory{}
+	for _, name := range sortedKeys(this.files_) {
+		msg.Files = append(msg.Files, this.files_[name])
+	}
+	for _, name := range sortedKeys(this.dirs_) {
+		digest, err := this.dirs_[name].Digest()
+		if err != nil {
+			return nil, err
+		}
+		msg.Directories = append(msg.Directories, &repb.DirectoryNode{Name: name, Digest: digest})
+	}
+	_, digest, err := reapiMarshal(&msg)
+	return digest, err
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// / The arguments that run |command| the way Subprocess does.
+func reapiArguments(command string) []string {
+	if runtime.GOOS == "windows" {
+		return []string{"cmd", "/c", command}
+	}
+	return []string{"/bin/sh", "-c", command}
+}
+
+// / The Action for |edge|.  Its input root holds the edge's inputs: it is
+// / the directory the relative input paths lead up to, and the build
+// / directory its working directory, so that the paths the command sees
+// / don't depend on where the tree is checked out.  Inputs with absolute
+// / paths, such as system headers, can't go in the root; their digests go
+// / in a platform property instead.
+func (this *ReapiCache) BuildAction(edge *Edge) (*ReapiAction, error) {
+	paths := []string{}
+	for _, node := range edge.inputs_ {
+		paths = append(paths, node.path())
+	}
+	input_root, err := NewRemoteInputRoot(paths)
+	if err != nil {
+		return nil, err
+	}
+	working_directory := input_root.WorkingDirectory
+
+	root := newReapiDir()
+	for i, path := range input_root.Paths {
+		digest, err := this.FileDigest(path)
+		if err != nil {
+			return nil, err
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		root.Add(input_root.RootPaths[i], &repb.FileNode{Digest: digest, IsExecutable: info.Mode()&0111 != 0})
+	}
+	absolute := sha256.New()
+	for _, path := range input_root.Absolute {
+		digest, err := this.FileDigest(path)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(absolute, "%s\x00%s\n", path, reapiKey(digest))
+	}
+	root_digest, err := root.Digest()
+	if err != nil {
+		return nil, err
+	}
+
+	outputs := []string{}
+	for _, o := range edge.outputs_ {
+		outputs = append(outputs, filepath.ToSlash(filepath.Clean(o.path())))
+	}
+	// The depfile is an output too; the cache stores it with the others.
+	if depfile := edge.GetUnescapedDepfile(); depfile != "" {
+		outputs = append(outputs, filepath.ToSlash(filepath.Clean(depfile)))
+	}
+	slices.Sort(outputs)
+	platform := &repb.Platform{Properties: []*repb.Platform_Property{
+		{Name: "ninja-absolute-inputs", Value: hex.EncodeToString(absolute.Sum(nil))},
+	}}
+	command := &repb.Command{
+		Arguments:   reapiArguments(edge.EvaluateCommand(true)),
+		OutputPaths: outputs,
+		// For servers older than v2.1.
+		OutputFiles:      outputs,
+		WorkingDirectory: working_directory,
+		Platform:         platform,
+	}
+	command_data, command_digest, err := reapiMarshal(command)
+	if err != nil {
+		return nil, err
+	}
+	action := &repb.Action{
+		CommandDigest:   command_digest,
+		InputRootDigest: root_digest,
+		Platform:        platform,
+	}
+	action_data, action_digest, err := reapiMarshal(action)
+	if err != nil {
+		return nil, err
+	}
+	ret := ReapiAction{}
+	ret.command_ = command
+	ret.digest_ = action_digest
+	ret.blobs_ = []reapiBlob{
+		{digest_: command_digest, data_: command_data},
+		{digest_: action_digest, data_: action_data},
+	}
+	return &ret, nil
+}
+
+// / The result of |action|, or nil if the cache doesn't have it.
+func (this *ReapiCache) GetActionResult(action *ReapiAction) (*repb.ActionResult, error) {
+	key := reapiKey(action.digest_)
+	this.mu_.Lock()
+	result, ok := this.results_[key]
+	this.mu_.Unlock()
+	if ok {
+		return result, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	result, err := this.ac_.GetActionResult(ctx, &repb.GetActionResultRequest{
+		InstanceName: this.instance_,
+		ActionDigest: action.digest_,
+	})
+	if status.Code(err) == codes.NotFound {
+		result, err = nil, nil
+	}
+	if err != nil || result == nil {
+		return nil, err
+	}
+	this.mu_.Lock()
+	this.results_[key] = result
+	this.mu_.Unlock()
+	return result, nil
+}
+
+// / Record |result| for |action|, storing the blobs it refers to first.
+func (this *ReapiCache) UpdateActionResult(action *ReapiAction, result *repb.ActionResult, outputs []reapiBlob) error {
+	if err := this.Upload(append(slices.Clone(action.blobs_), outputs...)); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	_, err := this.ac_.UpdateActionResult(ctx, &repb.UpdateActionResultRequest{
+		InstanceName: this.instance_,
+		ActionDigest: action.digest_,
+		ActionResult: result,
+	})
+	if err != nil {
+		return err
+	}
+	this.mu_.Lock()
+	this.results_[reapiKey(action.digest_)] = result
+	this.mu_.Unlock()
+	return nil
+}
+
+// / Store the |blobs| the CAS is missing.
+func (this *ReapiCache) Upload(blobs []reapiBlob) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+	req := repb.FindMissingBlobsRequest{InstanceName: this.instance_}
+	by_key := map[string]reapiBlob{}
+	for _, blob := range blobs {
+		if _, ok := by_key[reapiKey(blob.digest_)]; !ok {
+			by_key[reapiKey(blob.digest_)] = blob
+			req.BlobDigests = append(req.BlobDigests, blob.digest_)
+		}
+	}
+	resp, err := this.cas_.FindMissingBlobs(ctx, &req)
+	if err != nil {
+		return err
+	}
+	batch := repb.BatchUpdateBlobsRequest{InstanceName: this.instance_}
+	var batch_size int64 = 0
+	flush := func() error {
+		if len(batch.Requests) == 0 {
+			return nil
+		}
+		resp, err := this.cas_.BatchUpdateBlobs(ctx, &batch)
+		if err != nil {
+			return err
+		}
+		for _, r := range resp.Responses {
+			if r.Status != nil && codes.Code(r.Status.Code) != codes.OK {
+				return fmt.Errorf("uploading %s: %s", r.Digest.Hash, r.Status.Message)
+			}
+		}
+		batch.Requests = nil
+		batch_size = 0
+		return nil
+	}
+	for _, digest := range resp.MissingBlobDigests {
+		blob, ok := by_key[reapiKey(digest)]
+		if !ok {
+			continue
+		}
+		if digest.SizeBytes > kReapiBatchLimit {
+			if err := this.Write(ctx, blob); err != nil {
+				return err
+			}
+			continue
+		}
+		data := blob.data_
+		if data == nil {
+			if data, err = os.ReadFile(blob.path_); err != nil {
+				return err
+			}
+		}
+		if batch_size+digest.SizeBytes > kReapiBatchLimit {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+		batch.Requests = append(batch.Requests, &repb.BatchUpdateBlobsRequest_Request{Digest: digest, Data: data})
+		batch_size += digest.SizeBytes
+	}
+	return flush()
+}
+
+func (this *ReapiCache) resourceName(parts ...string) string {
+	if this.instance_ != "" {
+		parts = append([]string{this.instance_}, parts...)
+	}
+	return strings.Join(parts, "/")
+}
+
+// / Stream |blob| to the CAS through ByteStream.
+func (this *ReapiCache) Write(ctx context.Context, blob reapiBlob) error {
+	var r io.Reader
+	if blob.data_ != nil {
+		r = strings.NewReader(string(blob.data_))
+	} else {
+		f, err := os.Open(blob.path_)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	stream, err := this.bs_.Write(ctx)
+	if err != nil {
+		return err
+	}
+	name := this.resourceName("uploads", uuid.NewString(), "blobs", blob.digest_.Hash,
+		fmt.Sprint(blob.digest_.SizeBytes))
+	buf := make([]byte, kReapiChunkSize)
+	var offset int64 = 0
+	for {
+		n, err := io.ReadFull(r, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		last := offset+int64(n) >= blob.digest_.SizeBytes
+		req := bspb.WriteRequest{WriteOffset: offset, Data: buf[:n], FinishWrite: last}
+		if offset == 0 {
+			req.ResourceName = name
+		}
+		if err := stream.Send(&req); err != nil {
+			if err == io.EOF {
+				// The server has the blob already, it ended the stream.
+				break
+			}
+			return err
+		}
+		offset += int64(n)
+		if last {
+			break
+		}
+	}
+	_, err = stream.CloseAndRecv()
+	return err
+}
+
+// / Fetch the blob |digest| into |path|, checking it against the digest,
+// / and remove it if that fails.
+func (this *ReapiCache) Fetch(digest *repb.Digest, path string) error {
+	defer TraceSpan(kTraceRemote, "download "+path, "rbe")()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+	if dir := filepath.Dir(path); dir != "." {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	out, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	err = this.Read(ctx, digest, io.MultiWriter(out, h))
+	if err1 := out.Close(); err == nil {
+		err = err1
+	}
+	if err == nil && hex.EncodeToString(h.Sum(nil)) != digest.Hash {
+		err = fmt.Errorf("downloading %s: contents don't match digest %s", path, digest.Hash)
+	}
+	if err != nil {
+		os.Remove(path)
+	}
+	return err
+}
+
+// / Copy the blob |digest| to |w|, in a batch call if it is small and
+// / through ByteStream otherwise.
+func (this *ReapiCache) Read(ctx context.Context, digest *repb.Digest, w io.Writer) error {
+	if digest.SizeBytes <= kReapiBatchLimit {
+		resp, err := this.cas_.BatchReadBlobs(ctx, &repb.BatchReadBlobsRequest{
+			InstanceName: this.instance_,
+			Digests:      []*repb.Digest{digest},
+		})
+		if err != nil {
+			return err
+		}
+		if len(resp.Responses) != 1 {
+			return fmt.Errorf("reading %s: got %d blobs", digest.Hash, len(resp.Responses))
+		}
+		r := resp.Responses[0]
+		if r.Status != nil && codes.Code(r.Status.Code) != codes.OK {
+			return fmt.Errorf("reading %s: %s", digest.Hash, r.Status.Message)
+		}
+		_, err = w.Write(r.Data)
+		return err
+	}
+	stream, err := this.bs_.Read(ctx, &bspb.ReadRequest{
+		ResourceName: this.resourceName("blobs", digest.Hash, fmt.Sprint(digest.SizeBytes)),
+	})
+	if err != nil {
+		return err
+	}
+	for {
+		resp, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(resp.Data); err != nil {
+			return err
+		}
+	}
+}
+
+// / The remote cache of |this|, if -r names a Remote Execution API cache.
+func (this *BuildLog) Reapi() *ReapiCache {
+	if this.config_ == nil || !IsReapiService(this.config_.RbeService) {
+		return nil
+	}
+	this.reapi_once_.Do(func() {
+		var err error
+		this.reapi_, err = DialReapiCache(this.config_.RbeService, this.config_.RbeInstance)
+		if err != nil {
+			Warning("remote cache %s: %v", this.config_.RbeService, err)
+		}
+	})
+	return this.reapi_
+}
+
+// / Look up the action of |edge| in the Remote Execution API cache, and
+// / fetch those of its outputs whose contents we don't have.
+func (this *BuildLog) LookupEdgeReapi(edge *Edge, commandHash uint64, currentMtime TimeStamp) *RemoteHit {
+	cache := this.Reapi()
+	if cache == nil {
+		return nil
+	}
+	action, err := cache.BuildAction(edge)
+	if err != nil {
+		// Say an input is missing; the edge has to run anyway.
+		return nil
+	}
+	result, err := cache.GetActionResult(action)
+	if err != nil {
+		log.Println(err)
+		return nil
+	}
+	if result == nil || result.ExitCode != 0 {
+		return nil
+	}
+	deps := reapiDeps(result)
+	if !RemoteDepsCurrent(deps) {
+		return nil
+	}
+	by_path := map[string]*repb.OutputFile{}
+	for _, o := range result.OutputFiles {
+		by_path[o.Path] = o
+	}
+	depfile := ""
+	if path := edge.GetUnescapedDepfile(); path != "" {
+		if o, ok := by_path[filepath.ToSlash(filepath.Clean(path))]; ok {
+			var buf strings.Builder
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+			err := cache.Read(ctx, o.Digest, &buf)
+			cancel()
+			if err != nil {
+				log.Println(err)
+				return nil
+			}
+			depfile = buf.String()
+		}
+	}
+	outputs := FetchRemoteOutputs(edge, func(o *RemoteOutput) (bool, error) {
+		output, ok := by_path[filepath.ToSlash(filepath.Clean(o.path_))]
+		if !ok {
+			return false, nil
+		}
+		o.mode_ = 0644
+		if output.IsExecutable {
+			o.mode_ = 0755
+		}
+		if local, err := cache.FileDigest(o.path_); err == nil && reapiKey(local) == reapiKey(output.Digest) {
+			o.tmp_ = ""
+			return true, nil
+		}
+		return true, cache.Fetch(output.Digest, o.tmp_)
+	})
+	if outputs == nil {
+		return nil
+	}
+	duration := 0
+	if md := result.ExecutionMetadata; md != nil && md.WorkerStartTimestamp != nil && md.WorkerCompletedTimestamp != nil {
+		duration = int(md.WorkerCompletedTimestamp.AsTime().Sub(md.WorkerStartTimestamp.AsTime()).Milliseconds())
+	}
+	return this.RestoreRemoteHit(edge, outputs, depfile, deps, commandHash, currentMtime, 0, duration)
+}
+
+// / Store the outputs of |edge|, which just ran successfully, its |depfile|
+// / and |deps| in the Remote Execution API cache, as the result of its
+// / action.
+func (this *BuildLog) WriteEdgeReapi(edge *Edge, deps []*RemoteDep, depfile string, start_time, end_time int) {
+	cache := this.Reapi()
+	if cache == nil {
+		return
+	}
+	action, err := cache.BuildAction(edge)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	now := time.Now()
+	result := &repb.ActionResult{
+		ExecutionMetadata: &repb.ExecutedActionMetadata{
+			Worker:                   "ninja",
+			WorkerStartTimestamp:     timestamppb.New(now.Add(-time.Duration(end_time-start_time) * time.Millisecond)),
+			WorkerCompletedTimestamp: timestamppb.New(now),
+		},
+	}
+	if len(deps) > 0 {
+		metadata, err := reapiDepsMetadata(deps)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		result.ExecutionMetadata.AuxiliaryMetadata = append(result.ExecutionMetadata.AuxiliaryMetadata, metadata)
+	}
+	blobs := []reapiBlob{}
+	stored := StoreRemoteOutputs(edge, func(path string, info os.FileInfo) error {
+		digest, err := cache.FileDigest(path)
+		if err != nil {
+			return err
+		}
+		result.OutputFiles = append(result.OutputFiles, &repb.OutputFile{
+			Path: filepath.ToSlash(filepath.Clean(path)), Digest: digest, IsExecutable: info.Mode()&0111 != 0,
+		})
+		blobs = append(blobs, reapiBlob{digest_: digest, path_: path})
+		return nil
+	})
+	if !stored {
+		return
+	}
+	if path := edge.GetUnescapedDepfile(); path != "" && depfile != "" {
+		data := []byte(depfile)
+		digest := reapiDigest(data)
+		result.OutputFiles = append(result.OutputFiles, &repb.OutputFile{
+			Path: filepath.ToSlash(filepath.Clean(path)), Digest: digest,
+		})
+		blobs = append(blobs, reapiBlob{digest_: digest, data_: data})
+	}
+	if err := cache.UpdateActionResult(action, result, blobs); err != nil {
+		log.Println(err)
+	}
+}
+
+// / The |deps| of an edge as auxiliary metadata of its result.
+func reapiDepsMetadata(deps []*RemoteDep) (*anypb.Any, error) {
+	list := []any{}
+	for _, dep := range deps {
+		list = append(list, map[string]any{"path": dep.path_, "digest": dep.digest_})
+	}
+	value, err := structpb.NewStruct(map[string]any{kReapiDepsField: list})
+	if err != nil {
+		return nil, err
+	}
+	return anypb.New(value)
+}
+
+// / The deps WriteEdgeReapi() stored with |result|.
+func reapiDeps(result *repb.ActionResult) []*RemoteDep {
+	deps := []*RemoteDep{}
+	if result.ExecutionMetadata == nil {
+		return deps
+	}
+	for _, metadata := range result.ExecutionMetadata.AuxiliaryMetadata {
+		value := structpb.Struct{}
+		if metadata.UnmarshalTo(&value) != nil {
+			// Something a worker put there.
+			continue
+		}
+		for _, v := range value.Fields[kReapiDepsField].GetListValue().GetValues() {
+			fields := v.GetStructValue().GetFields()
+			deps = append(deps, &RemoteDep{
+				path_:   fields["path"].GetStringValue(),
+				digest_: fields["digest"].GetStringValue(),
+			})
+		}
+	}
+	return deps
+}
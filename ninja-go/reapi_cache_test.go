@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	repb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	bspb "google.golang.org/genproto/googleapis/bytestream"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// / An ActionCache, CAS and ByteStream server keeping everything in memory.
+type fakeReapi struct {
+	repb.UnimplementedActionCacheServer
+	repb.UnimplementedContentAddressableStorageServer
+	bspb.UnimplementedByteStreamServer
+
+	mu_      sync.Mutex
+	results_ map[string]*repb.ActionResult
+	blobs_   map[string][]byte
+	/// The blobs written and read through ByteStream, by reapiKey().
+	streamed_writes_ map[string]bool
+	streamed_reads_  map[string]bool
+}
+
+// / Start a fakeReapi and return it with a client connection to it.
+func newFakeReapi(t *testing.T) (*fakeReapi, *grpc.ClientConn) {
+	fake := &fakeReapi{
+		results_:         map[string]*repb.ActionResult{},
+		blobs_:           map[string][]byte{},
+		streamed_writes_: map[string]bool{},
+		streamed_reads_:  map[string]bool{},
+	}
+	listener := bufconn.Listen(1 << 20)
+	server := grpc.NewServer()
+	repb.RegisterActionCacheServer(server, fake)
+	repb.RegisterContentAddressableStorageServer(server, fake)
+	bspb.RegisterByteStreamServer(server, fake)
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return fake, conn
+}
+
+func (this *fakeReapi) GetActionResult(ctx context.Context, req *repb.GetActionResultRequest) (*repb.ActionResult, error) {
+	this.mu_.Lock()
+	defer this.mu_.Unlock()
+	result, ok := this.results_[reapiKey(req.ActionDigest)]
+	if !ok {
+		return nil, status.Error(codes.NotFound, "no such action")
+	}
+	return result, nil
+}
+
+func (this *fakeReapi) UpdateActionResult(ctx context.Context, req *repb.UpdateActionResultRequest) (*repb.ActionResult, error) {
+	this.mu_.Lock()
+	defer this.mu_.Unlock()
+	for _, o := range req.ActionResult.OutputFiles {
+		if _, ok := this.blobs_[reapiKey(o.Digest)]; !ok {
+			return nil, status.Errorf(codes.FailedPrecondition, "missing blob for %s", o.Path)
+		}
+	}
+	this.results_[reapiKey(req.ActionDigest)] = req.ActionResult
+	return req.ActionResult, nil
+}
+
+func (this *fakeReapi) FindMissingBlobs(ctx context.Context, req *repb.FindMissingBlobsRequest) (*repb.FindMissingBlobsResponse, error) {
+	this.mu_.Lock()
+	defer this.mu_.Unlock()
+	resp := &repb.FindMissingBlobsResponse{}
+	for _, digest := range req.BlobDigests {
+		if _, ok := this.blobs_[reapiKey(digest)]; !ok {
+			resp.MissingBlobDigests = append(resp.MissingBlobDigests, digest)
+		}
+	}
+	return resp, nil
+}
+
+// / Store |data| under |digest|, refusing data that doesn't match it.
+func (this *fakeReapi) store(digest *repb.Digest, data []byte) error {
+	if got := reapiDigest(data); reapiKey(got) != reapiKey(digest) {
+		return status.Errorf(codes.InvalidArgument, "got %s for %s", reapiKey(got), reapiKey(digest))
+	}
+	this.blobs_[reapiKey(digest)] = data
+	return nil
+}
+
+func (this *fakeReapi) BatchUpdateBlobs(ctx context.Context, req *repb.BatchUpdateBlobsRequest) (*repb.BatchUpdateBlobsResponse, error) {
+	this.mu_.Lock()
+	defer this.mu_.Unlock()
+	resp := &repb.BatchUpdateBlobsResponse{}
+	var size int64 = 0
+	for _, r := range req.Requests {
+		size += r.Digest.SizeBytes
+		if size > kReapiBatchLimit {
+			return nil, status.Error(codes.InvalidArgument, "batch too large")
+		}
+		if err := this.store(r.Digest, r.Data); err != nil {
+			return nil, err
+		}
+		resp.Responses = append(resp.Responses, &repb.BatchUpdateBlobsResponse_Response{Digest: r.Digest})
+	}
+	return resp, nil
+}
+
+func (this *fakeReapi) BatchReadBlobs(ctx context.Context, req *repb.BatchReadBlobsRequest) (*repb.BatchReadBlobsResponse, error) {
+	this.mu_.Lock()
+	defer this.mu_.Unlock()
+	resp := &repb.BatchReadBlobsResponse{}
+	for _, digest := range req.Digests {
+		if digest.SizeBytes > kReapiBatchLimit {
+			return nil, status.Error(codes.InvalidArgument, "blob too large for a batch")
+		}
+		data, ok := this.blobs_[reapiKey(digest)]
+		if !ok {
+			return nil, status.Errorf(codes.NotFound, "no blob %s", reapiKey(digest))
+		}
+		resp.Responses = append(resp.Responses, &repb.BatchReadBlobsResponse_Response{Digest: digest, Data: data})
+	}
+	return resp, nil
+}
+
+// / The "<hash>/<size>" key of the ByteStream resource |name|, which ends
+// / with "blobs/<hash>/<size>".
+func fakeReapiResourceKey(name string) string {
+	parts := strings.Split(name, "/")
+	if len(parts) < 3 || parts[len(parts)-3] != "blobs" {
+		return ""
+	}
+	return parts[len(parts)-2] + "/" + parts[len(parts)-1]
+}
+
+func (this *fakeReapi) Read(req *bspb.ReadRequest, stream bspb.ByteStream_ReadServer) error {
+	key := fakeReapiResourceKey(req.ResourceName)
+	this.mu_.Lock()
+	data, ok := this.blobs_[key]
+	this.streamed_reads_[key] = true
+	this.mu_.Unlock()
+	if !ok {
+		return status.Errorf(codes.NotFound, "no blob %s", req.ResourceName)
+	}
+	for len(data) > 0 {
+		n := min(len(data), kReapiChunkSize)
+		if err := stream.Send(&bspb.ReadResponse{Data: data[:n]}); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+func (this *fakeReapi) Write(stream bspb.ByteStream_WriteServer) error {
+	var buf bytes.Buffer
+	key := ""
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			return status.Error(codes.InvalidArgument, "stream ended before FinishWrite")
+		}
+		if err != nil {
+			return err
+		}
+		if req.ResourceName != "" {
+			key = fakeReapiResourceKey(req.ResourceName)
+		}
+		if req.WriteOffset != int64(buf.Len()) {
+			return status.Errorf(codes.InvalidArgument, "write at %d, expected %d", req.WriteOffset, buf.Len())
+		}
+		buf.Write(req.Data)
+		if req.FinishWrite {
+			break
+		}
+	}
+	this.mu_.Lock()
+	defer this.mu_.Unlock()
+	digest := reapiDigest(buf.Bytes())
+	if reapiKey(digest) != key {
+		return status.Errorf(codes.InvalidArgument, "got %s for %s", reapiKey(digest), key)
+	}
+	if err := this.store(digest, buf.Bytes()); err != nil {
+		return err
+	}
+	this.streamed_writes_[key] = true
+	return stream.SendAndClose(&bspb.WriteResponse{CommittedSize: int64(buf.Len())})
+}
+
+// / Parse |manifest| in a new directory, which becomes the working directory
+// / for the rest of the test, and return its state with a build log whose
+// / remote cache talks to |conn|.
+func reapiTestBuild(t *testing.T, conn grpc.ClientConnInterface, manifest string) (*State, *BuildLog) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	state := NewState()
+	parser := NewManifestParser(state, nil, NewManifestParserOptions())
+	err1 := ""
+	// The lexer expects the NUL that ReadFile() appends.
+	if !parser.ParseTest(manifest+"\x00", &err1) {
+		t.Fatal(err1)
+	}
+	config := NewBuildConfig()
+	config.RbeService = "grpc://bufconn"
+	log := NewBuildLog(config, "")
+	cache := NewReapiCache(conn, "ninja")
+	log.reapi_once_.Do(func() { log.reapi_ = cache })
+	return state, log
+}
+
+func writeTestFile(t *testing.T, path, contents string) {
+	if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readTestFile(t *testing.T, path string) string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+const kReapiTestManifest = "rule cp\n  command = cp $in $out\nbuild out: cp in\n"
+
+func TestReapiCacheHit(t *testing.T) {
+	_, conn := newFakeReapi(t)
+	state, log := reapiTestBuild(t, conn, kReapiTestManifest)
+	edge := state.LookupNode("out").in_edge()
+	writeTestFile(t, "in", "contents\n")
+	writeTestFile(t, "out", "contents\n")
+	log.WriteEdgeReapi(edge, nil, "", 100, 250)
+
+	os.Remove("out")
+	hit := log.LookupEdgeReapi(edge, 0x1234, 42)
+	if hit == nil {
+		t.Fatal("expected a hit")
+	}
+	if got := readTestFile(t, "out"); got != "contents\n" {
+		t.Errorf("out = %q", got)
+	}
+	entry := hit.entries_["out"]
+	if entry == nil || entry.command_hash != 0x1234 || entry.mtime != 42 || entry.end_time != 150 {
+		t.Errorf("entry = %+v", entry)
+	}
+	if _, err := os.Stat("out.tmp"); !os.IsNotExist(err) {
+		t.Errorf("out.tmp left behind: %v", err)
+	}
+}
+
+func TestReapiCacheMiss(t *testing.T) {
+	_, conn := newFakeReapi(t)
+	state, log := reapiTestBuild(t, conn, kReapiTestManifest)
+	edge := state.LookupNode("out").in_edge()
+	writeTestFile(t, "in", "contents\n")
+	if hit := log.LookupEdgeReapi(edge, 0x1234, 42); hit != nil {
+		t.Fatal("expected a miss")
+	}
+
+	// Another build stores the result meanwhile; the miss mustn't stick.
+	other := NewBuildLog(log.config_, "")
+	other.reapi_once_.Do(func() { other.reapi_ = NewReapiCache(conn, "ninja") })
+	writeTestFile(t, "out", "contents\n")
+	other.WriteEdgeReapi(edge, nil, "", 0, 0)
+	os.Remove("out")
+	if hit := log.LookupEdgeReapi(edge, 0x1234, 42); hit == nil {
+		t.Fatal("expected a hit once the result is stored")
+	}
+	if got := readTestFile(t, "out"); got != "contents\n" {
+		t.Errorf("out = %q", got)
+	}
+}
+
+func TestReapiCacheByteStream(t *testing.T) {
+	fake, conn := newFakeReapi(t)
+	state, log := reapiTestBuild(t, conn, kReapiTestManifest)
+	edge := state.LookupNode("out").in_edge()
+	var large strings.Builder
+	for i := 0; large.Len() <= kReapiBatchLimit; i++ {
+		fmt.Fprintf(&large, "line %d\n", i)
+	}
+	writeTestFile(t, "in", large.String())
+	writeTestFile(t, "out", large.String())
+	log.WriteEdgeReapi(edge, nil, "", 0, 0)
+
+	key := reapiKey(reapiDigest([]byte(large.String())))
+	if !fake.streamed_writes_[key] {
+		t.Fatalf("%s wasn't written through ByteStream", key)
+	}
+	os.Remove("out")
+	if hit := log.LookupEdgeReapi(edge, 0x1234, 42); hit == nil {
+		t.Fatal("expected a hit")
+	}
+	if !fake.streamed_reads_[key] {
+		t.Errorf("%s wasn't read through ByteStream", key)
+	}
+	if got := readTestFile(t, "out"); got != large.String() {
+		t.Errorf("out has %d bytes, expected %d", len(got), large.Len())
+	}
+}
+
+func TestReapiCacheMissingOutput(t *testing.T) {
+	_, conn := newFakeReapi(t)
+	state, log := reapiTestBuild(t, conn,
+		"rule cp2\n  command = cp $in a && cp $in b\nbuild a b: cp2 in\n")
+	edge := state.LookupNode("a").in_edge()
+	writeTestFile(t, "in", "contents\n")
+	writeTestFile(t, "a", "contents\n")
+
+	// A result with only one of the edge's outputs.
+	cache := log.Reapi()
+	action, err := cache.BuildAction(edge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest, err := cache.FileDigest("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := &repb.ActionResult{OutputFiles: []*repb.OutputFile{{Path: "a", Digest: digest}}}
+	if err := cache.UpdateActionResult(action, result, []reapiBlob{{digest_: digest, path_: "a"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	os.Remove("a")
+	if hit := log.LookupEdgeReapi(edge, 0x1234, 42); hit != nil {
+		t.Fatal("expected no hit for a partial result")
+	}
+	for _, path := range []string{"a", "a.tmp", "b", "b.tmp"} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s exists: %v", path, err)
+		}
+	}
+}
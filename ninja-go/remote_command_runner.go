@@ -0,0 +1,462 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// / RemoteInputRoot lays out the files a command reads for a remote machine.
+// / The root is the directory the relative paths lead up to, with the build
+// / directory as the working directory below it, so that the paths the
+// / command sees don't depend on where the tree is checked out.  Absolute
+// / paths, such as system headers, can't go in the root.
+type RemoteInputRoot struct {
+	WorkingDirectory string
+	/// The relative paths, as given, and where they are in the root.
+	Paths     []string
+	RootPaths []string
+	Absolute  []string
+}
+
+func NewRemoteInputRoot(paths []string) (*RemoteInputRoot, error) {
+	cwd, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+	cwd_parts := strings.Split(filepath.ToSlash(strings.TrimPrefix(cwd, filepath.VolumeName(cwd))), "/")[1:]
+	ret := RemoteInputRoot{}
+	// How many levels up the root is from the build directory.
+	up := 0
+	for _, path := range paths {
+		if filepath.IsAbs(path) {
+			ret.Absolute = append(ret.Absolute, filepath.ToSlash(path))
+			continue
+		}
+		slashed := filepath.ToSlash(filepath.Clean(path))
+		n := 0
+		for strings.HasPrefix(slashed[3*n:], "../") {
+			n++
+		}
+		if n > len(cwd_parts) {
+			// Above the filesystem root.
+			ret.Absolute = append(ret.Absolute, filepath.ToSlash(filepath.Join(cwd, path)))
+			continue
+		}
+		up = max(up, n)
+		ret.Paths = append(ret.Paths, path)
+	}
+	ret.WorkingDirectory = strings.Join(cwd_parts[len(cwd_parts)-up:], "/")
+	for _, path := range ret.Paths {
+		ret.RootPaths = append(ret.RootPaths, filepath.ToSlash(filepath.Join(ret.WorkingDirectory, path)))
+	}
+	return &ret, nil
+}
+
+// / Whether |edge|'s command should run on a remote worker: with
+// / --remote-jobs, unless its edge sets "remote = 0".  Commands that need
+// / the terminal, regenerate the manifest or run under the sandbox or the
+// / tracer stay here.
+func (this *Edge) UseRemote(config *BuildConfig) bool {
+	if this.is_phony() || this.use_console() || this.GetBindingBool("generator") ||
+		this.UseSandbox(config) || this.UseTracing(config) {
+		return false
+	}
+	if value := this.GetBinding("remote"); value != "" {
+		return value != "0"
+	}
+	return config.RemoteJobs > 0
+}
+
+// / The wire form of the jobs ninja-rbe queues for its workers, as
+// / ninja-rbe/exec_service.go has it.
+type RemoteExecInput struct {
+	Path       string `json:"path"`
+	Digest     string `json:"digest"`
+	Executable bool   `json:"executable"`
+}
+
+type RemoteExecJob struct {
+	Command          string             `json:"command"`
+	WorkingDirectory string             `json:"working_directory"`
+	Inputs           []*RemoteExecInput `json:"inputs"`
+	Outputs          []string           `json:"outputs"`
+	TimeoutMs        int64              `json:"timeout_ms"`
+}
+
+type RemoteExecOutput struct {
+	Path       string `json:"path"`
+	Digest     string `json:"digest"`
+	Size       int64  `json:"size"`
+	Executable bool   `json:"executable"`
+}
+
+type RemoteExecResult struct {
+	ExitCode int                 `json:"exit_code"`
+	TimedOut bool                `json:"timed_out"`
+	Output   string              `json:"output"`
+	Outputs  []*RemoteExecOutput `json:"outputs"`
+	Error    string              `json:"error"`
+}
+
+// / A command running remotely.
+type remoteCommand struct {
+	edge_   *Edge
+	cancel_ context.CancelFunc
+	result_ Result
+	/// Why the command couldn't run remotely, or its outputs couldn't be
+	/// fetched, as opposed to how it exited, which is in result_.
+	err_ error
+}
+
+// / RemoteCommandRunner runs the edges UseRemote() picks on the workers of a
+// / ninja-rbe, up to RemoteJobs of them at once, and the others through a
+// / RealCommandRunner, within the -j limit.  A remote command uploads the
+// / input tree to the CAS, is queued for a worker, and once it finished we
+// / fetch the outputs it left.
+type RemoteCommandRunner struct {
+	CommandRunner
+	config_  *BuildConfig
+	local_   *RealCommandRunner
+	service_ string
+	client_  *http.Client
+
+	running_ map[*Edge]*remoteCommand
+	done_    chan *remoteCommand
+
+	/// The digests of the blobs we know the CAS has.
+	mu_       sync.Mutex
+	uploaded_ map[string]bool
+}
+
+func NewRemoteCommandRunner(config *BuildConfig) *RemoteCommandRunner {
+	ret := RemoteCommandRunner{}
+	ret.config_ = config
+	ret.local_ = NewRealCommandRunner(config)
+	ret.service_ = config.RbeService
+	ret.client_ = rbeClient(10 * time.Minute)
+	ret.running_ = make(map[*Edge]*remoteCommand)
+	ret.done_ = make(chan *remoteCommand, config.RemoteJobs)
+	ret.uploaded_ = make(map[string]bool)
+	return &ret
+}
+
+func (this *RemoteCommandRunner) CanRunMore() int64 {
+	return int64(this.config_.RemoteJobs-len(this.running_)) + this.local_.CanRunMore()
+}
+
+func (this *RemoteCommandRunner) CanRunEdge(edge *Edge) bool {
+	if edge.UseRemote(this.config_) {
+		return len(this.running_) < this.config_.RemoteJobs
+	}
+	return this.local_.CanRunMore() > 0 && this.local_.CanRunEdge(edge)
+}
+
+func (this *RemoteCommandRunner) StartCommand(edge *Edge) bool {
+	if !edge.UseRemote(this.config_) {
+		return this.local_.StartCommand(edge)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	command := &remoteCommand{edge_: edge, cancel_: cancel}
+	command.result_.edge = edge
+	this.running_[edge] = command
+	job, err := this.NewJob(edge)
+	go func() {
+		if err == nil {
+			err = this.Run(ctx, job, &command.result_)
+		}
+		command.err_ = err
+		this.done_ <- command
+	}()
+	return true
+}
+
+// / Describe the job running |edge|'s command.  Its inputs are the edge's
+// / (directories with all the files below them), its response file and the
+// / paths of its "remote_paths" binding: toolchains or other files checked
+// / into the tree, which nobody declares as inputs.  Inputs with absolute
+// / paths must be on the workers already.
+func (this *RemoteCommandRunner) NewJob(edge *Edge) (*RemoteExecJob, error) {
+	paths := []string{}
+	add := func(path string) error {
+		if path == "" {
+			return nil
+		}
+		if filepath.IsAbs(path) {
+			paths = append(paths, path)
+			return nil
+		}
+		return filepath.Walk(path, func(path string, info os.FileInfo, err error) error {
+			if os.IsNotExist(err) {
+				// Say a phony input.
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if info.Mode().IsRegular() {
+				paths = append(paths, path)
+			}
+			return nil
+		})
+	}
+	for _, input := range edge.inputs_ {
+		if err := add(input.path()); err != nil {
+			return nil, err
+		}
+	}
+	if err := add(edge.GetUnescapedRspfile()); err != nil {
+		return nil, err
+	}
+	for _, path := range strings.Fields(edge.GetBinding("remote_paths")) {
+		if err := add(path); err != nil {
+			return nil, err
+		}
+	}
+	root, err := NewRemoteInputRoot(paths)
+	if err != nil {
+		return nil, err
+	}
+	job := RemoteExecJob{}
+	job.Command = edge.EvaluateCommand(false)
+	job.WorkingDirectory = root.WorkingDirectory
+	job.TimeoutMs = edge.GetTimeout(this.config_).Milliseconds()
+	seen := map[string]bool{}
+	for i, path := range root.Paths {
+		if seen[root.RootPaths[i]] {
+			continue
+		}
+		seen[root.RootPaths[i]] = true
+		digest, err := hashFileDigest(path)
+		if err != nil {
+			return nil, err
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		job.Inputs = append(job.Inputs, &RemoteExecInput{Path: root.RootPaths[i],
+			Digest: hex.EncodeToString(digest), Executable: info.Mode()&0111 != 0})
+	}
+	for _, o := range edge.outputs_ {
+		job.Outputs = append(job.Outputs, filepath.ToSlash(filepath.Clean(o.path())))
+	}
+	if depfile := edge.GetUnescapedDepfile(); depfile != "" {
+		job.Outputs = append(job.Outputs, filepath.ToSlash(filepath.Clean(depfile)))
+	}
+	return &job, nil
+}
+
+// / Run |job| remotely and fill |result| in with how it went.  Returns an
+// / error if the command didn't get to run or its outputs couldn't be
+// / fetched, but not for a command that failed.
+func (this *RemoteCommandRunner) Run(ctx context.Context, job *RemoteExecJob, result *Result) error {
+	defer TraceSpan(kTraceRemote, "run "+result.edge.outputs_[0].path(), "rbe")()
+	if err := this.UploadInputs(job); err != nil {
+		return err
+	}
+	body, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	var id struct {
+		ID string `json:"id"`
+	}
+	err = this.call(ctx, "POST", this.service_+"/exec/", body, &id)
+	if status_err, ok := err.(*remoteStatusError); ok && status_err.status_ == http.StatusBadRequest &&
+		strings.HasPrefix(status_err.body_, "missing blob") {
+		// The CAS dropped blobs we uploaded earlier; upload them again.
+		this.ForgetUploads(job)
+		if err = this.UploadInputs(job); err == nil {
+			err = this.call(ctx, "POST", this.service_+"/exec/", body, &id)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	var exec_result RemoteExecResult
+	for {
+		err := this.call(ctx, "GET", this.service_+"/exec/"+id.ID+"?wait=30s", nil, &exec_result)
+		if ctx.Err() != nil {
+			// Aborted; nobody will want the result.
+			this.call(context.Background(), "DELETE", this.service_+"/exec/"+id.ID, nil, nil)
+			return ctx.Err()
+		}
+		if err == errRemotePending {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		break
+	}
+
+	if exec_result.Error != "" {
+		// Say the worker was lost; the command may never have run.
+		return fmt.Errorf("%s", exec_result.Error)
+	}
+	result.output = exec_result.Output
+	result.exit_code = exec_result.ExitCode
+	switch {
+	case exec_result.TimedOut:
+		result.status = ExitTimedOut
+	case exec_result.ExitCode != 0:
+		result.status = ExitFailure
+	default:
+		result.status = ExitSuccess
+	}
+	if !result.success() {
+		return nil
+	}
+	for _, output := range exec_result.Outputs {
+		digest, err := hashFileDigest(output.Path)
+		if err == nil && hex.EncodeToString(digest) == output.Digest {
+			continue
+		}
+		if err := RbeDownload(output.Path, output.Digest, this.service_); err != nil {
+			return err
+		}
+		if output.Executable {
+			if err := os.Chmod(output.Path, 0755); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// / Store the inputs of |job| the CAS doesn't have.
+func (this *RemoteCommandRunner) UploadInputs(job *RemoteExecJob) error {
+	root := filepath.FromSlash(job.WorkingDirectory)
+	for _, input := range job.Inputs {
+		this.mu_.Lock()
+		uploaded := this.uploaded_[input.Digest]
+		this.mu_.Unlock()
+		if uploaded {
+			continue
+		}
+		path, err := filepath.Rel(root, filepath.FromSlash(input.Path))
+		if err != nil {
+			return err
+		}
+		if err := RbeUploadBlob(this.client_, this.service_, path, input.Digest); err != nil {
+			return err
+		}
+		this.mu_.Lock()
+		this.uploaded_[input.Digest] = true
+		this.mu_.Unlock()
+	}
+	return nil
+}
+
+// / Forget that the CAS has the inputs of |job|, so that UploadInputs()
+// / checks them again.
+func (this *RemoteCommandRunner) ForgetUploads(job *RemoteExecJob) {
+	this.mu_.Lock()
+	defer this.mu_.Unlock()
+	for _, input := range job.Inputs {
+		delete(this.uploaded_, input.Digest)
+	}
+}
+
+var errRemotePending = fmt.Errorf("still running")
+
+// / An answer of the ninja-rbe other than 200 OK or 204 No Content.
+type remoteStatusError struct {
+	method_ string
+	url_    string
+	status_ int
+	body_   string
+}
+
+func (this *remoteStatusError) Error() string {
+	return fmt.Sprintf("%s %s: StatusCode: %v, Body: %s", this.method_, this.url_, this.status_, this.body_)
+}
+
+// / Send a request to the ninja-rbe and decode its JSON answer into |out|.
+func (this *RemoteCommandRunner) call(ctx context.Context, method, url string, body []byte, out any) error {
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp, err := this.client_.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode == http.StatusNoContent {
+		return errRemotePending
+	}
+	if resp.StatusCode != http.StatusOK {
+		return &remoteStatusError{method_: method, url_: url, status_: resp.StatusCode, body_: string(data)}
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(data, out)
+}
+
+func (this *RemoteCommandRunner) WaitForCommand(result *Result) bool {
+	subprocs := this.local_.subprocs_
+	for {
+		if subproc := subprocs.NextFinished(); subproc != nil {
+			this.local_.FinishSubprocess(subproc, result)
+			return true
+		}
+		select {
+		case command := <-this.done_:
+			delete(this.running_, command.edge_)
+			this.local_.ResampleMemory()
+			if command.err_ != nil {
+				// Not the command's fault; run it here instead.
+				Warning("remote execution of %s: %v; running it locally",
+					command.edge_.outputs_[0].path(), command.err_)
+				if this.local_.StartCommand(command.edge_) {
+					continue
+				}
+				*result = Result{edge: command.edge_, status: ExitFailure, exit_code: -1}
+				return true
+			}
+			*result = command.result_
+			return true
+		case subproc := <-subprocs.done_:
+			subprocs.reap(subproc)
+		case <-subprocs.interrupted_:
+			return false
+		case <-g_interrupt_build:
+			return false
+		}
+	}
+}
+
+func (this *RemoteCommandRunner) GetActiveEdges() []*Edge {
+	edges := this.local_.GetActiveEdges()
+	for edge := range this.running_ {
+		edges = append(edges, edge)
+	}
+	return edges
+}
+
+func (this *RemoteCommandRunner) Abort() {
+	this.local_.Abort()
+	for _, command := range this.running_ {
+		command.cancel_()
+	}
+	for len(this.running_) > 0 {
+		command := <-this.done_
+		delete(this.running_, command.edge_)
+	}
+}
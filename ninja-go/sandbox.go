@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// / SandboxSpec describes what a sandboxed command sees of the build tree.
+// / The tree is hidden, except for the edge's declared inputs, which are
+// / mounted read-only, and the directories of its outputs, which start out
+// / empty.  The outputs are copied back into the tree once the command
+// / succeeded; anything else it writes there is dropped.  The rest of the
+// / file system, where the toolchain lives, is left as it is.
+type SandboxSpec struct {
+	Command string
+	/// Absolute path of the build tree, our working directory.
+	Root string
+	/// An empty directory the sandbox sets its mounts up in.
+	Staging string
+	/// Paths relative to Root.
+	Inputs  []string
+	Outputs []string
+	/// Whether Inputs include deps discovered by an earlier run, which may
+	/// be out of date.
+	DiscoveredDeps bool
+	/// Where to write the files the command accessed, if it is traced.
+	TraceFile string
+}
+
+// / Whether |edge|'s command should run in a sandbox, per its "sandbox"
+// / binding or else --sandbox.  Console jobs never are, as they need the
+// / terminal.
+func (this *Edge) UseSandbox(config *BuildConfig) bool {
+	if this.is_phony() || this.use_console() {
+		return false
+	}
+	if value := this.GetBinding("sandbox"); value != "" {
+		return value != "0"
+	}
+	return config.Sandbox
+}
+
+// / NewSandboxSpec fails with this if the deps of an edge come from a
+// / depfile or the deps log and couldn't be loaded, as on the first build:
+// / we can't tell what it will read.
+var errSandboxDepsUnknown = fmt.Errorf("its deps aren't known until it ran once")
+
+// / Describe the sandbox for |edge|'s |command|, or say why the edge can't
+// / be sandboxed.
+func NewSandboxSpec(edge *Edge, command string) (*SandboxSpec, error) {
+	discovered := edge.GetBinding("deps") != "" || edge.GetUnescapedDepfile() != ""
+	if discovered && (edge.deps_missing_ || !edge.deps_loaded_) {
+		return nil, errSandboxDepsUnknown
+	}
+	cwd, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+	// The tracer resolves the paths it sees through /proc/<pid>/cwd, which
+	// has no symlinks; neither must the root they are checked against.
+	root, err := filepath.EvalSymlinks(cwd)
+	if err != nil {
+		return nil, err
+	}
+	if root == "/" {
+		return nil, fmt.Errorf("the build tree is the root directory")
+	}
+	ret := SandboxSpec{Command: command, Root: root, DiscoveredDeps: discovered}
+
+	add := func(paths *[]string, path string) {
+		if path == "" {
+			return
+		}
+		if filepath.IsAbs(path) {
+			// Paths outside the tree stay visible anyway.  Those in it may
+			// go through the symlinks we resolved or not.
+			in_tree := false
+			for _, dir := range []string{root, cwd} {
+				rel, err := filepath.Rel(dir, path)
+				if err == nil && rel != ".." && !strings.HasPrefix(rel, "../") {
+					path, in_tree = rel, true
+					break
+				}
+			}
+			if !in_tree {
+				return
+			}
+		}
+		path = filepath.Clean(path)
+		if !slices.Contains(*paths, path) {
+			*paths = append(*paths, path)
+		}
+	}
+	// inputs_ includes the deps loaded from the depfile or deps log.
+	for _, input := range edge.inputs_ {
+		add(&ret.Inputs, input.path())
+	}
+	add(&ret.Inputs, edge.GetUnescapedRspfile())
+	// Toolchains or other files checked into the tree, which nobody
+	// declares as inputs.
+	for _, path := range strings.Fields(edge.GetBinding("sandbox_paths")) {
+		add(&ret.Inputs, path)
+	}
+	for _, output := range edge.outputs_ {
+		add(&ret.Outputs, output.path())
+	}
+	add(&ret.Outputs, edge.GetUnescapedDepfile())
+	return &ret, nil
+}
+
+// / Write the spec into |Staging| for the sandbox to pick up.
+func (this *SandboxSpec) Save() (string, error) {
+	data, err := json.Marshal(this)
+	if err != nil {
+		return "", err
+	}
+	path := this.Staging + ".json"
+	return path, os.WriteFile(path, data, 0600)
+}
+
+func LoadSandboxSpec(path string) (*SandboxSpec, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	ret := SandboxSpec{}
+	if err := json.Unmarshal(data, &ret); err != nil {
+		return nil, err
+	}
+	return &ret, nil
+}
+
+// / Remove what Save() and the sandbox left behind.
+func (this *SandboxSpec) Cleanup() {
+	os.Remove(this.Staging + ".json")
+	os.RemoveAll(this.Staging)
+}
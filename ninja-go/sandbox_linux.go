@@ -0,0 +1,296 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+)
+
+// / argv[0] with which we re-execute ourselves to set up a sandbox.
+const kSandboxArgv0 = "ninja-sandbox"
+
+// / Build the command that runs |spec| in a new user and mount namespace.
+// / It re-executes ninja, which sets up the mounts there and then runs the
+// / actual command; see SandboxMain().
+func SandboxCommand(spec *SandboxSpec) (*exec.Cmd, error) {
+	staging, err := os.MkdirTemp("", "ninja-sandbox-")
+	if err != nil {
+		return nil, err
+	}
+	spec.Staging = staging
+	path, err := spec.Save()
+	if err != nil {
+		spec.Cleanup()
+		return nil, err
+	}
+	cmd := exec.Command("/proc/self/exe", path)
+	cmd.Args[0] = kSandboxArgv0
+	// We become root in the namespace, which is what allows us to mount.
+	// Files we create still belong to the invoking user outside of it.
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags:                 syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS,
+		UidMappings:                []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getuid(), Size: 1}},
+		GidMappings:                []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getgid(), Size: 1}},
+		GidMappingsEnableSetgroups: false,
+	}
+	return cmd, nil
+}
+
+// / The entry point of a re-executed ninja inside the namespaces: set up the
+// / view of the build tree described by the spec at |spec_path|, run the
+// / command in it and copy its outputs back.  Returns the exit code.
+func SandboxMain(spec_path string) int {
+	spec, err := LoadSandboxSpec(spec_path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ninja: sandbox: %v\n", err)
+		return 1
+	}
+	orig := filepath.Join(spec.Staging, "orig")
+	view := filepath.Join(spec.Staging, "view")
+	if err := spec.Mount(orig, view); err != nil {
+		fmt.Fprintf(os.Stderr, "ninja: sandbox: %v\n", err)
+		return 1
+	}
+
+	// Signals for the process group reach the command directly; we just wait
+	// for it.  Handled rather than ignored, so that the command still gets
+	// the default dispositions.
+	signal.Notify(make(chan os.Signal, 1), syscall.SIGINT, syscall.SIGTERM)
+
+	output := bytes.Buffer{}
+	cmd := exec.Command("bash", "-c", spec.Command)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = io.MultiWriter(os.Stdout, &output)
+	cmd.Stderr = cmd.Stdout
+	var status syscall.WaitStatus
+	if spec.TraceFile != "" {
+		var accesses map[string]bool
+		status, accesses, err = TraceCommand(cmd, spec.Root)
+		if err == nil {
+			err = SaveAccesses(spec.TraceFile, accesses)
+		}
+	} else if err = cmd.Run(); cmd.ProcessState != nil {
+		status, err = cmd.ProcessState.Sys().(syscall.WaitStatus), nil
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ninja: sandbox: %v\n", err)
+		return 1
+	}
+	if status.Signaled() {
+		return ExitCodeOf(status)
+	}
+	if status.ExitStatus() != 0 {
+		undeclared := spec.FindUndeclaredInputs(orig, output.String())
+		for _, path := range undeclared {
+			fmt.Printf("ninja: sandbox: '%s' is not a declared input of this edge\n", path)
+		}
+		if len(undeclared) != 0 && spec.DiscoveredDeps {
+			fmt.Printf("ninja: sandbox: if it was newly included, build once with sandbox = 0 to record it\n")
+		}
+		return status.ExitStatus()
+	}
+
+	for _, path := range spec.Outputs {
+		if err := copyTree(path, filepath.Join(orig, path)); err != nil && !os.IsNotExist(err) {
+			fmt.Printf("ninja: sandbox: copying output: %v\n", err)
+			return 1
+		}
+	}
+	return 0
+}
+
+// / Mount the build tree at |orig|, build the sandbox's view of it at |view|
+// / and mount that over the tree.
+func (this *SandboxSpec) Mount(orig, view string) error {
+	// Keep our mounts from propagating back to the parent namespace.
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("making mounts private: %v", err)
+	}
+	if err := syscall.Mount("tmpfs", this.Staging, "tmpfs", 0, "mode=0700"); err != nil {
+		return fmt.Errorf("mounting tmpfs: %v", err)
+	}
+	if err := os.Mkdir(orig, 0700); err != nil {
+		return err
+	}
+	if err := os.Mkdir(view, 0755); err != nil {
+		return err
+	}
+	if err := syscall.Mount(this.Root, orig, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return fmt.Errorf("mounting %s: %v", this.Root, err)
+	}
+
+	for _, path := range this.Inputs {
+		source := filepath.Join(orig, path)
+		target := filepath.Join(view, path)
+		info, err := os.Stat(source)
+		if err != nil {
+			// Missing inputs are for the command to report.
+			continue
+		}
+		if info.IsDir() {
+			err = os.MkdirAll(target, 0755)
+		} else if err = os.MkdirAll(filepath.Dir(target), 0755); err == nil {
+			err = createMountPoint(target)
+		}
+		if err != nil {
+			return err
+		}
+		if err := bindReadOnly(source, target); err != nil {
+			return fmt.Errorf("mounting %s: %v", path, err)
+		}
+	}
+	for _, path := range this.Outputs {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(view, path)), 0755); err != nil {
+			return err
+		}
+	}
+
+	if err := syscall.Mount(view, this.Root, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return fmt.Errorf("mounting the sandbox over %s: %v", this.Root, err)
+	}
+	// Our working directory still refers to the tree underneath.
+	return os.Chdir(this.Root)
+}
+
+func createMountPoint(path string) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		if os.IsExist(err) {
+			return nil
+		}
+		return err
+	}
+	return f.Close()
+}
+
+// / Bind |source| to |target| and make that read-only.
+func bindReadOnly(source, target string) error {
+	if err := syscall.Mount(source, target, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return err
+	}
+	// The remount has to keep the flags the kernel locked for the mount we
+	// inherited from the parent namespace, or it is refused.
+	flags := uintptr(syscall.MS_BIND | syscall.MS_REMOUNT | syscall.MS_RDONLY)
+	stat := syscall.Statfs_t{}
+	if err := syscall.Statfs(source, &stat); err == nil {
+		for st, ms := range map[int64]uintptr{
+			0x2:    syscall.MS_NOSUID,
+			0x4:    syscall.MS_NODEV,
+			0x8:    syscall.MS_NOEXEC,
+			0x400:  syscall.MS_NOATIME,
+			0x800:  syscall.MS_NODIRATIME,
+			0x1000: syscall.MS_RELATIME,
+		} {
+			if int64(stat.Flags)&st != 0 {
+				flags |= ms
+			}
+		}
+	}
+	return syscall.Mount("", target, "", flags, "")
+}
+
+// / Copy |source|, a file, symlink or directory, to |target|, replacing it.
+func copyTree(source, target string) error {
+	info, err := os.Lstat(source)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	switch {
+	case info.Mode()&os.ModeSymlink != 0:
+		link, err := os.Readlink(source)
+		if err != nil {
+			return err
+		}
+		os.RemoveAll(target)
+		return os.Symlink(link, target)
+	case info.IsDir():
+		if err := os.MkdirAll(target, info.Mode().Perm()); err != nil {
+			return err
+		}
+		entries, err := os.ReadDir(source)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if err := copyTree(filepath.Join(source, entry.Name()), filepath.Join(target, entry.Name())); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	data, err := os.ReadFile(source)
+	if err != nil {
+		return err
+	}
+	// Write next to the target and rename, so that nobody sees it half done.
+	tmp := target + ".ninja-sandbox"
+	if err := os.WriteFile(tmp, data, info.Mode().Perm()); err != nil {
+		return err
+	}
+	return os.Rename(tmp, target)
+}
+
+// / Guess which undeclared files a failed command was looking for: the paths
+// / mentioned in its |output| which exist in the real tree at |orig| but not
+// / in the sandbox.  Relative paths are also tried against the command's -I
+// / directories and the directories of its inputs, as compilers report
+// / includes the way they were written.
+func (this *SandboxSpec) FindUndeclaredInputs(orig, output string) []string {
+	bases := []string{"."}
+	words := strings.Fields(this.Command)
+	for i, word := range words {
+		for _, flag := range []string{"-I", "-isystem", "-iquote"} {
+			if dir, ok := strings.CutPrefix(word, flag); ok {
+				if dir == "" && i+1 < len(words) {
+					dir = words[i+1]
+				}
+				bases = append(bases, strings.Trim(dir, "'\""))
+			}
+		}
+	}
+	for _, input := range this.Inputs {
+		bases = append(bases, filepath.Dir(input))
+	}
+
+	found := []string{}
+	tokens := strings.FieldsFunc(output, func(r rune) bool {
+		return strings.ContainsRune(" \t\r\n'\"`‘’:;,()<>[]", r)
+	})
+	for _, token := range tokens {
+		if token == "." || token == ".." || strings.HasPrefix(token, "-") {
+			continue
+		}
+		for _, base := range bases {
+			path := filepath.Join(base, token)
+			if filepath.IsAbs(token) {
+				rel, err := filepath.Rel(this.Root, token)
+				if err != nil || strings.HasPrefix(rel, "..") {
+					break
+				}
+				path = rel
+			}
+			if slices.Contains(found, path) || slices.Contains(this.Outputs, path) {
+				continue
+			}
+			if _, err := os.Lstat(path); err == nil {
+				continue // Visible in the sandbox.
+			}
+			if _, err := os.Lstat(filepath.Join(orig, path)); err == nil {
+				found = append(found, path)
+			}
+		}
+	}
+	return found
+}
@@ -0,0 +1,19 @@
+//go:build windows
+
+package main
+
+import (
+	"errors"
+	"os/exec"
+)
+
+const kSandboxArgv0 = "ninja-sandbox"
+
+// / The sandbox relies on Linux namespaces.
+func SandboxCommand(spec *SandboxSpec) (*exec.Cmd, error) {
+	return nil, errors.New("the sandbox is not supported on Windows")
+}
+
+func SandboxMain(spec_path string) int {
+	return 1
+}
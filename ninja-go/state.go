@@ -57,15 +57,24 @@ func (this *Pool) DelayEdge(edge *Edge) {
 	if this.depth_ == 0 {
 		panic("this.depth_ == 0")
 	}
-	if !slices.Contains(this.delayed_, edge) {
-		this.delayed_ = append(this.delayed_, edge)
+	if slices.Contains(this.delayed_, edge) {
+		return
 	}
+	// Keep delayed_ sorted by priority, like the ready queue.
+	i := slices.IndexFunc(this.delayed_, func(e *Edge) bool { return EdgePriorityLess(e, edge) })
+	if i < 0 {
+		i = len(this.delayed_)
+	}
+	this.delayed_ = slices.Insert(this.delayed_, i, edge)
 }
 
 // / Pool will add zero or more edges to the ready_queue
 func (this *Pool) RetrieveReadyEdges(ready_queue EdgePriorityQueue) {
+	// Admit edges in priority order while their combined weight fits.  We
+	// stop at the first that doesn't rather than letting lighter edges
+	// overtake it, or a heavy edge could wait forever.
 	it := 0
-	for it := range this.delayed_ {
+	for it < len(this.delayed_) {
 		edge := this.delayed_[it]
 		if this.current_use_+edge.weight() > this.depth_ {
 			break
@@ -251,6 +260,78 @@ func (this *State) Reset() {
 	}
 }
 
+// / The parts of the graph that loading discovered deps and dyndep files
+// / adds to, as the manifest left them.  The daemon builds the same State
+// / again and again, and those are loaded anew by every build.
+type StateSnapshot struct {
+	edges_ []edgeSnapshot
+	nodes_ map[*Node]nodeSnapshot
+}
+
+type edgeSnapshot struct {
+	inputs_          []*Node
+	outputs_         []*Node
+	implicit_deps_   int
+	order_only_deps_ int
+	implicit_outs_   int
+}
+
+type nodeSnapshot struct {
+	in_edge_        *Edge
+	out_edges_      []*Edge
+	dyndep_pending_ bool
+}
+
+func (this *State) Snapshot() *StateSnapshot {
+	ret := StateSnapshot{nodes_: make(map[*Node]nodeSnapshot, len(this.paths_))}
+	for _, e := range this.edges_ {
+		ret.edges_ = append(ret.edges_, edgeSnapshot{
+			inputs_:          slices.Clone(e.inputs_),
+			outputs_:         slices.Clone(e.outputs_),
+			implicit_deps_:   e.implicit_deps_,
+			order_only_deps_: e.order_only_deps_,
+			implicit_outs_:   e.implicit_outs_,
+		})
+	}
+	for _, node := range this.paths_ {
+		ret.nodes_[node] = nodeSnapshot{node.in_edge_, slices.Clone(node.out_edges_), node.dyndep_pending_}
+	}
+	return &ret
+}
+
+// / Bring the graph back to |snapshot| and forget the state of the last
+// / build, like Reset(), but keep the digests and stat() results of the
+// / files: the daemon forgets those of the files that changed, and of the
+// / outputs that hash them, itself.
+func (this *State) Restore(snapshot *StateSnapshot) {
+	for i, e := range this.edges_ {
+		saved := snapshot.edges_[i]
+		e.inputs_ = slices.Clone(saved.inputs_)
+		e.outputs_ = slices.Clone(saved.outputs_)
+		e.implicit_deps_ = saved.implicit_deps_
+		e.order_only_deps_ = saved.order_only_deps_
+		e.implicit_outs_ = saved.implicit_outs_
+		e.outputs_ready_ = false
+		e.deps_loaded_ = false
+		e.deps_missing_ = false
+		e.mark_ = VisitNone
+		e.retries_ = 0
+		e.restat_digests_ = nil
+	}
+	for _, node := range this.paths_ {
+		// Nodes created since only come from deps.
+		saved := snapshot.nodes_[node]
+		node.in_edge_ = saved.in_edge_
+		node.out_edges_ = slices.Clone(saved.out_edges_)
+		node.dyndep_pending_ = saved.dyndep_pending_
+		node.dirty_ = false
+	}
+	for _, pool := range this.pools_ {
+		pool.current_use_ = 0
+		pool.delayed_ = nil
+	}
+}
+
 func (this *State) Dump() {
 	for _, second := range this.paths_ {
 		node := second
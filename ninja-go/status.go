@@ -4,7 +4,14 @@ type Status interface {
 	EdgeAddedToPlan(edge *Edge)
 	EdgeRemovedFromPlan(edge *Edge)
 	BuildEdgeStarted(edge *Edge, start_time_millis int64)
-	BuildEdgeFinished(edge *Edge, start_time_millis int64, end_time_millis int64, success bool, output string)
+	/// |return_code| is what the command exited with, or -1 if a signal
+	/// killed it.
+	BuildEdgeFinished(edge *Edge, start_time_millis int64, end_time_millis int64, exit_code ExitStatus, return_code int, output string)
+	/// Like BuildEdgeFinished, for a failed command that is queued to be run
+	/// again (see the "retries" binding).
+	BuildEdgeRetried(edge *Edge, start_time_millis int64, end_time_millis int64, exit_code ExitStatus, return_code int, output string)
+	/// The remote cache was asked for |output|, and had it or not.
+	CacheLookup(output string, hit bool)
 	BuildStarted()
 	BuildFinished()
 
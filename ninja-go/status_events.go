@@ -0,0 +1,269 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// / EventStatus reports the progress of a build as newline-delimited JSON,
+// / one object per event, for CI systems and IDEs to follow without parsing
+// / what StatusPrinter prints.  Every event has an "event" field naming it
+// / and a "time_ms" field, the milliseconds since the stream was opened.
+type EventStatus struct {
+	config_ *BuildConfig
+	start_  time.Time
+
+	/// Cache lookups may be reported from the goroutines of the scan.
+	mu_ sync.Mutex
+	w_  io.WriteCloser
+	/// Set once a write failed; the build goes on without the stream.
+	err_ error
+
+	explanations_ Explanations
+}
+
+// / Open the event stream at |path|: a Unix socket someone listens on, or
+// / else a file, which is created or truncated.
+func NewEventStatus(config *BuildConfig, path string) (*EventStatus, error) {
+	var w io.WriteCloser
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		conn, err := net.Dial("unix", path)
+		if err != nil {
+			return nil, err
+		}
+		w = conn
+	} else {
+		f, err := os.Create(path)
+		if err != nil {
+			return nil, err
+		}
+		w = f
+	}
+	ret := EventStatus{}
+	ret.config_ = config
+	ret.start_ = time.Now()
+	ret.w_ = w
+	return &ret, nil
+}
+
+func (this *EventStatus) emit(event string, fields map[string]any) {
+	this.mu_.Lock()
+	defer this.mu_.Unlock()
+	if this.err_ != nil {
+		return
+	}
+	if fields == nil {
+		fields = map[string]any{}
+	}
+	fields["event"] = event
+	fields["time_ms"] = time.Since(this.start_).Milliseconds()
+	data, err := json.Marshal(fields)
+	if err == nil {
+		_, err = this.w_.Write(append(data, '\n'))
+	}
+	if err != nil {
+		this.err_ = err
+		Warning("writing build events: %v", err)
+	}
+}
+
+// / The fields that identify |edge| in events.
+func edgeFields(edge *Edge) map[string]any {
+	outputs := []string{}
+	for _, o := range edge.outputs_ {
+		outputs = append(outputs, o.path())
+	}
+	return map[string]any{"id": edge.id_, "rule": edge.rule().name(), "outputs": outputs}
+}
+
+func exitStatusName(status ExitStatus) string {
+	switch status {
+	case ExitSuccess:
+		return "success"
+	case ExitInterrupted:
+		return "interrupted"
+	case ExitTimedOut:
+		return "timed_out"
+	}
+	return "failure"
+}
+
+func (this *EventStatus) EdgeAddedToPlan(edge *Edge) {
+	this.emit("edge_added", edgeFields(edge))
+}
+
+func (this *EventStatus) EdgeRemovedFromPlan(edge *Edge) {
+	this.emit("edge_removed", edgeFields(edge))
+}
+
+func (this *EventStatus) BuildEdgeStarted(edge *Edge, start_time_millis int64) {
+	if this.explanations_ != nil {
+		for _, output := range edge.outputs_ {
+			explanations := []string{}
+			this.explanations_.LookupAndAppend(output, &explanations)
+			for _, explanation := range explanations {
+				this.emit("explanation", map[string]any{"output": output.path(), "text": explanation})
+			}
+		}
+	}
+	fields := edgeFields(edge)
+	fields["command"] = edge.EvaluateCommand(false)
+	if description := edge.GetBinding("description"); description != "" {
+		fields["description"] = description
+	}
+	fields["start_ms"] = start_time_millis
+	this.emit("edge_started", fields)
+}
+
+func (this *EventStatus) BuildEdgeFinished(edge *Edge, start_time_millis int64, end_time_millis int64, exit_code ExitStatus, return_code int, output string) {
+	fields := edgeFields(edge)
+	fields["status"] = exitStatusName(exit_code)
+	fields["exit_code"] = return_code
+	fields["output"] = output
+	fields["start_ms"] = start_time_millis
+	fields["end_ms"] = end_time_millis
+	fields["duration_ms"] = end_time_millis - start_time_millis
+	this.emit("edge_finished", fields)
+}
+
+func (this *EventStatus) BuildEdgeRetried(edge *Edge, start_time_millis int64, end_time_millis int64, exit_code ExitStatus, return_code int, output string) {
+	fields := edgeFields(edge)
+	fields["status"] = exitStatusName(exit_code)
+	fields["exit_code"] = return_code
+	fields["output"] = output
+	fields["duration_ms"] = end_time_millis - start_time_millis
+	fields["retry"] = edge.retries_
+	fields["retries"] = edge.GetRetries()
+	this.emit("edge_retried", fields)
+}
+
+func (this *EventStatus) CacheLookup(output string, hit bool) {
+	this.emit("cache_lookup", map[string]any{"output": output, "hit": hit})
+}
+
+func (this *EventStatus) BuildStarted() {
+	this.emit("build_started", map[string]any{"parallelism": this.config_.Parallelism,
+		"dry_run": this.config_.DryRun})
+}
+
+func (this *EventStatus) BuildFinished() {
+	this.emit("build_finished", nil)
+}
+
+func (this *EventStatus) SetExplanations(explanations Explanations) {
+	this.explanations_ = explanations
+}
+
+func (this *EventStatus) Info(msg string, args ...interface{}) {
+	this.emit("info", map[string]any{"message": fmt.Sprintf(msg, args...)})
+}
+
+func (this *EventStatus) Warning(msg string, args ...interface{}) {
+	this.emit("warning", map[string]any{"message": fmt.Sprintf(msg, args...)})
+}
+
+func (this *EventStatus) Error(msg string, args ...interface{}) {
+	this.emit("error", map[string]any{"message": fmt.Sprintf(msg, args...)})
+}
+
+func (this *EventStatus) ReleaseStatus() {
+	this.mu_.Lock()
+	defer this.mu_.Unlock()
+	this.w_.Close()
+	this.err_ = os.ErrClosed
+}
+
+// / StatusFanout passes every call on to each of its statuses, so that the
+// / terminal and an event stream can follow the same build.
+type StatusFanout struct {
+	statuses_ []Status
+}
+
+func NewStatusFanout(statuses ...Status) *StatusFanout {
+	ret := StatusFanout{}
+	ret.statuses_ = statuses
+	return &ret
+}
+
+func (this *StatusFanout) EdgeAddedToPlan(edge *Edge) {
+	for _, status := range this.statuses_ {
+		status.EdgeAddedToPlan(edge)
+	}
+}
+
+func (this *StatusFanout) EdgeRemovedFromPlan(edge *Edge) {
+	for _, status := range this.statuses_ {
+		status.EdgeRemovedFromPlan(edge)
+	}
+}
+
+func (this *StatusFanout) BuildEdgeStarted(edge *Edge, start_time_millis int64) {
+	for _, status := range this.statuses_ {
+		status.BuildEdgeStarted(edge, start_time_millis)
+	}
+}
+
+func (this *StatusFanout) BuildEdgeFinished(edge *Edge, start_time_millis int64, end_time_millis int64, exit_code ExitStatus, return_code int, output string) {
+	for _, status := range this.statuses_ {
+		status.BuildEdgeFinished(edge, start_time_millis, end_time_millis, exit_code, return_code, output)
+	}
+}
+
+func (this *StatusFanout) BuildEdgeRetried(edge *Edge, start_time_millis int64, end_time_millis int64, exit_code ExitStatus, return_code int, output string) {
+	for _, status := range this.statuses_ {
+		status.BuildEdgeRetried(edge, start_time_millis, end_time_millis, exit_code, return_code, output)
+	}
+}
+
+func (this *StatusFanout) CacheLookup(output string, hit bool) {
+	for _, status := range this.statuses_ {
+		status.CacheLookup(output, hit)
+	}
+}
+
+func (this *StatusFanout) BuildStarted() {
+	for _, status := range this.statuses_ {
+		status.BuildStarted()
+	}
+}
+
+func (this *StatusFanout) BuildFinished() {
+	for _, status := range this.statuses_ {
+		status.BuildFinished()
+	}
+}
+
+func (this *StatusFanout) SetExplanations(explanations Explanations) {
+	for _, status := range this.statuses_ {
+		status.SetExplanations(explanations)
+	}
+}
+
+func (this *StatusFanout) Info(msg string, args ...interface{}) {
+	for _, status := range this.statuses_ {
+		status.Info(msg, args...)
+	}
+}
+
+func (this *StatusFanout) Warning(msg string, args ...interface{}) {
+	for _, status := range this.statuses_ {
+		status.Warning(msg, args...)
+	}
+}
+
+func (this *StatusFanout) Error(msg string, args ...interface{}) {
+	for _, status := range this.statuses_ {
+		status.Error(msg, args...)
+	}
+}
+
+func (this *StatusFanout) ReleaseStatus() {
+	for _, status := range this.statuses_ {
+		status.ReleaseStatus()
+	}
+}
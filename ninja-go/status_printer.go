@@ -119,7 +119,7 @@ func (this *StatusPrinter) BuildEdgeStarted(edge *Edge, start_time_millis int64)
 		this.printer_.SetConsoleLocked(true)
 	}
 }
-func (this *StatusPrinter) BuildEdgeFinished(edge *Edge, start_time_millis int64, end_time_millis int64, success bool, output string) {
+func (this *StatusPrinter) BuildEdgeFinished(edge *Edge, start_time_millis int64, end_time_millis int64, exit_code ExitStatus, return_code int, output string) {
 	this.time_millis_ = end_time_millis
 	this.finished_edges_++
 
@@ -149,20 +149,56 @@ func (this *StatusPrinter) BuildEdgeFinished(edge *Edge, start_time_millis int64
 	this.running_edges_--
 
 	// Print the command that is spewing before printing its output.
-	if !success {
-		outputs := ""
-		for _, o := range edge.outputs_ {
-			outputs += o.path() + " "
+	if exit_code != ExitSuccess {
+		failed := "FAILED: "
+		if exit_code == ExitTimedOut {
+			failed = fmt.Sprintf("TIMED OUT after %.1fs: ", float64(end_time_millis-start_time_millis)/1e3)
 		}
+		this.PrintEdgeHeading(edge, failed)
+	}
+	this.PrintEdgeOutput(output)
+}
 
-		if this.printer_.supports_color() {
-			this.printer_.PrintOnNewLine("\x1B[31m" + "FAILED: " + "\x1B[0m" + outputs + "\n")
-		} else {
-			this.printer_.PrintOnNewLine("FAILED: " + outputs + "\n")
-		}
-		this.printer_.PrintOnNewLine(edge.EvaluateCommand(false) + "\n")
+// / A failed command is about to be run again.  The edge will be started
+// / again, so it is only counted once in the progress status.
+func (this *StatusPrinter) BuildEdgeRetried(edge *Edge, start_time_millis int64, end_time_millis int64, exit_code ExitStatus, return_code int, output string) {
+	this.time_millis_ = end_time_millis
+	this.cpu_time_millis_ += end_time_millis - start_time_millis
+	this.started_edges_--
+	this.running_edges_--
+
+	if edge.use_console() {
+		this.printer_.SetConsoleLocked(false)
+	}
+	if this.config_.Verbosity == QUIET {
+		return
 	}
 
+	reason := "failed"
+	if exit_code == ExitTimedOut {
+		reason = "timed out"
+	}
+	this.PrintEdgeHeading(edge, fmt.Sprintf("RETRY %d/%d (%s): ", edge.retries_, edge.GetRetries(), reason))
+	this.PrintEdgeOutput(output)
+}
+
+// / Print |heading| in red followed by the edge's outputs and command line.
+func (this *StatusPrinter) PrintEdgeHeading(edge *Edge, heading string) {
+	outputs := ""
+	for _, o := range edge.outputs_ {
+		outputs += o.path() + " "
+	}
+
+	if this.printer_.supports_color() {
+		this.printer_.PrintOnNewLine("\x1B[31m" + heading + "\x1B[0m" + outputs + "\n")
+	} else {
+		this.printer_.PrintOnNewLine(heading + outputs + "\n")
+	}
+	this.printer_.PrintOnNewLine(edge.EvaluateCommand(false) + "\n")
+}
+
+// / Print the captured output of a command, if any.
+func (this *StatusPrinter) PrintEdgeOutput(output string) {
 	if output != "" {
 
 		// Fix extra CR being added on Windows, writing out CR CR LF (#773)
@@ -191,6 +227,8 @@ func (this *StatusPrinter) BuildEdgeFinished(edge *Edge, start_time_millis int64
 		//  this._setmode(_fileno(stdout), _O_TEXT);  // End Windows extra CR fix
 	}
 }
+func (this *StatusPrinter) CacheLookup(output string, hit bool) {}
+
 func (this *StatusPrinter) BuildStarted() {
 	this.started_edges_ = 0
 	this.finished_edges_ = 0
@@ -201,6 +239,8 @@ func (this *StatusPrinter) BuildFinished() {
 	this.printer_.PrintOnNewLine("")
 }
 
+func (this *StatusPrinter) ReleaseStatus() {}
+
 func (this *StatusPrinter) Info(msg string, args ...interface{}) {
 	Info(msg, args...)
 }
@@ -285,7 +325,7 @@ func (this *StatusPrinter) FormatProgressStatus(progress_status_format string, t
 					if this.finished_edges_ != 0 && this.total_edges_ != 0 {
 						percent = (100 * this.finished_edges_) / this.total_edges_
 					}
-					buf := fmt.Sprintf("%3i%%", percent)
+					buf := fmt.Sprintf("%3d%%", percent)
 					out.WriteString(buf)
 				}
 				// Wall time
@@ -339,12 +379,12 @@ func (this *StatusPrinter) FormatProgressStatus(progress_status_format string, t
 			// Percentage of time spent out of the predicted time total
 			case 'P':
 				{
-					buf := fmt.Sprintf("%3i%%", (int)(100.*this.time_predicted_percentage_))
+					buf := fmt.Sprintf("%3d%%", (int)(100.*this.time_predicted_percentage_))
 					out.WriteString(buf)
 				}
 
 			default:
-				log.Fatalln("unknown placeholder '%%%c' in $NINJA_STATUS", progress_status_format[s])
+				log.Fatalf("unknown placeholder '%%%c' in $NINJA_STATUS", progress_status_format[s])
 				return ""
 			}
 		} else {
@@ -361,11 +401,11 @@ func (this *StatusPrinter) SetExplanations(explanations Explanations) {
 }
 
 func (this *StatusPrinter) PrintStatus(edge *Edge, time_millis int64) {
-	if this.explanations_ != nil {
+	if this.explanations_ != nil && g_explaining {
 		// Collect all explanations for the current edge's outputs.
 		explanations := []string{}
 		for _, output := range edge.outputs_ {
-			this.explanations_.LookupAndAppend(output, explanations)
+			this.explanations_.LookupAndAppend(output, &explanations)
 		}
 		if len(explanations) != 0 {
 			// Start a new line so that the first explanation does not append to the
@@ -440,6 +480,14 @@ func (s *SlidingRateInfo) UpdateRate(update_hint int, time_millis int64) {
 	}
 }
 
-func Statusfactory(config *BuildConfig) Status {
-	return NewStatusPrinter(config)
+func Statusfactory(config *BuildConfig) (Status, error) {
+	printer := NewStatusPrinter(config)
+	if config.EventsPath == "" {
+		return printer, nil
+	}
+	events, err := NewEventStatus(config, config.EventsPath)
+	if err != nil {
+		return nil, fmt.Errorf("opening --events: %v", err)
+	}
+	return NewStatusFanout(printer, events), nil
 }
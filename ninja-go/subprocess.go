@@ -2,16 +2,42 @@ package main
 
 import (
 	"bytes"
-	"fmt"
-	"log"
 	"os"
 	"os/exec"
+	"os/signal"
 	"runtime"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
+// / Subprocess wraps a single async subprocess.  Its stdout and stderr are
+// / captured through one pipe into a per-process buffer, so the output of
+// / concurrent jobs is never interleaved.
 type Subprocess struct {
 	cmd         *exec.Cmd
 	use_console bool
+
+	/// Combined stdout and stderr of the child.
+	buf_ bytes.Buffer
+
+	/// Error from starting or waiting for the child.
+	err_ error
+
+	/// Whether the child has exited and buf_ holds all of its output.
+	exited_ bool
+
+	/// How long the child may run, 0 for no limit.
+	timeout_ time.Duration
+
+	/// Set by the watchdog once timeout_ elapsed and the child was terminated.
+	timed_out_ atomic.Bool
+
+	/// The sandbox to run the command in, if any.
+	sandbox_ *SandboxSpec
+
+	/// Where the tracer writes the files the command accessed, if traced.
+	trace_file_ string
 }
 
 func NewSubprocess(use_console bool) *Subprocess {
@@ -20,66 +46,103 @@ func NewSubprocess(use_console bool) *Subprocess {
 	return &ret
 }
 
-// https://github.com/go-cmd/cmd
 func (this *Subprocess) Start(set *SubprocessSet, command string) bool {
-	fmt.Println(command)
-	// command = strings.ReplaceAll(command, "\\", "/")
-	// fmt.Println(command)
-	//if true || this.use_console {
-	if runtime.GOOS == "windows" {
-		this.cmd = exec.Command("cmd") // , "/C", command
+	if this.sandbox_ != nil {
+		this.sandbox_.Command = command
+		this.sandbox_.TraceFile = this.trace_file_
+		cmd, err := SandboxCommand(this.sandbox_)
+		if err != nil {
+			this.err_ = err
+			this.buf_.WriteString("ninja: sandbox: " + err.Error() + "\n")
+			this.exited_ = true
+			return false
+		}
+		this.cmd = cmd
+	} else if this.trace_file_ != "" {
+		cmd, err := TracedCommand(command, this.trace_file_)
+		if err != nil {
+			this.err_ = err
+			this.buf_.WriteString("ninja: " + err.Error() + "\n")
+			this.exited_ = true
+			return false
+		}
+		this.cmd = cmd
+	} else if runtime.GOOS == "windows" {
+		// cmd.exe reads the command from stdin, which avoids its quoting rules.
+		this.cmd = exec.Command("cmd")
+		this.cmd.Stdin = bytes.NewBufferString(command + "\n")
 	} else {
-		this.cmd = exec.Command("bash") //
-	}
-	//} else {
-	//	arr := strings.Split(command, " ")
-	//	if len(arr) > 1 {
-	//		this.cmd = exec.Command(arr[0], arr[1:]...)
-	//	} else {
-	//		this.cmd = exec.Command(arr[0])
-	//	}
-	//}
-	buffer := bytes.Buffer{}
-	buffer.Write([]byte(command))
-	buffer.WriteString("\n")
-	this.cmd.Stdin = &buffer
-	//stdin, err := this.cmd.StdinPipe()
-	//if err != nil {
-	//	log.Fatalln(err)
-	//	return false
-	//}
-	// this.cmd.Stdout = os.Stdout
-	this.cmd.Stderr = os.Stderr
-	//this.cmd.Env = os.Environ()
-	err := this.cmd.Start()
-	if err != nil {
+		this.cmd = exec.Command("bash", "-c", command)
+	}
+	if this.use_console {
+		// Console jobs own the terminal; their output is not captured.
+		if this.cmd.Stdin == nil {
+			this.cmd.Stdin = os.Stdin
+		}
+		this.cmd.Stdout = os.Stdout
+		this.cmd.Stderr = os.Stderr
+	} else {
+		// Passing the same writer for both makes exec use a single pipe, which
+		// keeps stdout and stderr in the order the child wrote them.
+		this.cmd.Stdout = &this.buf_
+		this.cmd.Stderr = &this.buf_
+	}
+	this.SetProcessGroup()
+	if err := this.cmd.Start(); err != nil {
+		this.err_ = err
+		this.buf_.WriteString("ninja: failed to start command: " + err.Error() + "\n")
+		this.exited_ = true
 		return false
 	}
-	//Write to stdin
-	//_, err = stdin.Write([]byte(command + "\n"))
-	//if err != nil {
-	//	log.Fatalln(err)
-	//	return false
-	//}
-	//
-	//// Close stdin to signal the end of input
-	//stdin.Close()
 	return true
 }
 
+// / How long a timed out job gets to exit after being asked to before it is
+// / killed.
+const kJobKillGracePeriod = 5 * time.Second
+
+// / Terminate the child once timeout_ elapsed, and kill it if it is still
+// / running kJobKillGracePeriod later.  |exited| is closed once the child has
+// / been waited for.
+func (this *Subprocess) watchdog(exited chan struct{}) {
+	timer := time.NewTimer(this.timeout_)
+	defer timer.Stop()
+	select {
+	case <-exited:
+		return
+	case <-timer.C:
+	}
+	this.timed_out_.Store(true)
+	this.Terminate()
+	timer.Reset(kJobKillGracePeriod)
+	select {
+	case <-exited:
+	case <-timer.C:
+		this.Kill()
+	}
+}
+
 const CONTROL_C_EXIT = 0x00F00F00
 
+// / Returns ExitSuccess on successful process exit, ExitInterrupted if
+// / the process was interrupted, ExitTimedOut if it ran past its timeout,
+// / ExitFailure if it otherwise failed.
 func (this *Subprocess) Finish() ExitStatus {
-	if this.cmd == nil {
+	if this.cmd == nil || this.cmd.ProcessState == nil {
 		return ExitFailure
 	}
-	if this.cmd.ProcessState == nil {
-		err := this.cmd.Wait()
-		if err != nil {
-			log.Fatalf("cmd.Wait: %v", err)
+	if this.timed_out_.Load() {
+		return ExitTimedOut
+	}
+	state := this.cmd.ProcessState
+	if ws, ok := state.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		switch ws.Signal() {
+		case syscall.SIGINT, syscall.SIGTERM:
+			return ExitInterrupted
 		}
+		return ExitFailure
 	}
-	exit_code := this.cmd.ProcessState.ExitCode()
+	exit_code := state.ExitCode()
 	if exit_code == 0 {
 		return ExitSuccess
 	} else if exit_code == CONTROL_C_EXIT {
@@ -89,60 +152,111 @@ func (this *Subprocess) Finish() ExitStatus {
 	}
 }
 
+// / The child's exit code, or -1 if it didn't exit normally.
+func (this *Subprocess) ExitCode() int {
+	if this.cmd == nil || this.cmd.ProcessState == nil {
+		return -1
+	}
+	return this.cmd.ProcessState.ExitCode()
+}
+
 func (this *Subprocess) Done() bool {
-	return this.cmd.ProcessState.Exited()
+	return this.exited_
 }
 
 func (this *Subprocess) GetOutput() string {
-	buf, _ := this.cmd.CombinedOutput()
-	return string(buf)
+	return this.buf_.String()
 }
 
+// / SubprocessSet runs a set of subprocesses.  Each child is reaped by its own
+// / goroutine, which reports it on done_, so DoWork() returns as soon as any
+// / child exits rather than waiting for them in start order.
 type SubprocessSet struct {
 	running_  []*Subprocess
 	finished_ []*Subprocess // std::queue<Subprocess*>
+
+	/// Receives each child once cmd.Wait() returned.
+	done_ chan *Subprocess
+
+	/// Receives SIGINT/SIGTERM delivered to ninja while waiting.
+	interrupted_ chan os.Signal
 }
 
+// / Interrupts the build in progress as SIGINT would.  The daemon sends on it
+// / when its client went away.
+var g_interrupt_build = make(chan os.Signal, 1)
+
 // NewSubprocessSet creates a new SubprocessSet.
 func NewSubprocessSet() *SubprocessSet {
-	return &SubprocessSet{}
+	ret := SubprocessSet{}
+	ret.done_ = make(chan *Subprocess)
+	ret.interrupted_ = make(chan os.Signal, 1)
+	signal.Notify(ret.interrupted_, syscall.SIGINT, syscall.SIGTERM)
+	return &ret
 }
 
 func (this *SubprocessSet) NotifyInterrupted(dwCtrlType int) bool {
 	for _, task := range this.running_ {
-		err := task.cmd.Process.Signal(os.Interrupt)
-		if err != nil {
-			log.Fatalln(err)
-			continue
-		}
+		task.Interrupt()
 	}
 	return true
 }
 
-// Add adds a new subprocess to the set.
-func (this *SubprocessSet) Add(command string, useConsole bool) *Subprocess {
-	fmt.Printf("Add %s\n", command)
+// Add adds a new subprocess to the set.  A non-zero |timeout| bounds how
+// long it may run, a non-nil |sandbox| confines it, and a non-empty
+// |trace_file| traces the files it accesses into that file.
+func (this *SubprocessSet) Add(command string, useConsole bool, timeout time.Duration, sandbox *SandboxSpec, trace_file string) *Subprocess {
 	subprocess := NewSubprocess(useConsole)
-	if succ := subprocess.Start(this, command); succ {
-		this.running_ = append(this.running_, subprocess)
-	} else {
+	subprocess.timeout_ = timeout
+	subprocess.sandbox_ = sandbox
+	subprocess.trace_file_ = trace_file
+	if succ := subprocess.Start(this, command); !succ {
 		this.finished_ = append(this.finished_, subprocess)
+		return subprocess
 	}
+	this.running_ = append(this.running_, subprocess)
+	go func() {
+		exited := make(chan struct{})
+		if subprocess.timeout_ > 0 {
+			go subprocess.watchdog(exited)
+		}
+		subprocess.err_ = subprocess.cmd.Wait()
+		close(exited)
+		if subprocess.sandbox_ != nil {
+			subprocess.sandbox_.Cleanup()
+		}
+		subprocess.exited_ = true
+		this.done_ <- subprocess
+	}()
 	return subprocess
 }
 
+// / Block until a child exits or we are interrupted.  Returns true if
+// / interrupted (or if there is nothing left to wait for).
 func (this *SubprocessSet) DoWork() bool {
 	if len(this.running_) == 0 {
 		return true
 	}
-	subproc := this.running_[0]
-	err := subproc.cmd.Wait()
-	if err != nil {
-		log.Fatalln(err)
+	select {
+	case subproc := <-this.done_:
+		this.reap(subproc)
+		return false
+	case <-this.interrupted_:
+		return true
+	case <-g_interrupt_build:
+		return true
+	}
+}
+
+// / Move a child whose exit was received from done_ to finished_.
+func (this *SubprocessSet) reap(subproc *Subprocess) {
+	for i, s := range this.running_ {
+		if s == subproc {
+			this.running_ = append(this.running_[:i], this.running_[i+1:]...)
+			break
+		}
 	}
-	this.running_ = this.running_[1:]
 	this.finished_ = append(this.finished_, subproc)
-	return false
 }
 
 // NextFinished returns the next finished subprocess.
@@ -155,14 +269,14 @@ func (s *SubprocessSet) NextFinished() *Subprocess {
 	return subproc
 }
 
-// Clear clears the subprocess set.
+// Clear interrupts all running subprocesses and waits for them to exit.
 func (s *SubprocessSet) Clear() {
 	for _, sub := range s.running_ {
-		if sub.cmd.ProcessState == nil { //running
-			sub.cmd.Process.Signal(os.Interrupt)
-			//sub.cmd.Process.Kill()
-			sub.cmd.Wait()
-		}
+		sub.Interrupt()
+	}
+	for len(s.running_) != 0 {
+		s.reap(<-s.done_)
 	}
 	s.running_ = nil
+	s.finished_ = nil
 }
@@ -0,0 +1,49 @@
+//go:build linux
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// / Run the child in its own process group so that a timeout or an interrupt
+// / reaches everything it spawned.  Console jobs stay in ours so that they
+// / keep access to the terminal.
+func (this *Subprocess) SetProcessGroup() {
+	if !this.use_console {
+		if this.cmd.SysProcAttr == nil {
+			this.cmd.SysProcAttr = &syscall.SysProcAttr{}
+		}
+		this.cmd.SysProcAttr.Setpgid = true
+	}
+}
+
+func (this *Subprocess) signal(sig syscall.Signal) error {
+	if this.use_console {
+		return this.cmd.Process.Signal(sig)
+	}
+	return syscall.Kill(-this.cmd.Process.Pid, sig)
+}
+
+// / Ask the child's process group to exit (SIGTERM).
+func (this *Subprocess) Terminate() error { return this.signal(syscall.SIGTERM) }
+
+// / Kill the child's process group outright (SIGKILL).
+func (this *Subprocess) Kill() error { return this.signal(syscall.SIGKILL) }
+
+// / Forward an interrupt (SIGINT) to the child's process group.
+func (this *Subprocess) Interrupt() error { return this.signal(syscall.SIGINT) }
+
+// / The exit code with which a helper standing in for a child that exited
+// / with |status| should exit.  If the child was killed by a signal, the
+// / helper kills itself with it too, so that ninja sees e.g. the interrupt.
+func ExitCodeOf(status syscall.WaitStatus) int {
+	if status.Signaled() {
+		signal.Reset(status.Signal())
+		syscall.Kill(os.Getpid(), status.Signal())
+		return 128 + int(status.Signal())
+	}
+	return status.ExitStatus()
+}
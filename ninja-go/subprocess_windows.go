@@ -0,0 +1,36 @@
+//go:build windows
+
+package main
+
+import (
+	"os/exec"
+	"strconv"
+	"syscall"
+)
+
+// / Run the child in its own process group so that console Ctrl-C events
+// / aren't shared with ninja; we stop it through taskkill instead.
+func (this *Subprocess) SetProcessGroup() {
+	if !this.use_console {
+		this.cmd.SysProcAttr = &syscall.SysProcAttr{CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP}
+	}
+}
+
+// / taskkill /T walks the process tree, the closest Windows has to
+// / signalling a process group.
+func (this *Subprocess) taskkill(force bool) error {
+	args := []string{"/T", "/PID", strconv.Itoa(this.cmd.Process.Pid)}
+	if force {
+		args = append(args, "/F")
+	}
+	return exec.Command("taskkill", args...).Run()
+}
+
+// / Ask the child's process tree to exit.
+func (this *Subprocess) Terminate() error { return this.taskkill(false) }
+
+// / Kill the child's process tree outright.
+func (this *Subprocess) Kill() error { return this.taskkill(true) }
+
+// / Windows can't deliver an interrupt to another process, so kill it.
+func (this *Subprocess) Interrupt() error { return this.Kill() }
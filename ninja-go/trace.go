@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// / The files of the build tree a traced command opened, relative to it.
+// / A file it wrote is only listed in writes_, even if it read it too.
+type FileAccesses struct {
+	reads_  []string
+	writes_ []string
+}
+
+// / Whether |edge|'s command should run under the file access tracer: for
+// / --trace-access, or to discover its deps with "deps = trace".
+func (this *Edge) UseTracing(config *BuildConfig) bool {
+	if this.is_phony() || this.use_console() {
+		return false
+	}
+	return config.TraceAccess || this.GetBinding("deps") == "trace"
+}
+
+// / Record an access to |path|, as seen by a tracee, if it lies in the
+// / build tree |root|.
+func RecordAccess(accesses map[string]bool, root, path string, write bool) {
+	rel, err := filepath.Rel(root, filepath.Clean(path))
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, "../") {
+		return
+	}
+	accesses[rel] = accesses[rel] || write
+}
+
+// / Write the accesses gathered by RecordAccess() to |path|, one per line,
+// / prefixed with R or W.
+func SaveAccesses(path string, accesses map[string]bool) error {
+	paths := []string{}
+	for p := range accesses {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, p := range paths {
+		mode := "R"
+		if accesses[p] {
+			mode = "W"
+		}
+		fmt.Fprintf(w, "%s %s\n", mode, p)
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func LoadAccesses(path string) (*FileAccesses, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	ret := FileAccesses{}
+	for _, line := range strings.Split(string(data), "\n") {
+		if p, ok := strings.CutPrefix(line, "R "); ok {
+			ret.reads_ = append(ret.reads_, p)
+		} else if p, ok := strings.CutPrefix(line, "W "); ok {
+			ret.writes_ = append(ret.writes_, p)
+		}
+	}
+	return &ret, nil
+}
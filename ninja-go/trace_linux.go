@@ -0,0 +1,247 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+// / argv[0] with which we re-execute ourselves to trace a command.
+const kTraceArgv0 = "ninja-trace"
+
+// / A system call the tracer looks at, and which of its arguments hold what.
+// / -1 marks an argument the call doesn't have.
+type tracedSyscall struct {
+	dirfd_ int
+	path_  int
+	/// Index of the open flags, or of the struct open_how for openat2.
+	flags_    int
+	open_how_ bool
+	/// Whether a successful call writes |path_|, whatever the flags.
+	write_ bool
+}
+
+// / Build the command that runs |command| under the tracer, which writes the
+// / files it accessed to |accesses_path|.  The tracer is a re-executed ninja,
+// / so that it can wait for any of its children without stealing ours.
+func TracedCommand(command, accesses_path string) (*exec.Cmd, error) {
+	cmd := exec.Command("/proc/self/exe", accesses_path, command)
+	cmd.Args[0] = kTraceArgv0
+	return cmd, nil
+}
+
+// / The entry point of a re-executed ninja tracing |command|.  Returns the
+// / exit code.
+func TraceMain(accesses_path, command string) int {
+	root, err := os.Getwd()
+	if err == nil {
+		// The paths we trace are resolved through /proc/<pid>/cwd, which
+		// has no symlinks; neither must the root they are checked against.
+		root, err = filepath.EvalSymlinks(root)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ninja: trace: %v\n", err)
+		return 1
+	}
+	cmd := exec.Command("bash", "-c", command)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	status, accesses, err := TraceCommand(cmd, root)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ninja: trace: %v\n", err)
+		return 1
+	}
+	if err := SaveAccesses(accesses_path, accesses); err != nil {
+		fmt.Fprintf(os.Stderr, "ninja: trace: %v\n", err)
+		return 1
+	}
+	return ExitCodeOf(status)
+}
+
+// / PTRACE_GET_SYSCALL_INFO, which tells syscall entries and exits apart on
+// / every architecture (Linux 5.3).
+const kPtraceGetSyscallInfo = 0x420e
+
+const (
+	kPtraceSyscallInfoEntry = 1
+	kPtraceSyscallInfoExit  = 2
+)
+
+// / An access seen at a syscall entry, recorded once the call succeeded.
+type pendingAccess struct {
+	path_  string
+	write_ bool
+}
+
+// / Run |cmd| under ptrace, following every process it forks, and gather the
+// / files of the build tree |root| it opened successfully.  Only call this
+// / in a process that has no other children, as it waits for any child.
+func TraceCommand(cmd *exec.Cmd, root string) (syscall.WaitStatus, map[string]bool, error) {
+	accesses := map[string]bool{}
+	if len(kTracedSyscalls) == 0 {
+		return 0, nil, errors.New("tracing is not supported on " + runtime.GOARCH)
+	}
+
+	// Every ptrace request has to come from the thread that started the
+	// tracee.
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Ptrace = true
+	if err := cmd.Start(); err != nil {
+		return 0, nil, err
+	}
+	pid := cmd.Process.Pid
+
+	// The child stops once it exec'd.
+	var ws syscall.WaitStatus
+	if _, err := syscall.Wait4(pid, &ws, syscall.WALL, nil); err != nil {
+		return 0, nil, err
+	}
+	const options = syscall.PTRACE_O_TRACESYSGOOD | syscall.PTRACE_O_TRACEFORK |
+		syscall.PTRACE_O_TRACEVFORK | syscall.PTRACE_O_TRACECLONE |
+		syscall.PTRACE_O_TRACEEXEC | 0x100000 // PTRACE_O_EXITKILL
+	if err := syscall.PtraceSetOptions(pid, options); err != nil {
+		cmd.Process.Kill()
+		return 0, nil, err
+	}
+	syscall.PtraceSyscall(pid, 0)
+
+	var status syscall.WaitStatus
+	pending := map[int]*pendingAccess{}
+	known := map[int]bool{pid: true}
+	for {
+		wpid, err := syscall.Wait4(-1, &ws, syscall.WALL, nil)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			break // ECHILD: everything exited.
+		}
+		if ws.Exited() || ws.Signaled() {
+			delete(pending, wpid)
+			delete(known, wpid)
+			if wpid == pid {
+				status = ws
+			}
+			continue
+		}
+		if !ws.Stopped() {
+			continue
+		}
+		sig := ws.StopSignal()
+		switch {
+		case sig == syscall.SIGTRAP|0x80:
+			traceSyscall(wpid, root, pending, accesses)
+			sig = 0
+		case sig == syscall.SIGTRAP && ws.TrapCause() > 0:
+			// A fork, clone or exec event.
+			sig = 0
+		case sig == syscall.SIGSTOP && !known[wpid]:
+			// New tracees start with a SIGSTOP.
+			sig = 0
+		}
+		known[wpid] = true
+		syscall.PtraceSyscall(wpid, int(sig))
+	}
+	// Let exec finish copying output, if it set up pipes for it.
+	cmd.Wait()
+	return status, accesses, nil
+}
+
+// / Handle a syscall-stop of |pid|: note the path of a traced call at its
+// / entry, and record it in |accesses| if the call succeeded.
+func traceSyscall(pid int, root string, pending map[int]*pendingAccess, accesses map[string]bool) {
+	var info [88]byte
+	_, _, errno := syscall.Syscall6(syscall.SYS_PTRACE, kPtraceGetSyscallInfo, uintptr(pid),
+		uintptr(len(info)), uintptr(unsafe.Pointer(&info[0])), 0, 0)
+	if errno != 0 {
+		return
+	}
+	word := func(offset int) uint64 { return binary.LittleEndian.Uint64(info[offset:]) }
+	switch info[0] {
+	case kPtraceSyscallInfoEntry:
+		delete(pending, pid)
+		call, ok := kTracedSyscalls[word(24)]
+		if !ok {
+			return
+		}
+		arg := func(i int) uint64 { return word(32 + 8*i) }
+		path, ok := readTraceeString(pid, uintptr(arg(call.path_)))
+		if !ok || path == "" {
+			return
+		}
+		dirfd := -100 // AT_FDCWD
+		if call.dirfd_ >= 0 {
+			dirfd = int(int32(arg(call.dirfd_)))
+		}
+		if path[0] != '/' {
+			dir := "cwd"
+			if dirfd != -100 {
+				dir = "fd/" + strconv.Itoa(dirfd)
+			}
+			base, err := os.Readlink("/proc/" + strconv.Itoa(pid) + "/" + dir)
+			if err != nil {
+				return
+			}
+			path = base + "/" + path
+		}
+		write := call.write_
+		if call.flags_ >= 0 {
+			flags := arg(call.flags_)
+			if call.open_how_ {
+				var how [8]byte
+				if n, err := syscall.PtracePeekData(pid, uintptr(flags), how[:]); err != nil || n != 8 {
+					return
+				}
+				flags = binary.LittleEndian.Uint64(how[:])
+			}
+			if flags&syscall.O_DIRECTORY != 0 {
+				return
+			}
+			write = flags&syscall.O_ACCMODE != syscall.O_RDONLY ||
+				flags&(syscall.O_CREAT|syscall.O_TRUNC) != 0
+		}
+		pending[pid] = &pendingAccess{path_: path, write_: write}
+	case kPtraceSyscallInfoExit:
+		access := pending[pid]
+		delete(pending, pid)
+		rval := int64(word(24))
+		if access != nil && rval >= 0 {
+			RecordAccess(accesses, root, access.path_, access.write_)
+		}
+	}
+}
+
+// / Read a NUL-terminated string from the memory of |pid|.
+func readTraceeString(pid int, addr uintptr) (string, bool) {
+	buf := []byte{}
+	chunk := make([]byte, 64)
+	for len(buf) < 4096 {
+		// This may fail past the end of a mapping, after the string ended.
+		n, err := syscall.PtracePeekData(pid, addr+uintptr(len(buf)), chunk)
+		for i := 0; i < n; i++ {
+			if chunk[i] == 0 {
+				return string(append(buf, chunk[:i]...)), true
+			}
+		}
+		if err != nil || n == 0 {
+			return "", false
+		}
+		buf = append(buf, chunk[:n]...)
+	}
+	return "", false
+}
@@ -0,0 +1,13 @@
+//go:build linux && amd64
+
+package main
+
+var kTracedSyscalls = map[uint64]tracedSyscall{
+	2:   {dirfd_: -1, path_: 0, flags_: 1},                 // open
+	85:  {dirfd_: -1, path_: 0, flags_: -1, write_: true},  // creat
+	257: {dirfd_: 0, path_: 1, flags_: 2},                  // openat
+	437: {dirfd_: 0, path_: 1, flags_: 2, open_how_: true}, // openat2
+	82:  {dirfd_: -1, path_: 1, flags_: -1, write_: true},  // rename
+	264: {dirfd_: 2, path_: 3, flags_: -1, write_: true},   // renameat
+	316: {dirfd_: 2, path_: 3, flags_: -1, write_: true},   // renameat2
+}
@@ -0,0 +1,10 @@
+//go:build linux && arm64
+
+package main
+
+var kTracedSyscalls = map[uint64]tracedSyscall{
+	56:  {dirfd_: 0, path_: 1, flags_: 2},                  // openat
+	437: {dirfd_: 0, path_: 1, flags_: 2, open_how_: true}, // openat2
+	38:  {dirfd_: 2, path_: 3, flags_: -1, write_: true},   // renameat
+	276: {dirfd_: 2, path_: 3, flags_: -1, write_: true},   // renameat2
+}
@@ -0,0 +1,6 @@
+//go:build linux && !amd64 && !arm64
+
+package main
+
+// / We only know the system call numbers of amd64 and arm64.
+var kTracedSyscalls = map[uint64]tracedSyscall{}
@@ -0,0 +1,19 @@
+//go:build windows
+
+package main
+
+import (
+	"errors"
+	"os/exec"
+)
+
+const kTraceArgv0 = "ninja-trace"
+
+// / The tracer relies on ptrace.
+func TracedCommand(command, accesses_path string) (*exec.Cmd, error) {
+	return nil, errors.New("file access tracing is not supported on Windows")
+}
+
+func TraceMain(accesses_path, command string) int {
+	return 1
+}
@@ -0,0 +1,67 @@
+//go:build linux
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// / How long the tree has to be quiet after a change before we rebuild, so
+// / that an editor saving several files, or one file in several steps,
+// / causes a single build.
+const kWatchDebounce = 100 * time.Millisecond
+
+// / Build |targets| and again whenever a source changes, until interrupted.
+// / The graph stays loaded in between, as in the daemon, so only the files
+// / that changed are hashed again.  Returns the exit code.
+func WatchMain(ninja_command string, options *Options, config *BuildConfig, targets []string) int {
+	interrupted := make(chan os.Signal, 1)
+	signal.Notify(interrupted, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(interrupted)
+
+	watch := Daemon{ninja_command_: ninja_command, options_: options, config_: config,
+		debug_: saveDebugFlags()}
+	for {
+		// A fresh status for every build, which counts its edges anew.
+		status, err := Statusfactory(config)
+		if err != nil {
+			Error("%v", err)
+			return 1
+		}
+		watch.Build(targets, status)
+		select {
+		case <-interrupted:
+			status.ReleaseStatus()
+			return 130
+		default:
+		}
+		if watch.watcher_ == nil {
+			status.ReleaseStatus()
+			return 1
+		}
+
+		status.Info("waiting for changes, press Ctrl-C to stop")
+		source_changed := false
+		for {
+			select {
+			case <-interrupted:
+				status.ReleaseStatus()
+				return 130
+			default:
+			}
+			if watch.watcher_.Wait(kWatchDebounce) {
+				if watch.Sync() {
+					source_changed = true
+				}
+				continue
+			}
+			if source_changed {
+				break
+			}
+		}
+		status.ReleaseStatus()
+	}
+}
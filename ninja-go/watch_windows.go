@@ -0,0 +1,9 @@
+//go:build windows
+
+package main
+
+// / Watching relies on inotify.
+func WatchMain(ninja_command string, options *Options, config *BuildConfig, targets []string) int {
+	Error("-t watch is not supported on Windows")
+	return 1
+}
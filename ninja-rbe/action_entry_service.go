@@ -0,0 +1,100 @@
+package main
+
+import (
+	"gorm.io/gorm"
+	"ninja-build-go/model"
+	"os"
+	"time"
+)
+
+// SaveActionEntry records |entry|, replacing what was recorded for its key.
+func SaveActionEntry(entry *model.ActionEntry) error {
+	return DB.Transaction(func(tx *gorm.DB) error {
+		var ids []int64
+		if err := tx.Model(&model.ActionEntry{}).Where("`key`=?", entry.Key).
+			Pluck("id", &ids).Error; err != nil {
+			return err
+		}
+		if err := deleteActions(tx, ids); err != nil {
+			return err
+		}
+		outputs, deps := entry.Outputs, entry.Deps
+		entry.Outputs, entry.Deps = nil, nil
+		if err := tx.Create(entry).Error; err != nil {
+			return err
+		}
+		entry.Outputs, entry.Deps = outputs, deps
+		if len(outputs) > 0 {
+			for i := range outputs {
+				outputs[i].PID = entry.ID
+			}
+			if err := tx.Create(&outputs).Error; err != nil {
+				return err
+			}
+		}
+		if len(deps) == 0 {
+			return nil
+		}
+		for i := range deps {
+			deps[i].PID = entry.ID
+		}
+		return tx.Create(&deps).Error
+	})
+}
+
+// FindActionEntry returns the record for |key|, or os.ErrNotExist.
+func FindActionEntry(key string) (*model.ActionEntry, error) {
+	var items []*model.ActionEntry
+	if err := DB.Preload("Outputs").Preload("Deps").Where("`key`=?", key).Limit(1).Find(&items).Error; err != nil {
+		return nil, err
+	}
+	if len(items) == 0 {
+		return nil, os.ErrNotExist
+	}
+	return items[0], nil
+}
+
+func UpdateActionAccess(id int64) error {
+	return DB.Model(&model.ActionEntry{}).Where("`id`=?", id).
+		Update("last_access", time.Now().Unix()).Error
+}
+
+func FindExpiredActionsWithLimit(limit int) ([]int64, error) {
+	var ids []int64
+	now := time.Now().Unix()
+	if err := DB.Model(&model.ActionEntry{}).Where("`last_access`+`expired_duration` < ?", now).
+		Limit(limit).Pluck("id", &ids).Error; err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+func DeleteActions(ids []int64) error {
+	return DB.Transaction(func(tx *gorm.DB) error {
+		return deleteActions(tx, ids)
+	})
+}
+
+func deleteActions(tx *gorm.DB, ids []int64) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	if err := tx.Where("`pid` in ?", ids).Delete(&model.OutputEntry{}).Error; err != nil {
+		return err
+	}
+	if err := tx.Unscoped().Where("`pid` in ?", ids).Delete(&model.DepsEntry{}).Error; err != nil {
+		return err
+	}
+	return tx.Delete(&model.ActionEntry{}, ids).Error
+}
+
+// CountBlobReferences tells how many action outputs have the contents
+// |digest|.
+func CountBlobReferences(digest string) (int64, error) {
+	var cnt int64 = 0
+	if err := DB.Model(&model.OutputEntry{}).Where("`digest`=?", digest).
+		Count(&cnt).Error; err != nil {
+		return 0, err
+	}
+	return cnt, nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/zeebo/blake3"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var errDigestMismatch = errors.New("contents don't match the digest")
+
+// IsDigest tells whether |digest| is a hex blake3 digest, the address of a
+// blob in the CAS.
+func IsDigest(digest string) bool {
+	if len(digest) != 2*32 {
+		return false
+	}
+	_, err := hex.DecodeString(digest)
+	return err == nil
+}
+
+// BlobPath is where the blob |digest| is stored, spread over directories by
+// its first byte.
+func BlobPath(digest string) string {
+	return filepath.Join(fsRootDir, "cas", digest[:2], digest)
+}
+
+// BlobSize returns the size of the blob |digest|, or false if we don't have
+// it.
+func BlobSize(digest string) (int64, bool) {
+	info, err := os.Stat(BlobPath(digest))
+	if err != nil {
+		return 0, false
+	}
+	return info.Size(), true
+}
+
+// TouchBlob tells whether we have the blob |digest|, and if so renews its
+// modification time, which CleanUnreferencedBlobs counts the grace period
+// from.
+func TouchBlob(digest string) bool {
+	now := time.Now()
+	return os.Chtimes(BlobPath(digest), now, now) == nil
+}
+
+// SaveBlob stores |data| as the blob |digest|, checking that it is its
+// digest.  Identical contents are only stored once.
+func SaveBlob(digest string, data []byte) error {
+	sum := blake3.Sum256(data)
+	if hex.EncodeToString(sum[:]) != digest {
+		return errDigestMismatch
+	}
+	if TouchBlob(digest) {
+		return nil
+	}
+	path := BlobPath(digest)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	// Write next to the blob and rename, so that readers never see it half
+	// written.
+	tmp, err := os.CreateTemp(filepath.Dir(path), digest+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err1 := tmp.Close(); err == nil {
+		err = err1
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("storing blob %s: %v", digest, err)
+	}
+	return nil
+}
+
+// CleanUnreferencedBlobs removes the blobs no action output refers to any
+// more.  Blobs stored or touched less than |grace| ago are kept: they may
+// have been uploaded for an action that is not recorded yet.  So are the
+// inputs of the jobs that haven't finished, however long they queue.
+func CleanUnreferencedBlobs(grace time.Duration) error {
+	root := filepath.Join(fsRootDir, "cas")
+	inputs := ExecInputDigests()
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() || time.Since(info.ModTime()) < grace {
+			return nil
+		}
+		digest := info.Name()
+		if !IsDigest(digest) {
+			// A leftover of a failed upload.
+			return os.Remove(path)
+		}
+		if inputs[digest] {
+			return nil
+		}
+		cnt, err := CountBlobReferences(digest)
+		if err != nil {
+			return err
+		}
+		if cnt == 0 {
+			return os.Remove(path)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/valyala/fasthttp"
+	"sync"
+	"time"
+)
+
+// ExecInput is a file of a job's input tree, whose contents are in the CAS.
+type ExecInput struct {
+	// 相对于输入根目录的路径
+	Path       string `json:"path"`
+	Digest     string `json:"digest"`
+	Executable bool   `json:"executable"`
+}
+
+// ExecJob is a command to run remotely, submitted by ninja and run by a
+// worker once it materialized the input tree in a scratch directory.
+type ExecJob struct {
+	ID      string `json:"id"`
+	Command string `json:"command"`
+	// 执行命令的目录，相对于输入根目录
+	WorkingDirectory string       `json:"working_directory"`
+	Inputs           []*ExecInput `json:"inputs"`
+	// 输出文件，相对于执行目录
+	Outputs   []string `json:"outputs"`
+	TimeoutMs int64    `json:"timeout_ms"`
+}
+
+// ExecOutput is an output a job left, uploaded to the CAS by the worker.
+type ExecOutput struct {
+	Path       string `json:"path"`
+	Digest     string `json:"digest"`
+	Size       int64  `json:"size"`
+	Executable bool   `json:"executable"`
+}
+
+type ExecResult struct {
+	ExitCode int           `json:"exit_code"`
+	TimedOut bool          `json:"timed_out"`
+	Output   string        `json:"output"`
+	Outputs  []*ExecOutput `json:"outputs"`
+	// 任务没能执行的原因，比如 worker 丢失
+	Error string `json:"error"`
+}
+
+// How long a worker may keep a job without a timeout before we consider it
+// lost, and how long the long polls of clients and workers wait.
+const execLease = time.Hour
+const execPollWait = 30 * time.Second
+
+type execState struct {
+	job     *ExecJob
+	result  *ExecResult
+	done    chan struct{}
+	takenAt time.Time
+}
+
+var (
+	execMu    sync.Mutex
+	execJobs  = map[string]*execState{}
+	execQueue = make(chan *execState, 1<<16)
+)
+
+func pollWait(ctx *fasthttp.RequestCtx) time.Duration {
+	wait, err := time.ParseDuration(string(ctx.QueryArgs().Peek("wait")))
+	if err != nil || wait > execPollWait {
+		return execPollWait
+	}
+	return wait
+}
+
+func sendJson(ctx *fasthttp.RequestCtx, v any) {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		ctx.Error(err.Error(), fasthttp.StatusInternalServerError)
+		return
+	}
+	ctx.Success("application/json", buf)
+}
+
+// HandleExec serves the clients: POST /exec/ queues a job and returns its
+// id, GET /exec/<id> waits for its result and DELETE /exec/<id> drops it.
+func HandleExec(ctx *fasthttp.RequestCtx, id string) {
+	switch {
+	case ctx.IsPost() && id == "":
+		var job ExecJob
+		if err := json.Unmarshal(ctx.PostBody(), &job); err != nil {
+			ctx.Error(err.Error(), fasthttp.StatusBadRequest)
+			return
+		}
+		for _, input := range job.Inputs {
+			if !IsDigest(input.Digest) {
+				ctx.Error("bad digest for "+input.Path, fasthttp.StatusBadRequest)
+				return
+			}
+			// Renewed so that the cleanup keeps it until the job is in
+			// execJobs, where ExecInputDigests finds it.
+			if !TouchBlob(input.Digest) {
+				ctx.Error("missing blob for "+input.Path, fasthttp.StatusBadRequest)
+				return
+			}
+		}
+		job.ID = uuid.NewString()
+		state := &execState{job: &job, done: make(chan struct{})}
+		execMu.Lock()
+		execJobs[job.ID] = state
+		execMu.Unlock()
+		select {
+		case execQueue <- state:
+		default:
+			execMu.Lock()
+			delete(execJobs, job.ID)
+			execMu.Unlock()
+			ctx.Error("queue full", fasthttp.StatusServiceUnavailable)
+			return
+		}
+		sendJson(ctx, map[string]string{"id": job.ID})
+	case ctx.IsGet():
+		execMu.Lock()
+		state, ok := execJobs[id]
+		execMu.Unlock()
+		if !ok {
+			ctx.Error("not found", fasthttp.StatusNotFound)
+			return
+		}
+		select {
+		case <-state.done:
+		case <-time.After(pollWait(ctx)):
+			if !expireJob(state) {
+				ctx.SetStatusCode(fasthttp.StatusNoContent)
+				return
+			}
+		}
+		execMu.Lock()
+		delete(execJobs, id)
+		execMu.Unlock()
+		sendJson(ctx, state.result)
+	case ctx.IsDelete():
+		execMu.Lock()
+		delete(execJobs, id)
+		execMu.Unlock()
+	default:
+		ctx.Error("method not allowed", fasthttp.StatusMethodNotAllowed)
+	}
+}
+
+// ExecInputDigests returns the digests of the inputs of the jobs that
+// haven't finished, which a worker may still have to fetch.
+func ExecInputDigests() map[string]bool {
+	execMu.Lock()
+	defer execMu.Unlock()
+	digests := map[string]bool{}
+	for _, state := range execJobs {
+		if state.result != nil {
+			continue
+		}
+		for _, input := range state.job.Inputs {
+			digests[input.Digest] = true
+		}
+	}
+	return digests
+}
+
+// expireJob fails |state| if the worker that took it ran past its timeout,
+// or past execLease without one, by a margin: the worker must be gone.
+func expireJob(state *execState) bool {
+	execMu.Lock()
+	defer execMu.Unlock()
+	if state.result != nil {
+		return true
+	}
+	lease := execLease
+	if state.job.TimeoutMs > 0 {
+		lease = time.Duration(state.job.TimeoutMs)*time.Millisecond + execPollWait
+	}
+	if state.takenAt.IsZero() || time.Since(state.takenAt) < lease {
+		return false
+	}
+	state.result = &ExecResult{ExitCode: -1, Error: "worker lost"}
+	close(state.done)
+	return true
+}
+
+// HandleJobs serves the workers: POST /jobs/ waits for a job to run and
+// PUT /jobs/<id> reports its result.
+func HandleJobs(ctx *fasthttp.RequestCtx, id string) {
+	switch {
+	case ctx.IsPost() && id == "":
+		timeout := time.After(pollWait(ctx))
+		for {
+			select {
+			case state := <-execQueue:
+				execMu.Lock()
+				_, ok := execJobs[state.job.ID]
+				if ok {
+					state.takenAt = time.Now()
+				}
+				execMu.Unlock()
+				if !ok {
+					// Dropped by its client.
+					continue
+				}
+				sendJson(ctx, state.job)
+				return
+			case <-timeout:
+				ctx.SetStatusCode(fasthttp.StatusNoContent)
+				return
+			}
+		}
+	case ctx.IsPut():
+		var result ExecResult
+		if err := json.Unmarshal(ctx.PostBody(), &result); err != nil {
+			ctx.Error(err.Error(), fasthttp.StatusBadRequest)
+			return
+		}
+		execMu.Lock()
+		defer execMu.Unlock()
+		state, ok := execJobs[id]
+		if !ok || state.result != nil {
+			ctx.Error(fmt.Sprintf("no job %s", id), fasthttp.StatusNotFound)
+			return
+		}
+		state.result = &result
+		close(state.done)
+	default:
+		ctx.Error("method not allowed", fasthttp.StatusMethodNotAllowed)
+	}
+}
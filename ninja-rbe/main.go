@@ -8,6 +8,7 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
+	"runtime"
 	"time"
 )
 
@@ -19,6 +20,10 @@ var (
 	dir                = flag.String("dir", "html", "Directory to serve static files from")
 	generateIndexPages = flag.Bool("generateIndexPages", true, "Whether to generate directory index pages")
 	vhost              = flag.Bool("vhost", false, "Enables virtual hosting by prepending the requested path with the requested hostname")
+	worker             = flag.Bool("worker", false, "Run the jobs of the server given by -server rather than serving")
+	server             = flag.String("server", "http://localhost:8080", "Server whose jobs a worker runs")
+	jobs               = flag.Int("jobs", runtime.NumCPU(), "How many jobs a worker runs at once")
+	scratch            = flag.String("scratch", filepath.Join(os.TempDir(), "ninja-worker"), "Directory a worker runs jobs and caches their inputs in")
 )
 
 func shutdown(ctx context.Context) {
@@ -33,6 +38,14 @@ func shutdown(ctx context.Context) {
 func main() {
 	// Parse command-line flags.
 	flag.Parse()
+	if *worker {
+		RunWorker(*server, *scratch, *jobs)
+		sigch := make(chan os.Signal, 1)
+		signal.Notify(sigch, os.Interrupt)
+		<-sigch
+		fmt.Println("Interrupted. Exiting.")
+		return
+	}
 	dbPath := filepath.Join(filepath.Dir(os.Args[0]), *dbName)
 	err := OpenDb(dbPath)
 	if err != nil {
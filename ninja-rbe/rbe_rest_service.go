@@ -1,16 +1,13 @@
 package main
 
 import (
-	"cmp"
-	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/valyala/fasthttp"
-	"github.com/zeebo/blake3"
 	"log"
 	"ninja-build-go/model"
-	"path/filepath"
-	"slices"
+	"os"
 	"strings"
 	"time"
 )
@@ -33,108 +30,108 @@ var (
 	fsServer  *fasthttp.Server
 )
 
-func ParseLogEntry(ctx *fasthttp.RequestCtx) (*model.RbeLogEntry, error) {
-	body := ctx.FormValue("body")
-	base64Buf := make([]byte, base64.StdEncoding.DecodedLen(len(body)))
-	_, err := base64.StdEncoding.Decode(base64Buf, body)
-	if err != nil {
-		return nil, err
-	}
-	var entry model.RbeLogEntry
-	err = json.Unmarshal(base64Buf, &entry)
-	if err != nil {
-		return nil, err
-	}
-	expired_duration_str := string(ctx.FormValue("expired_duration"))
-	expired_duration := 5 * time.Minute
-	if expired_duration_str != "" {
-		expired_duration, _ = time.ParseDuration(expired_duration_str)
-	}
-	now := time.Now()
-	created_at := now.Unix()
-	last_access := created_at
-	entry.CreatedAt = created_at
-	entry.LastAccess = last_access
-	entry.ExpiredDuration = int64(expired_duration)
-	return &entry, nil
-}
-
-func HashEntry(entry *model.RbeLogEntry) string {
-	h := blake3.New()
-	h.WriteString(fmt.Sprintf("n:%s,%s,%s, %s\n", entry.Output,
-		entry.CommandHash, entry.OutputHash, entry.InputHash))
-	for _, dep := range entry.Deps {
-		h.WriteString(fmt.Sprintf("d:%s,%s\n", dep.FilePath, dep.FileHash))
-	}
-	return string(h.Sum(nil))
-}
-
-func HandleUpload(ctx *fasthttp.RequestCtx) {
-	ctx.Response.Reset()
-	header, err := ctx.FormFile("file")
-	if err != nil {
-		ctx.Error(err.Error(), fasthttp.StatusInternalServerError)
-		return
-	}
-	entry, err := ParseLogEntry(ctx)
-	//==
-	slices.SortFunc(entry.Deps, func(a, b *model.DepsEntry) int {
-		return cmp.Compare(a.FilePath, b.FilePath)
-	})
-	paramsHash := HashEntry(entry)
-	//==
-	exist, err := CheckEntryExist(paramsHash)
-	if err != nil {
-		ctx.Error(err.Error(), fasthttp.StatusInternalServerError)
-		return
-	}
-	entry.ParamsHash = paramsHash
-	if exist {
-		ctx.Success("plain/text", []byte("already exists."))
-		return
-	}
-	if err := fasthttp.SaveMultipartFile(header, filepath.Join(fsRootDir, paramsHash)); err != nil {
-		ctx.Error(err.Error(), fasthttp.StatusInternalServerError)
-		return
-	}
-	//==
-	err = SaveLogEntry(entry)
-	if err != nil {
-		ctx.Error(err.Error(), fasthttp.StatusInternalServerError)
+// HandleCas serves the content-addressed store: the blob with the blake3
+// digest |digest| is read with GET, probed with HEAD and stored with PUT.
+func HandleCas(ctx *fasthttp.RequestCtx, digest string) {
+	if !IsDigest(digest) {
+		ctx.Error("bad digest", fasthttp.StatusBadRequest)
 		return
 	}
-	ctx.Success("plain/text", []byte("success"))
-}
-
-func HandleQuery(ctx *fasthttp.RequestCtx) {
-	ctx.Response.Reset()
-	instance := string(ctx.QueryArgs().Peek("instance"))
-	output := string(ctx.QueryArgs().Peek("output"))
-	commandHash := string(ctx.QueryArgs().Peek("command_hash"))
-	input_hash := string(ctx.QueryArgs().Peek("input_hash"))
-	potentialRecords, err := FindPotentialCacheRecords(instance, output, commandHash, input_hash)
-	if err != nil {
-		ctx.Error(err.Error(), fasthttp.StatusInternalServerError)
-		return
-	}
-	buf, err := json.Marshal(potentialRecords)
-	if err != nil {
-		ctx.Error(err.Error(), fasthttp.StatusInternalServerError)
-		return
+	switch {
+	case ctx.IsHead():
+		size, ok := BlobSize(digest)
+		if !ok {
+			ctx.SetStatusCode(fasthttp.StatusNotFound)
+			return
+		}
+		ctx.Response.SkipBody = true
+		ctx.Response.Header.SetContentLength(int(size))
+	case ctx.IsGet():
+		if _, ok := BlobSize(digest); !ok {
+			ctx.Error("not found", fasthttp.StatusNotFound)
+			return
+		}
+		ctx.SendFile(BlobPath(digest))
+	case ctx.IsPut():
+		if err := SaveBlob(digest, ctx.PostBody()); err != nil {
+			if errors.Is(err, errDigestMismatch) {
+				ctx.Error(err.Error(), fasthttp.StatusBadRequest)
+			} else {
+				ctx.Error(err.Error(), fasthttp.StatusInternalServerError)
+			}
+			return
+		}
+		ctx.SetStatusCode(fasthttp.StatusCreated)
+	default:
+		ctx.Error("method not allowed", fasthttp.StatusMethodNotAllowed)
 	}
-	ctx.Success("application/json", buf)
 }
 
-func UpdateRecordLastAccess(ctx *fasthttp.RequestCtx) {
-	path := string(ctx.Path())
-	paths := strings.Split(path, "/")
-	if len(paths) != 2 {
+// HandleActionCache serves the action cache: GET returns what the action
+// |key| produced, PUT records it once all its outputs are in the CAS.
+func HandleActionCache(ctx *fasthttp.RequestCtx, key string) {
+	if !IsDigest(key) {
+		ctx.Error("bad key", fasthttp.StatusBadRequest)
 		return
 	}
-	paramsHash := paths[1]
-	err := UpdateFileAccess(paramsHash)
-	if err != nil {
-		fmt.Println(err)
+	switch {
+	case ctx.IsGet():
+		entry, err := FindActionEntry(key)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				ctx.Error("not found", fasthttp.StatusNotFound)
+			} else {
+				ctx.Error(err.Error(), fasthttp.StatusInternalServerError)
+			}
+			return
+		}
+		buf, err := json.Marshal(entry)
+		if err != nil {
+			ctx.Error(err.Error(), fasthttp.StatusInternalServerError)
+			return
+		}
+		if err := UpdateActionAccess(entry.ID); err != nil {
+			fmt.Println(err)
+		}
+		ctx.Success("application/json", buf)
+	case ctx.IsPut():
+		var entry model.ActionEntry
+		if err := json.Unmarshal(ctx.PostBody(), &entry); err != nil {
+			ctx.Error(err.Error(), fasthttp.StatusBadRequest)
+			return
+		}
+		for _, output := range entry.Outputs {
+			if !IsDigest(output.Digest) {
+				ctx.Error("bad digest for "+output.Path, fasthttp.StatusBadRequest)
+				return
+			}
+			if _, ok := BlobSize(output.Digest); !ok {
+				ctx.Error("missing blob for "+output.Path, fasthttp.StatusBadRequest)
+				return
+			}
+		}
+		expired_duration_str := string(ctx.QueryArgs().Peek("expired_duration"))
+		expired_duration := 12 * time.Hour
+		if expired_duration_str != "" {
+			d, err := time.ParseDuration(expired_duration_str)
+			if err != nil {
+				ctx.Error(err.Error(), fasthttp.StatusBadRequest)
+				return
+			}
+			expired_duration = d
+		}
+		now := time.Now().Unix()
+		entry.Key = key
+		entry.CreatedAt = now
+		entry.LastAccess = now
+		entry.ExpiredDuration = int64(expired_duration / time.Second)
+		if err := SaveActionEntry(&entry); err != nil {
+			ctx.Error(err.Error(), fasthttp.StatusInternalServerError)
+			return
+		}
+		ctx.SetStatusCode(fasthttp.StatusCreated)
+	default:
+		ctx.Error("method not allowed", fasthttp.StatusMethodNotAllowed)
 	}
 }
 
@@ -178,16 +175,20 @@ func ServeFiles(addr, rootDir string, compress, byteRange, generateIndexPages, v
 	//   * /stats?r=fs will show only stats (expvars) containing 'fs'
 	//     in their names.
 	requestHandler := func(ctx *fasthttp.RequestCtx) {
-		switch string(ctx.Path()) {
-		//case "/stats":
+		path := string(ctx.Path())
+		switch {
+		//case path == "/stats":
 		//	expvarhandler.ExpvarHandler(ctx)
-		case "/upload":
-			HandleUpload(ctx)
-		case "/query":
-			HandleQuery(ctx)
+		case strings.HasPrefix(path, "/cas/"):
+			HandleCas(ctx, strings.TrimPrefix(path, "/cas/"))
+		case strings.HasPrefix(path, "/ac/"):
+			HandleActionCache(ctx, strings.TrimPrefix(path, "/ac/"))
+		case strings.HasPrefix(path, "/exec/"):
+			HandleExec(ctx, strings.TrimPrefix(path, "/exec/"))
+		case strings.HasPrefix(path, "/jobs/"):
+			HandleJobs(ctx, strings.TrimPrefix(path, "/jobs/"))
 		default:
 			fsHandler(ctx)
-			UpdateRecordLastAccess(ctx)
 			//updateFSCounters(ctx)
 		}
 	}
@@ -199,6 +200,8 @@ func ServeFiles(addr, rootDir string, compress, byteRange, generateIndexPages, v
 			ReadTimeout:  15 * time.Minute,
 			WriteTimeout: 15 * time.Minute,
 			Concurrency:  256 * 1024,
+			// Outputs are uploaded whole.
+			MaxRequestBodySize: 1 << 30,
 		}
 		if err := fsServer.ListenAndServe(addr); err != nil {
 			log.Fatalf("error in ListenAndServe: %v", err)
@@ -9,7 +9,11 @@ import (
 var DB *gorm.DB = nil
 
 func migrate() error {
-	err := DB.AutoMigrate(&model.RbeLogEntry{})
+	err := DB.AutoMigrate(&model.ActionEntry{})
+	if err != nil {
+		return err
+	}
+	err = DB.AutoMigrate(&model.OutputEntry{})
 	if err != nil {
 		return err
 	}
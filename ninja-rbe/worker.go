@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/zeebo/blake3"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+)
+
+// How long a timed out job gets to exit after being asked to before it is
+// killed.
+const jobKillGracePeriod = 5 * time.Second
+
+// Worker runs the jobs of a ninja-rbe server in scratch directories.  The
+// blobs of inputs are kept in a local cache, so that the files most jobs
+// share, such as headers, are only fetched once.
+type Worker struct {
+	server  string
+	scratch string
+	client  *http.Client
+}
+
+func NewWorker(server, scratch string) (*Worker, error) {
+	if err := os.MkdirAll(filepath.Join(scratch, "cas"), 0755); err != nil {
+		return nil, err
+	}
+	return &Worker{server: server, scratch: scratch, client: &http.Client{}}, nil
+}
+
+// RunWorker runs up to |jobs| jobs of |server| at once, until stopped.
+func RunWorker(server, scratch string, jobs int) {
+	worker, err := NewWorker(server, scratch)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	log.Printf("Running %d jobs at once for %s in %s", jobs, server, scratch)
+	for i := 0; i < jobs; i++ {
+		go worker.Loop()
+	}
+}
+
+func (w *Worker) Loop() {
+	for {
+		job, err := w.Take()
+		if err != nil {
+			log.Println(err)
+			time.Sleep(time.Second)
+			continue
+		}
+		if job == nil {
+			continue
+		}
+		result := w.Run(job)
+		if err := w.Report(job, result); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// Take waits for the next job, or returns nil if none came.
+func (w *Worker) Take() (*ExecJob, error) {
+	resp, err := w.client.Post(w.server+"/jobs/", "application/json", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNoContent {
+		return nil, nil
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("taking a job: StatusCode: %v, Body: %s", resp.StatusCode, string(data))
+	}
+	var job ExecJob
+	if err := json.Unmarshal(data, &job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+func (w *Worker) Report(job *ExecJob, result *ExecResult) error {
+	body, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("PUT", w.server+"/jobs/"+job.ID, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		// The client is gone; nobody waits for the result.
+		io.Copy(io.Discard, resp.Body)
+	}
+	return nil
+}
+
+// Run materializes the inputs of |job|, runs it and uploads its outputs.
+func (w *Worker) Run(job *ExecJob) *ExecResult {
+	dir, err := os.MkdirTemp(w.scratch, "job-")
+	if err != nil {
+		return &ExecResult{ExitCode: -1, Error: err.Error()}
+	}
+	defer os.RemoveAll(dir)
+	local := func(path string) (string, error) {
+		if !filepath.IsLocal(path) {
+			return "", fmt.Errorf("path %s leaves the input root", path)
+		}
+		return filepath.Join(dir, path), nil
+	}
+	for _, input := range job.Inputs {
+		path, err := local(input.Path)
+		if err == nil {
+			err = w.Materialize(input, path)
+		}
+		if err != nil {
+			return &ExecResult{ExitCode: -1, Error: err.Error()}
+		}
+	}
+	wd := dir
+	if job.WorkingDirectory != "" {
+		if wd, err = local(job.WorkingDirectory); err != nil {
+			return &ExecResult{ExitCode: -1, Error: err.Error()}
+		}
+	}
+	for _, output := range job.Outputs {
+		path, err := local(filepath.Join(job.WorkingDirectory, output))
+		if err == nil {
+			err = os.MkdirAll(filepath.Dir(path), 0755)
+		}
+		if err != nil {
+			return &ExecResult{ExitCode: -1, Error: err.Error()}
+		}
+	}
+
+	ctx := context.Background()
+	if job.TimeoutMs > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(job.TimeoutMs)*time.Millisecond)
+		defer cancel()
+	}
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", job.Command)
+	cmd.Dir = wd
+	killOnCancel(cmd)
+	// Don't wait for children that ignore the termination but hold the
+	// output open any longer than it takes to kill them.
+	cmd.WaitDelay = jobKillGracePeriod
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	err = cmd.Run()
+	result := &ExecResult{Output: out.String()}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		result.ExitCode = exitErr.ExitCode()
+	} else if err != nil {
+		result.ExitCode = -1
+		result.Error = err.Error()
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		result.TimedOut = true
+	}
+	if result.ExitCode != 0 || result.TimedOut {
+		return result
+	}
+
+	for _, output := range job.Outputs {
+		path := filepath.Join(wd, output)
+		info, err := os.Stat(path)
+		if err != nil || !info.Mode().IsRegular() {
+			// A restat rule may not write all of its outputs.
+			continue
+		}
+		digest, err := w.Upload(path)
+		if err != nil {
+			result.ExitCode = -1
+			result.Error = err.Error()
+			return result
+		}
+		result.Outputs = append(result.Outputs, &ExecOutput{Path: output, Digest: digest,
+			Size: info.Size(), Executable: info.Mode()&0111 != 0})
+	}
+	return result
+}
+
+// Materialize copies the blob of |input| to |path|, fetching it into the
+// local cache if needed.  Inputs are copied rather than linked, so that a
+// command writing to one can't spoil the cache.
+func (w *Worker) Materialize(input *ExecInput, path string) error {
+	if !IsDigest(input.Digest) {
+		return fmt.Errorf("bad digest for %s", input.Path)
+	}
+	cached := filepath.Join(w.scratch, "cas", input.Digest)
+	if _, err := os.Stat(cached); err != nil {
+		if err := w.Download(input.Digest, cached); err != nil {
+			return err
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	mode := os.FileMode(0644)
+	if input.Executable {
+		mode = 0755
+	}
+	src, err := os.Open(cached)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	if err1 := dst.Close(); err == nil {
+		err = err1
+	}
+	return err
+}
+
+func (w *Worker) Download(digest, path string) error {
+	resp, err := w.client.Get(w.server + "/cas/" + digest)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetching blob %s: StatusCode: %v", digest, resp.StatusCode)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), digest+".*.tmp")
+	if err != nil {
+		return err
+	}
+	h := blake3.New()
+	_, err = io.Copy(io.MultiWriter(tmp, h), resp.Body)
+	if err1 := tmp.Close(); err == nil {
+		err = err1
+	}
+	if err == nil && hex.EncodeToString(h.Sum(nil)) != digest {
+		err = fmt.Errorf("fetching blob %s: %v", digest, errDigestMismatch)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// Upload stores the file |path| in the CAS unless it has it, and returns
+// its digest.
+func (w *Worker) Upload(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	sum := blake3.Sum256(data)
+	digest := hex.EncodeToString(sum[:])
+	url := w.server + "/cas/" + digest
+	resp, err := w.client.Head(url)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return digest, nil
+	}
+	req, err := http.NewRequest("PUT", url, bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	resp, err = w.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return "", fmt.Errorf("uploading %s: StatusCode: %v, Body: %s", path, resp.StatusCode, string(body))
+	}
+	return digest, nil
+}
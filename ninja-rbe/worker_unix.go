@@ -0,0 +1,23 @@
+//go:build !windows
+
+package main
+
+import (
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// killOnCancel makes a timed out |cmd| take its whole process group with it:
+// the shell alone would leave the compiler it started running.  The group is
+// asked to exit first, and killed jobKillGracePeriod later.
+func killOnCancel(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		pid := cmd.Process.Pid
+		time.AfterFunc(jobKillGracePeriod, func() {
+			syscall.Kill(-pid, syscall.SIGKILL)
+		})
+		return syscall.Kill(-pid, syscall.SIGTERM)
+	}
+}
@@ -0,0 +1,9 @@
+//go:build windows
+
+package main
+
+import "os/exec"
+
+// killOnCancel leaves |cmd| to exec.CommandContext, which kills the process
+// itself when it times out.
+func killOnCancel(cmd *exec.Cmd) {}